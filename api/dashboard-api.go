@@ -1,22 +1,109 @@
 package api
 
 import (
+	"io"
 	"net/http"
 	"qiot-configuration-service/config"
 	"qiot-configuration-service/service"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func NewDashboardAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
 	dashboardService := service.NewDashboardService(appConfig)
+	ginEngine.GET("/dashboard/:experimentId", func(c *gin.Context) {
+		experimentDashboard(c, dashboardService, c.Param("experimentId"), queryParams(c), c.Query("gateway") == "true")
+	})
+	ginEngine.GET("/dashboard/:experimentId/stream", func(c *gin.Context) {
+		streamDashboard(c, dashboardService, c.Param("experimentId"), queryList(c, "series"), queryParams(c), c.Query("gateway") == "true", appConfig.Settings.Dashboard.Interval())
+	})
 	ginEngine.GET("/dashboard/:experimentId/device/:sensorId", func(c *gin.Context) {
-		dashboardForSensor(c, dashboardService, c.Param("experimentId"), c.Param("sensorId"))
+		dashboardForSensor(c, dashboardService, c.Param("experimentId"), c.Param("sensorId"), queryParams(c), c.Query("gateway") == "true")
 	})
 }
 
-func dashboardForSensor(c *gin.Context, es *service.DashboardService, experimentId string, characteristicId string) {
-	result, _ := es.GetDashboardData(experimentId, characteristicId)
+// queryParams collects the time window parameters shared by the dashboard endpoints.
+func queryParams(c *gin.Context) config.QueryParams {
+	return config.QueryParams{
+		Start: c.Query("start"),
+		Stop:  c.Query("stop"),
+		Every: c.Query("every"),
+		Fn:    c.Query("fn"),
+	}
+}
+
+// queryList splits a comma separated query parameter, skipping empty items.
+func queryList(c *gin.Context, key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(c.Query(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func dashboardForSensor(c *gin.Context, es *service.DashboardService, experimentId string, characteristicId string, params config.QueryParams, includeGateway bool) {
+	result, err := es.GetDashboardData(c.Request.Context(), experimentId, characteristicId, params, includeGateway)
+	if err != nil {
+		respondWithError(c, err, "Error fetching dashboard data")
+		return
+	}
 	c.IndentedJSON(http.StatusOK, result)
 
 }
+
+func experimentDashboard(c *gin.Context, ds *service.DashboardService, experimentId string, params config.QueryParams, includeGateway bool) {
+	result, err := ds.GetExperimentDashboard(c.Request.Context(), experimentId, params, includeGateway)
+	if err != nil {
+		respondWithError(c, err, "Error fetching dashboard data")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// streamDashboard sends the points of the experiment series as Server-Sent
+// Events until the client disconnects: a "series" event listing the followed
+// series, then at every interval a "points" event per series with new points
+// and an "error" event per failed query.
+func streamDashboard(c *gin.Context, ds *service.DashboardService, experimentId string, ids []string, params config.QueryParams, includeGateway bool, interval time.Duration) {
+	stream, err := ds.OpenStream(experimentId, ids, params, includeGateway)
+	if err != nil {
+		respondWithError(c, err, "Error opening the dashboard stream")
+		return
+	}
+	defer stream.Close()
+	c.Header("Cache-Control", "no-cache")
+	// keep reverse proxies (nginx) from buffering the events
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("series", stream.Series())
+
+	ctx := c.Request.Context()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		updates := stream.Poll(ctx)
+		if ctx.Err() != nil {
+			return false
+		}
+		for _, update := range updates {
+			event := "points"
+			if update.Error != "" {
+				event = "error"
+			}
+			c.SSEvent(event, update)
+		}
+		if len(updates) == 0 {
+			// a comment line keeps idle connections open
+			_, _ = io.WriteString(w, ": keepalive\n\n")
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	})
+}
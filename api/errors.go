@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"qiot-configuration-service/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorResponse is the JSON envelope returned by every failed request.
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusNotFound:            "not_found",
+	http.StatusConflict:            "conflict",
+	http.StatusTooManyRequests:     "too_many_requests",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusBadGateway:          "bad_gateway",
+	http.StatusGatewayTimeout:      "timeout",
+}
+
+// statusForError maps the sentinel errors of the config package to an HTTP status.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, config.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, config.ErrValidation), errors.Is(err, config.ErrInvalidQuery):
+		return http.StatusBadRequest
+	case errors.Is(err, config.ErrDuplicateKey), errors.Is(err, config.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, config.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, config.ErrUpstream):
+		return http.StatusBadGateway
+	case errors.Is(err, config.ErrTooManyRequests):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// respondError writes the error envelope with the given status.
+func respondError(c *gin.Context, status int, message string, details interface{}) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: c.GetString(requestIDKey),
+	})
+}
+
+// respondWithError picks the status from err; the error text is exposed as
+// details except for internal errors, which are only logged.
+func respondWithError(c *gin.Context, err error, message string) {
+	status := statusForError(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("[%s] %s: %v", c.GetString(requestIDKey), message, err)
+		respondError(c, status, message, nil)
+		return
+	}
+	respondError(c, status, message, err.Error())
+}
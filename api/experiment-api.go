@@ -1,9 +1,12 @@
 package api
 
 import (
+	"fmt"
+	"log"
 	"net/http"
 	"qiot-configuration-service/config"
 	"qiot-configuration-service/service"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -20,13 +23,14 @@ func NewExperimentAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine)
 	ginEngine.GET("/experiment/json/:id", func(c *gin.Context) {
 		getExperimentByIdJson(c, es, c.Param("id"))
 	})
-	ginEngine.GET("/experiment/:id", func(c *gin.Context) {
-		getRawExperimentById(c, es, c.Param("id"))
+	// gin needs the same wildcard name on every GET route under /experiment/
+	ginEngine.GET("/experiment/:experimentId", func(c *gin.Context) {
+		getRawExperimentById(c, es, c.Param("experimentId"))
 	})
 	ginEngine.POST("/experiment", func(c *gin.Context) {
 		var body bson.M
 		if err := c.ShouldBindJSON(&body); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 			return
 		}
 		insertExperiment(c, es, body)
@@ -34,17 +38,74 @@ func NewExperimentAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine)
 	ginEngine.PUT("/experiment/:experimentId", func(c *gin.Context) {
 		var body bson.M
 		if err := c.ShouldBindJSON(&body); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 			return
 		}
 		updateExperiment(c, es, c.Param("experimentId"), body)
 	})
+	ginEngine.DELETE("/experiment/:experimentId", func(c *gin.Context) {
+		deleteExperiment(c, es, c.Param("experimentId"))
+	})
+	ginEngine.GET("/experiment/:experimentId/emqx/definitions", func(c *gin.Context) {
+		getEMQXDefinitions(c, es, c.Param("experimentId"))
+	})
+	ginEngine.GET("/experiment/:experimentId/emqx/plan", func(c *gin.Context) {
+		planEMQX(c, es, c.Param("experimentId"))
+	})
+	ginEngine.POST("/experiment/:experimentId/emqx/apply", func(c *gin.Context) {
+		applyEMQX(c, es, c.Param("experimentId"))
+	})
+	ginEngine.GET("/experiment/:experimentId/emqx/status", func(c *gin.Context) {
+		getEMQXStatus(c, es, c.Param("experimentId"))
+	})
+	ginEngine.GET("/experiment/:experimentId/ingestion", func(c *gin.Context) {
+		getIngestion(c, es, c.Param("experimentId"))
+	})
+	exports := service.NewExportService(appConfig)
+	ginEngine.GET("/experiment/:experimentId/export", func(c *gin.Context) {
+		request := service.ExportRequest{
+			Format:         c.Query("format"),
+			Layout:         c.Query("layout"),
+			Params:         queryParams(c),
+			Devices:        queryList(c, "devices"),
+			IncludeGateway: c.Query("gateway") == "true",
+		}
+		exportExperiment(c, exports, c.Param("experimentId"), request)
+	})
+	stats := service.NewStatsService(appConfig)
+	ginEngine.GET("/experiment/:experimentId/stats", func(c *gin.Context) {
+		percentiles := []float64{}
+		for _, item := range queryList(c, "percentiles") {
+			p, err := strconv.ParseFloat(item, 64)
+			if err != nil {
+				respondError(c, http.StatusBadRequest, "Invalid percentiles", err.Error())
+				return
+			}
+			percentiles = append(percentiles, p)
+		}
+		request := service.StatsRequest{
+			Params:         queryParams(c),
+			Percentiles:    percentiles,
+			Method:         c.Query("method"),
+			Devices:        queryList(c, "devices"),
+			IncludeGateway: c.Query("gateway") == "true",
+		}
+		experimentStats(c, stats, c.Param("experimentId"), request)
+	})
+	ginEngine.GET("/topics/migration", func(c *gin.Context) {
+		getTopicMigrationReport(c, es)
+	})
+	for _, action := range []string{"start", "pause", "stop", "archive"} {
+		ginEngine.POST("/experiment/:experimentId/"+action, func(c *gin.Context) {
+			transitionExperiment(c, es, c.Param("experimentId"), action)
+		})
+	}
 }
 
 func getExperiments(c *gin.Context, es *service.ExperimentService) {
 	result, err := es.GetAllExperiments()
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error fetching data from database"})
+		respondWithError(c, err, "Error fetching data from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, result)
@@ -52,7 +113,7 @@ func getExperiments(c *gin.Context, es *service.ExperimentService) {
 func getRawExperimentById(c *gin.Context, es *service.ExperimentService, experimentId string) {
 	result, err := es.GetRawExperimentById(experimentId)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error fetching experiment from database"})
+		respondWithError(c, err, "Error fetching experiment from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, result)
@@ -60,33 +121,152 @@ func getRawExperimentById(c *gin.Context, es *service.ExperimentService, experim
 func getExperimentByIdYaml(c *gin.Context, es *service.ExperimentService, experimentId string) {
 	result, err := es.GetCompleteExperimentById(experimentId)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error while fetching experiment from database"})
+		respondWithError(c, err, "Error while fetching experiment from database")
 		return
 	}
+	// the YAML is the gateway configuration: it carries the MQTT logins
+	credentials, err := es.GatewayCredentials(experimentId)
+	if err != nil {
+		respondWithError(c, err, "Error while fetching MQTT credentials")
+		return
+	}
+	result["mqttCredentials"] = credentials
 	c.YAML(http.StatusOK, gin.H(result))
 }
 func getExperimentByIdJson(c *gin.Context, es *service.ExperimentService, experimentId string) {
 	result, err := es.GetCompleteExperimentById(experimentId)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error while fetching experiment from database"})
+		respondWithError(c, err, "Error while fetching experiment from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, gin.H(result))
 }
 
 func insertExperiment(c *gin.Context, es *service.ExperimentService, data bson.M) {
-	_, err := es.InsertExperiment(data)
+	inserted, jobId, credentials, err := es.InsertExperiment(data)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error while inserting experiment"})
+		if inserted != nil {
+			// the experiment is stored: report the failed provisioning with its id, any queued job and any issued credentials
+			respondError(c, statusForError(err), "Experiment inserted but its MQTT credentials or EMQX provisioning failed", gin.H{"id": inserted, "jobId": jobId, "mqttCredentials": credentials})
+			return
+		}
+		respondWithError(c, err, "Error while inserting experiment")
 		return
 	}
-	c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment inserted successfully"})
+	if jobId == "" {
+		// built-in ingestion: nothing to provision
+		c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment inserted successfully", "id": inserted})
+		return
+	}
+	c.IndentedJSON(http.StatusAccepted, gin.H{"result": "Experiment inserted, EMQX provisioning queued", "id": inserted, "jobId": jobId, "mqttCredentials": credentials})
 }
 func updateExperiment(c *gin.Context, es *service.ExperimentService, experimentId string, data bson.M) {
-	_, err := es.UpdateExperiment(experimentId, data)
+	_, jobId, credentials, err := es.UpdateExperiment(experimentId, data)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error while updating experiment"})
+		if credentials != nil || jobId != "" {
+			// the experiment is updated: report the failed provisioning with any queued job and the issued credentials, not shown again
+			respondError(c, statusForError(err), "Experiment updated but its MQTT credentials or EMQX provisioning failed", gin.H{"jobId": jobId, "mqttCredentials": credentials})
+			return
+		}
+		respondWithError(c, err, "Error while updating experiment")
+		return
+	}
+	if jobId == "" {
+		c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment updated successfully"})
+		return
+	}
+	c.IndentedJSON(http.StatusAccepted, gin.H{"result": "Experiment updated, EMQX provisioning queued", "jobId": jobId, "mqttCredentials": credentials})
+}
+func getEMQXStatus(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	report, err := es.GetEMQXStatus(experimentId)
+	if err != nil {
+		respondWithError(c, err, "Error while fetching EMQX sync status")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, report)
+}
+func getIngestion(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	ingestion, err := es.GetIngestion(experimentId)
+	if err != nil {
+		respondWithError(c, err, "Error while fetching EMQX metrics")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, ingestion)
+}
+func deleteExperiment(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	if err := es.DeleteExperiment(experimentId); err != nil {
+		respondWithError(c, err, "Error while deleting experiment")
 		return
 	}
-	c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment updated successfully"})
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment deleted successfully"})
+}
+func transitionExperiment(c *gin.Context, es *service.ExperimentService, experimentId string, action string) {
+	status, err := es.TransitionExperiment(experimentId, action)
+	if err != nil {
+		respondWithError(c, err, "Error while changing experiment status")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Experiment status changed successfully", "status": status})
+}
+func getEMQXDefinitions(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	definitions, err := es.GetEMQXDefinitions(experimentId)
+	if err != nil {
+		respondWithError(c, err, "Error while generating EMQX definitions")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, definitions)
+}
+func getTopicMigrationReport(c *gin.Context, es *service.ExperimentService) {
+	report, err := es.TopicMigrationReport()
+	if err != nil {
+		respondWithError(c, err, "Error while computing topic migration report")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, report)
+}
+func planEMQX(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	plan, err := es.PlanEMQX(experimentId)
+	if err != nil {
+		respondWithError(c, err, "Error while computing EMQX plan")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, plan)
+}
+func applyEMQX(c *gin.Context, es *service.ExperimentService, experimentId string) {
+	plan, report, err := es.ApplyEMQX(experimentId)
+	if err != nil {
+		if report != nil {
+			respondError(c, statusForError(err), "Error while applying EMQX plan", gin.H{"plan": plan, "emqx": report})
+			return
+		}
+		respondWithError(c, err, "Error while applying EMQX plan")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"plan": plan, "emqx": report})
+}
+
+// exportExperiment streams the export as a zip archive. Once the data files
+// are being sent the status cannot change: a failure is logged and leaves the
+// archive without its central directory, so clients see it as truncated.
+func exportExperiment(c *gin.Context, exports *service.ExportService, experimentId string, request service.ExportRequest) {
+	export, err := exports.PrepareExport(experimentId, request)
+	if err != nil {
+		respondWithError(c, err, "Error preparing the export")
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.FileName()))
+	c.Status(http.StatusOK)
+	if err := export.WriteTo(c.Request.Context(), c.Writer); err != nil {
+		log.Printf("[%s] export of experiment %s interrupted: %v", c.GetString(requestIDKey), experimentId, err)
+	}
+}
+
+func experimentStats(c *gin.Context, stats *service.StatsService, experimentId string, request service.StatsRequest) {
+	result, err := stats.GetExperimentStats(c.Request.Context(), experimentId, request)
+	if err != nil {
+		respondWithError(c, err, "Error computing experiment statistics")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, result)
 }
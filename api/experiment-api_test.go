@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/service"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// An update that issues credentials and then fails to queue its provisioning
+// still returns the credentials, which are not shown again.
+func TestUpdateExperimentPartialFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("enqueue fails", func(mt *mtest.T) {
+		oid := primitive.NewObjectID()
+		mt.AddMockResponses(
+			// the stored experiment
+			mtest.CreateCursorResponse(0, "db.experiments", mtest.FirstBatch, bson.D{{Key: "_id", Value: oid}, {Key: "status", Value: service.StatusDraft}}),
+			// its replacement
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			// no active credentials, then the credential of the new gateway
+			mtest.CreateCursorResponse(0, "db.mqttCredentials", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			// the provisioning job
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Name: "InterruptedAtShutdown", Message: "shutting down"}),
+		)
+		settings := &config.Settings{Ingestion: config.IngestionSettings{Mode: config.IngestionEMQX}}
+		es := &service.ExperimentService{AppConfig: &config.AppConfiguration{Settings: settings, Mongo: &config.MongoClient{Database: mt.DB}}}
+
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		updateExperiment(c, es, oid.Hex(), bson.M{"name": "e1", "gateways": bson.A{"gw1"}})
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+		}
+		var response struct {
+			Details struct {
+				JobID       string                   `json:"jobId"`
+				Credentials []service.MQTTCredential `json:"mqttCredentials"`
+			} `json:"details"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%v: %s", err, recorder.Body)
+		}
+		credentials := response.Details.Credentials
+		if len(credentials) != 1 || credentials[0].Gateway != "gw1" || credentials[0].Username != oid.Hex()+"_gw1" || credentials[0].Password == "" {
+			t.Errorf("mqttCredentials = %+v, want the credential of gw1", credentials)
+		}
+		if response.Details.JobID != "" {
+			t.Errorf("jobId = %q, want none", response.Details.JobID)
+		}
+	})
+}
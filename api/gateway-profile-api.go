@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/service"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func NewGatewayProfileAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
+	gs := service.NewGatewayProfileService(appConfig)
+	ginEngine.GET("/gateway-profile", func(c *gin.Context) {
+		getGatewayProfiles(c, gs)
+	})
+	ginEngine.GET("/gateway-profile/:name", func(c *gin.Context) {
+		getGatewayProfile(c, gs, c.Param("name"))
+	})
+	ginEngine.POST("/gateway-profile", func(c *gin.Context) {
+		var body bson.M
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+		insertGatewayProfile(c, gs, body)
+	})
+	ginEngine.PUT("/gateway-profile/:name", func(c *gin.Context) {
+		var body bson.M
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+		updateGatewayProfile(c, gs, c.Param("name"), body)
+	})
+	ginEngine.DELETE("/gateway-profile/:name", func(c *gin.Context) {
+		deleteGatewayProfile(c, gs, c.Param("name"))
+	})
+}
+
+func getGatewayProfiles(c *gin.Context, gs *service.GatewayProfileService) {
+	result, err := gs.GetAllGatewayProfiles()
+	if err != nil {
+		respondWithError(c, err, "Error fetching gateway profiles from database")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
+func getGatewayProfile(c *gin.Context, gs *service.GatewayProfileService, name string) {
+	result, err := gs.GetGatewayProfile(name)
+	if err != nil {
+		respondWithError(c, err, "Error fetching gateway profile from database")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
+func insertGatewayProfile(c *gin.Context, gs *service.GatewayProfileService, data bson.M) {
+	if err := gs.InsertGatewayProfile(data); err != nil {
+		respondWithError(c, err, "Error while inserting gateway profile")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Gateway profile inserted successfully"})
+}
+func updateGatewayProfile(c *gin.Context, gs *service.GatewayProfileService, name string, data bson.M) {
+	if err := gs.UpdateGatewayProfile(name, data); err != nil {
+		respondWithError(c, err, "Error while updating gateway profile")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Gateway profile updated successfully"})
+}
+func deleteGatewayProfile(c *gin.Context, gs *service.GatewayProfileService, name string) {
+	if err := gs.DeleteGatewayProfile(name); err != nil {
+		respondWithError(c, err, "Error while deleting gateway profile")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Gateway profile deleted successfully"})
+}
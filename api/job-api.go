@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func NewJobAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
+	js := service.NewJobService(appConfig)
+	ginEngine.GET("/jobs/:id", func(c *gin.Context) {
+		getJob(c, js, c.Param("id"))
+	})
+}
+
+func getJob(c *gin.Context, js *service.JobService, jobId string) {
+	job, err := js.GetJob(jobId)
+	if err != nil {
+		respondWithError(c, err, "Error while fetching job")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, job)
+}
@@ -20,7 +20,7 @@ func NewSensorAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
 	ginEngine.POST("/sensor", func(c *gin.Context) {
 		var body bson.M
 		if err := c.ShouldBindJSON(&body); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 			return
 		}
 		insertSensorConfiguration(c, ss, body)
@@ -28,11 +28,22 @@ func NewSensorAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
 	ginEngine.PUT("/sensor/:sensorId", func(c *gin.Context) {
 		var body bson.M
 		if err := c.ShouldBindJSON(&body); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 			return
 		}
 		editSensorConfiguration(c, ss, c.Param("sensorId"), body)
 	})
+	ginEngine.DELETE("/sensor/:sensorId", func(c *gin.Context) {
+		deleteSensor(c, ss, c.Param("sensorId"), c.Query("force") == "true")
+	})
+	ginEngine.POST("/sensor/:sensorId/preview", func(c *gin.Context) {
+		var body service.PreviewRequest
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+		previewParser(c, ss, c.Param("sensorId"), body)
+	})
 	ginEngine.GET("/sensor/:sensorId/characteristic/:serviceUuid", func(c *gin.Context) {
 		getCharacteristic(c, ss, c.Param("sensorId"), c.Param("serviceUuid"))
 	})
@@ -41,16 +52,16 @@ func NewSensorAPI(appConfig *config.AppConfiguration, ginEngine *gin.Engine) {
 func getSensors(c *gin.Context, ss *service.SensorService) {
 	result, err := ss.GetAllSensors()
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error fetching data from database"})
+		respondWithError(c, err, "Error fetching data from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, result)
 }
 
 func getSensorById(c *gin.Context, ss *service.SensorService, sensorId string) {
-	sensor, err := ss.GetSensorById(sensorId)
+	sensor, err := ss.GetNormalizedSensor(sensorId)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error fetching sensor from database"})
+		respondWithError(c, err, "Error fetching sensor from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, sensor)
@@ -59,27 +70,42 @@ func getSensorById(c *gin.Context, ss *service.SensorService, sensorId string) {
 func insertSensorConfiguration(c *gin.Context, ss *service.SensorService, data bson.M) {
 	_, errConfiguration := ss.InsertSensor(data)
 	if errConfiguration != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error inserting configuration into database"})
+		respondWithError(c, errConfiguration, "Error inserting configuration into database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, gin.H{"result": "Sensor inserted successfully"})
 }
 func editSensorConfiguration(c *gin.Context, ss *service.SensorService, sensorId string, data bson.M) {
-	modifiedCount, errUpdate := ss.EditSensorConfiguration(
+	_, errUpdate := ss.EditSensorConfiguration(
 		sensorId,
 		data,
 	)
-	if errUpdate != nil || modifiedCount == 0 {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error updating sensor configuration in database"})
+	if errUpdate != nil {
+		respondWithError(c, errUpdate, "Error updating sensor configuration in database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, gin.H{"result": "Sensor updated successfully"})
 }
+func deleteSensor(c *gin.Context, ss *service.SensorService, sensorId string, force bool) {
+	if err := ss.DeleteSensor(sensorId, force); err != nil {
+		respondWithError(c, err, "Error deleting sensor")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"result": "Sensor deleted successfully"})
+}
 func getCharacteristic(c *gin.Context, ss *service.SensorService, sensorId string, serviceUuid string) {
 	characteristics, err := ss.GetCharacteristic(sensorId, serviceUuid)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Error fetching characteristics from database"})
+		respondWithError(c, err, "Error fetching characteristics from database")
 		return
 	}
 	c.IndentedJSON(http.StatusOK, characteristics)
 }
+func previewParser(c *gin.Context, ss *service.SensorService, sensorId string, request service.PreviewRequest) {
+	result, err := ss.PreviewParser(sensorId, request)
+	if err != nil {
+		respondWithError(c, err, "Error while previewing the parser")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, result)
+}
@@ -1,15 +1,66 @@
 package config
 
+import (
+	"log"
+	"qiot-configuration-service/topic"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// InfluxTarget identifies where the data of an experiment is written (EMQX
+// connector) and read back (Influx org and bucket).
+type InfluxTarget struct {
+	Org       string
+	Bucket    string
+	Connector string
+}
+
 type AppConfiguration struct {
-	Mongo  *MongoClient
-	Influx *InfluxClient
+	Settings     *Settings
+	Mongo        *MongoClient
+	Influx       *InfluxClient
+	InfluxTarget InfluxTarget
+	Topics       *topic.Namer
 }
 
-func NewAppConfiguration() *AppConfiguration {
-	mongo := NewMongoClient()
-	influx := NewInfluxClient()
+func NewAppConfiguration(settings *Settings) *AppConfiguration {
+	mongo := NewMongoClient(settings.Mongo)
+	influx := NewInfluxClient(settings.Influx)
+	// the templates are validated with the settings
+	topics, err := topic.NewNamer(settings.MQTT.TopicTemplate, settings.MQTT.WhiteboardTopicTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &AppConfiguration{
-		Mongo:  mongo,
-		Influx: influx,
+		Settings: settings,
+		Mongo:    mongo,
+		Influx:   influx,
+		InfluxTarget: InfluxTarget{
+			Org:       settings.Influx.Org,
+			Bucket:    settings.Influx.Bucket,
+			Connector: settings.EMQX.Connector,
+		},
+		Topics: topics,
+	}
+}
+
+// TargetFor returns the Influx target of an experiment: the configured defaults,
+// overridden by the optional "influx" object (org, bucket, connector) of the
+// experiment document.
+func (ac *AppConfiguration) TargetFor(experiment bson.M) InfluxTarget {
+	target := ac.InfluxTarget
+	override, ok := experiment["influx"].(bson.M)
+	if !ok {
+		return target
+	}
+	if v, ok := override["org"].(string); ok && v != "" {
+		target.Org = v
+	}
+	if v, ok := override["bucket"].(string); ok && v != "" {
+		target.Bucket = v
+	}
+	if v, ok := override["connector"].(string); ok && v != "" {
+		target.Connector = v
 	}
+	return target
 }
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Sentinel errors returned (wrapped) by the storage clients. Callers match them
+// with errors.Is; the api package maps them to HTTP status codes.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrDuplicateKey = errors.New("duplicate key")
+	ErrValidation   = errors.New("validation failed")
+	ErrTimeout      = errors.New("timeout")
+	ErrConflict     = errors.New("conflict")
+	// ErrUpstream reports a failure of an external service (e.g. EMQX).
+	ErrUpstream = errors.New("upstream service error")
+	// ErrTooManyRequests reports a request refused by a concurrency limit.
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// mongo error code for a document rejected by the collection validator
+const documentValidationFailure = 121
+
+// mongoError wraps a driver error with the matching sentinel, keeping the original error in the chain.
+func mongoError(operation string, err error) error {
+	var serverError mongo.ServerError
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("%s: %w", operation, ErrNotFound)
+	case mongo.IsDuplicateKeyError(err):
+		return fmt.Errorf("%s: %w: %w", operation, ErrDuplicateKey, err)
+	case mongo.IsTimeout(err), errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%s: %w: %w", operation, ErrTimeout, err)
+	case errors.As(err, &serverError) && serverError.HasErrorCode(documentValidationFailure):
+		return fmt.Errorf("%s: %w: %w", operation, ErrValidation, err)
+	}
+	return fmt.Errorf("%s: %w", operation, err)
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FluxQuery builds a Flux script stage by stage. Every value coming from the
+// caller (bucket, column names, filter values) is emitted as an escaped string
+// literal, so it can never terminate the literal or inject further pipeline
+// stages.
+type FluxQuery struct {
+	bucket   string
+	stages   []string
+	branches []fluxBranch
+	err      error
+}
+
+// fluxBranch is a pipeline applied to the rows of the query, yielding its result under name.
+type fluxBranch struct {
+	name  string
+	stage string
+}
+
+// statFunctions are the aggregates a branch can apply (see Yield).
+var statFunctions = map[string]bool{"count": true, "min": true, "max": true, "mean": true, "stddev": true}
+
+// NewFluxQuery starts a query reading from the given bucket.
+func NewFluxQuery(bucket string) *FluxQuery {
+	return &FluxQuery{bucket: bucket}
+}
+
+// Range limits the query to [start, stop).
+func (q *FluxQuery) Range(start time.Time, stop time.Time) *FluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf("range(start: time(v: %s), stop: time(v: %s))",
+		FluxString(start.UTC().Format(time.RFC3339Nano)),
+		FluxString(stop.UTC().Format(time.RFC3339Nano)),
+	))
+	return q
+}
+
+// Filter keeps the rows whose column equals one of the given values.
+func (q *FluxQuery) Filter(column string, values ...string) *FluxQuery {
+	if len(values) == 0 {
+		q.setErr(fmt.Errorf("filter on %q without values", column))
+		return q
+	}
+	conditions := make([]string, 0, len(values))
+	for _, v := range values {
+		conditions = append(conditions, fmt.Sprintf("r[%s] == %s", FluxString(column), FluxString(v)))
+	}
+	q.stages = append(q.stages, fmt.Sprintf("filter(fn: (r) => %s)", strings.Join(conditions, " or ")))
+	return q
+}
+
+// Window aggregates the series in windows of the given size using fn.
+func (q *FluxQuery) Window(every time.Duration, fn string) *FluxQuery {
+	if every <= 0 {
+		q.setErr(fmt.Errorf("window size must be positive"))
+		return q
+	}
+	if !aggregateFunctions[fn] {
+		q.setErr(fmt.Errorf("unsupported aggregate function %q", fn))
+		return q
+	}
+	q.stages = append(q.stages, fmt.Sprintf("aggregateWindow(every: %s, fn: %s, createEmpty: false)", fluxDuration(every), fn))
+	return q
+}
+
+// Pivot turns the values of columnKey into columns, one row per rowKey.
+func (q *FluxQuery) Pivot(rowKey []string, columnKey []string, valueColumn string) *FluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf("pivot(rowKey: %s, columnKey: %s, valueColumn: %s)",
+		fluxStringArray(rowKey),
+		fluxStringArray(columnKey),
+		FluxString(valueColumn),
+	))
+	return q
+}
+
+// Group regroups the tables by the given columns (no columns merges everything in one table).
+func (q *FluxQuery) Group(columns ...string) *FluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf("group(columns: %s)", fluxStringArray(columns)))
+	return q
+}
+
+// Windows splits the tables in windows of the given size, aligned to the epoch.
+func (q *FluxQuery) Windows(every time.Duration) *FluxQuery {
+	if every <= 0 {
+		q.setErr(fmt.Errorf("window size must be positive"))
+		return q
+	}
+	q.stages = append(q.stages, fmt.Sprintf("window(every: %s)", fluxDuration(every)))
+	return q
+}
+
+// ToFloat converts the values to floats.
+func (q *FluxQuery) ToFloat() *FluxQuery {
+	q.stages = append(q.stages, "toFloat()")
+	return q
+}
+
+// Yield adds a branch reducing the rows of the query with fn (count, min, max,
+// mean or stddev) and yielding the result under name. The rows of a query with
+// branches are bound to a variable shared by every branch.
+func (q *FluxQuery) Yield(name string, fn string) *FluxQuery {
+	if !statFunctions[fn] {
+		q.setErr(fmt.Errorf("unsupported aggregate function %q", fn))
+		return q
+	}
+	q.branches = append(q.branches, fluxBranch{name: name, stage: fn + "()"})
+	return q
+}
+
+// YieldQuantile adds a branch yielding under name the exact quantile (0 to 1)
+// of the rows, interpolated between the closest values (method exact_mean).
+func (q *FluxQuery) YieldQuantile(name string, quantile float64) *FluxQuery {
+	if !(quantile >= 0 && quantile <= 1) {
+		q.setErr(fmt.Errorf("quantile %v out of [0, 1]", quantile))
+		return q
+	}
+	literal := strconv.FormatFloat(quantile, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	q.branches = append(q.branches, fluxBranch{name: name, stage: fmt.Sprintf(`quantile(q: %s, method: "exact_mean")`, literal)})
+	return q
+}
+
+// Keep drops every column but the given ones.
+func (q *FluxQuery) Keep(columns ...string) *FluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf("keep(columns: %s)", fluxStringArray(columns)))
+	return q
+}
+
+// Sort orders the rows of each table by the given columns, ascending.
+func (q *FluxQuery) Sort(columns ...string) *FluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf("sort(columns: %s)", fluxStringArray(columns)))
+	return q
+}
+
+// Build returns the Flux script or the first error met while building it.
+func (q *FluxQuery) Build() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	var sb strings.Builder
+	if len(q.branches) > 0 {
+		sb.WriteString("data = ")
+	}
+	sb.WriteString(fmt.Sprintf("from(bucket: %s)", FluxString(q.bucket)))
+	for _, stage := range q.stages {
+		sb.WriteString("\n  |> ")
+		sb.WriteString(stage)
+	}
+	for _, branch := range q.branches {
+		sb.WriteString(fmt.Sprintf("\n\ndata\n  |> %s\n  |> yield(name: %s)", branch.stage, FluxString(branch.name)))
+	}
+	return sb.String(), nil
+}
+
+func (q *FluxQuery) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// FluxString returns s as a double quoted Flux string literal.
+func FluxString(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) + 2)
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '"':
+			sb.WriteString(`\"`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '$':
+			// "${" starts string interpolation in Flux
+			if i+1 < len(s) && s[i+1] == '{' {
+				sb.WriteString(`\$`)
+			} else {
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func fluxStringArray(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, FluxString(v))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// fluxDuration formats d as a Flux duration literal.
+func fluxDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", int64(d/time.Second))
+	}
+	return fmt.Sprintf("%dms", int64(d/time.Millisecond))
+}
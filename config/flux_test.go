@@ -0,0 +1,156 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFluxString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{``, `""`},
+		{`plain`, `"plain"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{`\"`, `"\\\""`},
+		{"line\nbreak", `"line\nbreak"`},
+		{"carriage\rreturn", `"carriage\rreturn"`},
+		{"tab\there", `"tab\there"`},
+		{`${r._value}`, `"\${r._value}"`},
+		{`cost $5 and $`, `"cost $5 and $"`},
+		{`$${`, `"$\${"`},
+		{`\${`, `"\\\${"`},
+		{`") |> drop(columns: ["x`, `"\") |> drop(columns: [\"x"`},
+		{"température", `"température"`},
+	}
+	for _, tt := range tests {
+		if got := FluxString(tt.in); got != tt.want {
+			t.Errorf("FluxString(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFluxQueryBuild(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	stop := time.Date(2024, 5, 1, 12, 0, 0, 500000000, time.FixedZone("CEST", 2*3600))
+	tests := []struct {
+		name  string
+		query *FluxQuery
+		want  string
+	}{
+		{
+			name:  "bucket only",
+			query: NewFluxQuery(`my"bucket`),
+			want:  `from(bucket: "my\"bucket")`,
+		},
+		{
+			name:  "range in UTC",
+			query: NewFluxQuery("b").Range(start, stop),
+			want: `from(bucket: "b")
+  |> range(start: time(v: "2024-05-01T10:00:00Z"), stop: time(v: "2024-05-01T10:00:00.5Z"))`,
+		},
+		{
+			name:  "filter values escaped",
+			query: NewFluxQuery("b").Filter("deviceName", "a\"b", `c\`, "d\ne", "f\rg\th", "${x}"),
+			want: `from(bucket: "b")
+  |> filter(fn: (r) => r["deviceName"] == "a\"b" or r["deviceName"] == "c\\" or r["deviceName"] == "d\ne" or r["deviceName"] == "f\rg\th" or r["deviceName"] == "\${x}")`,
+		},
+		{
+			name:  "filter column escaped",
+			query: NewFluxQuery("b").Filter(`"] == "" or r["x`, "v"),
+			want: `from(bucket: "b")
+  |> filter(fn: (r) => r["\"] == \"\" or r[\"x"] == "v")`,
+		},
+		{
+			name:  "window pivot group",
+			query: NewFluxQuery("b").Window(90*time.Second, "mean").Pivot([]string{"_time"}, []string{"_field"}, "_value").Group(),
+			want: `from(bucket: "b")
+  |> aggregateWindow(every: 90s, fn: mean, createEmpty: false)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: [])`,
+		},
+		{
+			name:  "sub-second window",
+			query: NewFluxQuery("b").Window(1500*time.Millisecond, "last"),
+			want: `from(bucket: "b")
+  |> aggregateWindow(every: 1500ms, fn: last, createEmpty: false)`,
+		},
+		{
+			name:  "keep and sort",
+			query: NewFluxQuery("b").Keep("_time", "_value", `a"b`).Sort("_time", "deviceName"),
+			want: `from(bucket: "b")
+  |> keep(columns: ["_time", "_value", "a\"b"])
+  |> sort(columns: ["_time", "deviceName"])`,
+		},
+		{
+			name: "yield branches",
+			query: NewFluxQuery("b").Group("_start", "_stop").Windows(time.Hour).ToFloat().
+				Yield("count", "count").Yield("mean", "mean").YieldQuantile("p50", 0.5).YieldQuantile("p0", 0).YieldQuantile(`p"1`, 1),
+			want: `data = from(bucket: "b")
+  |> group(columns: ["_start", "_stop"])
+  |> window(every: 3600s)
+  |> toFloat()
+
+data
+  |> count()
+  |> yield(name: "count")
+
+data
+  |> mean()
+  |> yield(name: "mean")
+
+data
+  |> quantile(q: 0.5, method: "exact_mean")
+  |> yield(name: "p50")
+
+data
+  |> quantile(q: 0.0, method: "exact_mean")
+  |> yield(name: "p0")
+
+data
+  |> quantile(q: 1.0, method: "exact_mean")
+  |> yield(name: "p\"1")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.query.Build()
+			if err != nil {
+				t.Fatalf("Build: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Build =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFluxQueryBuildErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *FluxQuery
+		want  string
+	}{
+		{"filter without values", NewFluxQuery("b").Filter("deviceName"), "without values"},
+		{"zero window", NewFluxQuery("b").Window(0, "mean"), "window size must be positive"},
+		{"unknown aggregate", NewFluxQuery("b").Window(time.Second, "sum"), `unsupported aggregate function "sum"`},
+		{"negative windows", NewFluxQuery("b").Windows(-time.Second), "window size must be positive"},
+		{"unknown yield function", NewFluxQuery("b").Yield("x", "median"), `unsupported aggregate function "median"`},
+		{"injected yield function", NewFluxQuery("b").Yield("x", "count() |> drop"), "unsupported aggregate function"},
+		{"quantile above one", NewFluxQuery("b").YieldQuantile("p", 1.5), "out of [0, 1]"},
+		{"negative quantile", NewFluxQuery("b").YieldQuantile("p", -0.1), "out of [0, 1]"},
+		// the first error is kept
+		{"first error", NewFluxQuery("b").Filter("a").Window(0, "mean"), "without values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.query.Build()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Build = %q, %v, want an error containing %q", got, err, tt.want)
+			}
+		})
+	}
+}
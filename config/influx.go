@@ -2,9 +2,12 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,70 +18,297 @@ type InfluxClient struct {
 	Client influxdb2.Client
 }
 
-func NewInfluxClient() *InfluxClient {
-	influxUrl := os.Getenv("INFLUX_URI")
-	token := os.Getenv("INFLUX_TOKEN")
-	if influxUrl == "" || token == "" {
-		panic("INFLUX_URL and INFLUX_TOKEN environment variables must be set")
+const (
+	// DefaultQueryRange is used when the caller does not give a start bound.
+	DefaultQueryRange = 5 * time.Second
+	// MaxQueryRange caps the span of a single query (a whole recording session fits).
+	MaxQueryRange = 31 * 24 * time.Hour
+	// MaxRawQueryRange is the widest span returned without aggregation; wider
+	// ranges are aggregated automatically.
+	MaxRawQueryRange = 10 * time.Minute
+	// MaxQueryPoints is the maximum number of windows a single series may return.
+	MaxQueryPoints = 5000
+)
+
+// ErrInvalidQuery is returned when the query parameters cannot be turned into a valid window.
+var ErrInvalidQuery = errors.New("invalid query")
+
+var aggregateFunctions = map[string]bool{"mean": true, "max": true, "min": true, "last": true}
+
+// QueryParams holds the raw time window parameters received from the API.
+type QueryParams struct {
+	Start string
+	Stop  string
+	Every string
+	Fn    string
+}
+
+// QueryWindow is the resolved time range and optional aggregation of an Influx query.
+type QueryWindow struct {
+	Start time.Time
+	Stop  time.Time
+	Every time.Duration
+	Fn    string
+}
+
+// ParseQueryWindow resolves the raw parameters against the given defaults.
+// start and stop accept RFC3339 timestamps, "now" or durations relative to now
+// (e.g. "-2h", "-7d"); every accepts a duration and fn one of mean, max, min, last.
+func ParseQueryWindow(params QueryParams, defaultStart time.Time, defaultStop time.Time) (QueryWindow, error) {
+	now := time.Now().UTC()
+	start, err := parseTimeBound(params.Start, now, defaultStart)
+	if err != nil {
+		return QueryWindow{}, fmt.Errorf("%w: start: %v", ErrInvalidQuery, err)
 	}
+	stop, err := parseTimeBound(params.Stop, now, defaultStop)
+	if err != nil {
+		return QueryWindow{}, fmt.Errorf("%w: stop: %v", ErrInvalidQuery, err)
+	}
+	if !start.Before(stop) {
+		return QueryWindow{}, fmt.Errorf("%w: start must be before stop", ErrInvalidQuery)
+	}
+	span := stop.Sub(start)
+	if span > MaxQueryRange {
+		return QueryWindow{}, fmt.Errorf("%w: range %s exceeds maximum of %s", ErrInvalidQuery, span, MaxQueryRange)
+	}
+	window := QueryWindow{Start: start, Stop: stop, Fn: strings.ToLower(strings.TrimSpace(params.Fn))}
+	if window.Fn != "" && !aggregateFunctions[window.Fn] {
+		return QueryWindow{}, fmt.Errorf("%w: fn must be one of mean, max, min, last", ErrInvalidQuery)
+	}
+	if strings.TrimSpace(params.Every) != "" {
+		every, err := parseDuration(strings.TrimSpace(params.Every))
+		if err != nil || every < time.Second {
+			return QueryWindow{}, fmt.Errorf("%w: every must be a duration of at least 1s", ErrInvalidQuery)
+		}
+		// the limit applies to the whole-second window actually queried
+		every = every.Truncate(time.Second)
+		if int64(span/every) > MaxQueryPoints {
+			return QueryWindow{}, fmt.Errorf("%w: every %s yields more than %d points over %s", ErrInvalidQuery, every, MaxQueryPoints, span)
+		}
+		window.Every = every
+	} else if window.Fn != "" || span > MaxRawQueryRange {
+		// pick the smallest whole-second window that keeps the series under MaxQueryPoints
+		every := (span + MaxQueryPoints - 1) / MaxQueryPoints
+		every = (every + time.Second - 1).Truncate(time.Second)
+		window.Every = every
+	}
+	if window.Every > 0 && window.Fn == "" {
+		window.Fn = "mean"
+	}
+	return window, nil
+}
+
+func parseTimeBound(value string, now time.Time, fallback time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "":
+		return fallback.UTC(), nil
+	case value == "now":
+		return now, nil
+	case strings.HasPrefix(value, "-"):
+		d, err := parseDuration(value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// parseDuration extends time.ParseDuration with a day unit ("7d").
+func parseDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+func NewInfluxClient(settings InfluxSettings) *InfluxClient {
 	var client influxdb2.Client
 	client = influxdb2.NewClient(
-		influxUrl,
-		token,
+		settings.URI,
+		settings.Token,
 	)
 	return &InfluxClient{
 		Client: client,
 	}
 }
 
-func (client InfluxClient) ExecuteQuery(experimentId string, bucket string, deviceAddress string, measurement string, field string) ([]string, []float64, error) {
+// Point is a numeric value of a series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// ExecuteQuery returns the times (RFC3339) and numeric values of a series; ctx bounds the query.
+func (client InfluxClient) ExecuteQuery(ctx context.Context, experimentId string, org string, bucket string, deviceAddress string, measurement string, field string, window QueryWindow) ([]string, []float64, error) {
+	points, err := client.QueryPoints(ctx, experimentId, org, bucket, deviceAddress, measurement, field, window)
+	if err != nil {
+		return nil, nil, err
+	}
+	times := make([]string, 0, len(points))
+	values := make([]float64, 0, len(points))
+	for _, p := range points {
+		times = append(times, p.Time.Format(time.RFC3339))
+		values = append(values, p.Value)
+	}
+	return times, values, nil
+}
+
+// QueryPoints returns the numeric points of a series, in time order; ctx bounds the query.
+func (client InfluxClient) QueryPoints(ctx context.Context, experimentId string, org string, bucket string, deviceAddress string, measurement string, field string, window QueryWindow) ([]Point, error) {
 	// build base flux query; append _field filter only when field is non-empty
-	flux := fmt.Sprintf(`
-		from(bucket: "%s")
-		  |> range(start: -%ds)
-		  |> filter(fn: (r) => r["experimentId"] == "%s")
-		  |> filter(fn: (r) => r["deviceAddress"] == "%s")
-		  |> filter(fn: (r) => r["_measurement"] == "%s")
-		`,
-		bucket,
-		5,
-		experimentId,
-		deviceAddress,
-		measurement,
-	)
+	query := NewFluxQuery(bucket).
+		Range(window.Start, window.Stop).
+		Filter("experimentId", experimentId).
+		Filter("deviceAddress", deviceAddress).
+		Filter("_measurement", measurement)
 	if strings.TrimSpace(field) != "" {
-		// append field filter
-		flux += fmt.Sprintf("\n\t\t  |> filter(fn: (r) => r[\"_field\"] == \"%s\")\n\t\t", field)
+		query.Filter("_field", field)
+	}
+	if window.Every > 0 {
+		query.Window(window.Every, window.Fn)
+	}
+	flux, err := query.Build()
+	if err != nil {
+		return nil, err
 	}
 	log.Printf("Query: %s", flux)
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
-	defer cancel()
-	queryAPI := client.Client.QueryAPI("003e6c7c0dc0eb8b")
+	queryAPI := client.Client.QueryAPI(org)
 	result, err := queryAPI.Query(ctx, flux)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	var times []string
-	var values []float64
-
+	points := []Point{}
 	for result.Next() {
 		rec := result.Record()
-		// _time -> time, _value -> numeric value
-		t := rec.Time().Format(time.RFC3339)
 		// careful with type assertion: _value often float64
 		switch v := rec.Value().(type) {
 		case float64:
-			times = append(times, t)
-			values = append(values, v)
+			points = append(points, Point{Time: rec.Time(), Value: v})
 		case int64:
-			times = append(times, t)
-			values = append(values, float64(v))
+			points = append(points, Point{Time: rec.Time(), Value: float64(v)})
 		default:
 			// skip non-numeric or handle as needed
 		}
 	}
 	if result.Err() != nil {
-		return nil, nil, result.Err()
+		return nil, result.Err()
 	}
-	return times, values, nil
+	return points, nil
+}
+
+// StreamQuery runs a query and calls row with the values of each record, in
+// order, as they are read: the result is never held in memory. It stops at the
+// first error returned by row; ctx bounds the query.
+func (client InfluxClient) StreamQuery(ctx context.Context, org string, query *FluxQuery, row func(values map[string]interface{}) error) error {
+	flux, err := query.Build()
+	if err != nil {
+		return err
+	}
+	log.Printf("Query: %s", flux)
+	result, err := client.Client.QueryAPI(org).Query(ctx, flux)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	for result.Next() {
+		if err := row(result.Record().Values()); err != nil {
+			return err
+		}
+	}
+	return result.Err()
+}
+
+// Stats are the descriptive statistics of the values of a series over a
+// window. The values are nil without points; StdDev (of the sample) with fewer
+// than two. Percentiles are keyed by PercentileKey.
+type Stats struct {
+	Start       time.Time          `json:"start"`
+	Stop        time.Time          `json:"stop"`
+	Count       int64              `json:"count"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Mean        *float64           `json:"mean,omitempty"`
+	StdDev      *float64           `json:"stddev,omitempty"`
+	Median      *float64           `json:"median,omitempty"`
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// PercentileKey names a percentile in Stats.Percentiles, e.g. "p95" or "p99.9".
+func PercentileKey(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// QueryStats computes in Flux the statistics of the values selected by query,
+// per window of the given size (a single window when 0), in time order. Windows
+// without values are not returned. The query must leave a table per window
+// with its bounds in _start and _stop.
+func (client InfluxClient) QueryStats(ctx context.Context, org string, query *FluxQuery, every time.Duration, percentiles []float64) ([]Stats, error) {
+	query.ToFloat()
+	if every > 0 {
+		query.Windows(every)
+	}
+	for _, fn := range []string{"count", "min", "max", "mean", "stddev"} {
+		query.Yield(fn, fn)
+	}
+	query.YieldQuantile("median", 0.5)
+	for _, p := range percentiles {
+		query.YieldQuantile(PercentileKey(p), p/100)
+	}
+	windows := map[time.Time]*Stats{}
+	err := client.StreamQuery(ctx, org, query, func(values map[string]interface{}) error {
+		start, _ := values["_start"].(time.Time)
+		stop, _ := values["_stop"].(time.Time)
+		stats, ok := windows[start]
+		if !ok {
+			stats = &Stats{Start: start, Stop: stop}
+			windows[start] = stats
+		}
+		name, _ := values["result"].(string)
+		if name == "count" {
+			stats.Count, _ = values["_value"].(int64)
+			return nil
+		}
+		v, ok := values["_value"].(float64)
+		if !ok {
+			return nil
+		}
+		switch name {
+		case "min":
+			stats.Min = &v
+		case "max":
+			stats.Max = &v
+		case "mean":
+			stats.Mean = &v
+		case "stddev":
+			stats.StdDev = &v
+		case "median":
+			stats.Median = &v
+		default:
+			if stats.Percentiles == nil {
+				stats.Percentiles = map[string]float64{}
+			}
+			stats.Percentiles[name] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := []Stats{}
+	for _, start := range slices.SortedFunc(maps.Keys(windows), time.Time.Compare) {
+		if windows[start].Count > 0 {
+			result = append(result, *windows[start])
+		}
+	}
+	return result, nil
 }
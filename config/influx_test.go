@@ -0,0 +1,24 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseQueryWindowEvery(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	// 7500s: 5000 windows of 1.5s, but the window is truncated to 1s
+	stop := start.Add(7500 * time.Second)
+	params := QueryParams{Start: start.Format(time.RFC3339), Stop: stop.Format(time.RFC3339)}
+
+	params.Every = "1.5s"
+	if window, err := ParseQueryWindow(params, start, stop); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("ParseQueryWindow(every=1.5s) = %+v, %v, want ErrInvalidQuery", window, err)
+	}
+	params.Every = "2.5s"
+	window, err := ParseQueryWindow(params, start, stop)
+	if err != nil || window.Every != 2*time.Second || window.Fn != "mean" {
+		t.Errorf("ParseQueryWindow(every=2.5s) = %+v, %v, want every 2s and fn mean", window, err)
+	}
+}
@@ -2,9 +2,8 @@ package config
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,20 +16,19 @@ type MongoClient struct {
 	Database          *mongo.Database
 }
 
-func NewMongoClient() *MongoClient {
+func NewMongoClient(settings MongoSettings) *MongoClient {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	var err error
 	var client *mongo.Client
-	mongoUri := os.Getenv("MONGO_URI")
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoUri))
+	client, err = mongo.Connect(ctx, options.Client().ApplyURI(settings.URI))
 	if err != nil {
 		log.Fatal(err)
 	}
 	return &MongoClient{
 		defaultCollection: "configurations",
-		Database:          client.Database("configurations"),
+		Database:          client.Database(settings.Database),
 	}
 }
 
@@ -39,31 +37,33 @@ func (mc *MongoClient) ExecuteSelectionQuery(query bson.M, coll ...string) ([]bs
 	if len(coll) > 0 {
 		collection = coll[0]
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
 	var opts *options.FindOptions
 	opts = options.Find()
 	var cur *mongo.Cursor
 	cur, err := mc.Database.Collection(collection).Find(
-		context.TODO(),
+		ctx,
 		query,
 		opts,
 	)
 	if err != nil {
-		// ErrNoDocuments means that the filter did not match any documents in
-		// the collection.
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, err
-		}
-		log.Panic(err)
+		return nil, mongoError("find in "+collection, err)
 	}
+	defer func() { _ = cur.Close(context.Background()) }()
 	var result = make([]bson.M, 0)
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 		var elem bson.M
 		err := cur.Decode(&elem)
 		if err != nil {
-			log.Panic(err)
+			return nil, mongoError("decode from "+collection, err)
 		}
 		result = append(result, elem)
 	}
+	if err := cur.Err(); err != nil {
+		return nil, mongoError("find in "+collection, err)
+	}
 
 	return result, nil
 }
@@ -78,12 +78,12 @@ func (mc *MongoClient) InsertData(data bson.M, coll ...string) (InsertedID inter
 
 	result, err := mc.Database.Collection(collection).InsertOne(ctx, data)
 	if err != nil {
-		log.Fatal(err)
-		return nil, err
+		return nil, mongoError("insert into "+collection, err)
 	}
 	return result.InsertedID, nil
 }
 
+// UpdateData replaces the document matching filter; it returns ErrNotFound when nothing matches.
 func (mc *MongoClient) UpdateData(filter bson.M, update bson.M, coll ...string) (ModifiedCount int64, err error) {
 	collection := mc.defaultCollection
 	if len(coll) > 0 {
@@ -94,9 +94,105 @@ func (mc *MongoClient) UpdateData(filter bson.M, update bson.M, coll ...string)
 
 	result, err := mc.Database.Collection(collection).ReplaceOne(ctx, filter, update)
 	if err != nil {
-		log.Fatal(err)
-		return 0, err
+		return 0, mongoError("update in "+collection, err)
+	}
+	if result.MatchedCount == 0 {
+		return 0, fmt.Errorf("update in %s: %w", collection, ErrNotFound)
 	}
 	log.Println("Modified count:", result.ModifiedCount)
 	return result.ModifiedCount, nil
 }
+
+// PatchData applies update operators ($set, $pull, ...) to every document matching filter.
+func (mc *MongoClient) PatchData(filter bson.M, update bson.M, coll ...string) (ModifiedCount int64, err error) {
+	collection := mc.defaultCollection
+	if len(coll) > 0 {
+		collection = coll[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	result, err := mc.Database.Collection(collection).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, mongoError("patch in "+collection, err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteData removes the documents matching filter; it returns ErrNotFound when nothing matches.
+func (mc *MongoClient) DeleteData(filter bson.M, coll ...string) (DeletedCount int64, err error) {
+	collection := mc.defaultCollection
+	if len(coll) > 0 {
+		collection = coll[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	result, err := mc.Database.Collection(collection).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, mongoError("delete from "+collection, err)
+	}
+	if result.DeletedCount == 0 {
+		return 0, fmt.Errorf("delete from %s: %w", collection, ErrNotFound)
+	}
+	return result.DeletedCount, nil
+}
+
+// ClaimData atomically applies update to the first document matching filter (in
+// sort order) and returns the updated document, or ErrNotFound when nothing matches.
+func (mc *MongoClient) ClaimData(filter bson.M, update bson.M, sort bson.D, coll ...string) (bson.M, error) {
+	collection := mc.defaultCollection
+	if len(coll) > 0 {
+		collection = coll[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetSort(sort).SetReturnDocument(options.After)
+	var result bson.M
+	err := mc.Database.Collection(collection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if err != nil {
+		return nil, mongoError("claim in "+collection, err)
+	}
+	return result, nil
+}
+
+// UpsertData applies update to the first document matching filter, inserting one
+// when nothing matches, and returns the resulting document.
+func (mc *MongoClient) UpsertData(filter bson.M, update bson.M, coll ...string) (bson.M, error) {
+	collection := mc.defaultCollection
+	if len(coll) > 0 {
+		collection = coll[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var result bson.M
+	err := mc.Database.Collection(collection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
+	if err != nil {
+		return nil, mongoError("upsert in "+collection, err)
+	}
+	return result, nil
+}
+
+// EnsureUniqueIndex creates, if missing, a unique index on keys restricted to
+// the documents matching partial (every document when nil).
+func (mc *MongoClient) EnsureUniqueIndex(name string, keys bson.D, partial bson.M, coll ...string) error {
+	collection := mc.defaultCollection
+	if len(coll) > 0 {
+		collection = coll[0]
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancel()
+
+	opts := options.Index().SetName(name).SetUnique(true)
+	if partial != nil {
+		opts.SetPartialFilterExpression(partial)
+	}
+	_, err := mc.Database.Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+	if err != nil {
+		return mongoError("create index in "+collection, err)
+	}
+	return nil
+}
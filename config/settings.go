@@ -0,0 +1,394 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"qiot-configuration-service/topic"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// DefaultSettingsFile is read when CONFIG_FILE is not set; it is optional.
+const DefaultSettingsFile = "config.yaml"
+
+// Settings is the whole service configuration. It is loaded once at startup
+// from a YAML file, then overridden by environment variables.
+type Settings struct {
+	Server    ServerSettings    `yaml:"server"`
+	Mongo     MongoSettings     `yaml:"mongo"`
+	Influx    InfluxSettings    `yaml:"influx"`
+	EMQX      EMQXSettings      `yaml:"emqx"`
+	Jobs      JobSettings       `yaml:"jobs"`
+	MQTT      MQTTSettings      `yaml:"mqtt"`
+	Ingestion IngestionSettings `yaml:"ingestion"`
+	Dashboard DashboardSettings `yaml:"dashboard"`
+}
+
+type ServerSettings struct {
+	Port        int      `yaml:"port"`
+	CORSOrigins []string `yaml:"corsOrigins"`
+}
+
+type MongoSettings struct {
+	URI      string `yaml:"uri"`
+	Database string `yaml:"database"`
+}
+
+type InfluxSettings struct {
+	URI    string `yaml:"uri"`
+	Token  string `yaml:"token"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+}
+
+type EMQXSettings struct {
+	Host      string `yaml:"host"`
+	APIPort   string `yaml:"apiPort"`
+	User      string `yaml:"user"`
+	Password  string `yaml:"password"`
+	Connector string `yaml:"connector"`
+}
+
+// MQTTSettings holds the templates of the topics gateways publish on (see package topic).
+type MQTTSettings struct {
+	TopicTemplate           string `yaml:"topicTemplate"`
+	WhiteboardTopicTemplate string `yaml:"whiteboardTopicTemplate"`
+}
+
+// Ingestion modes: EMQX rules write the data to Influx, or the service
+// subscribes to the broker and writes it itself.
+const (
+	IngestionEMQX    = "emqx"
+	IngestionBuiltin = "builtin"
+)
+
+// IngestionSettings selects who writes the gateway messages to Influx. The
+// broker settings are only used by the built-in ingestion.
+type IngestionSettings struct {
+	Mode            string `yaml:"mode"`
+	BrokerURL       string `yaml:"brokerUrl"`
+	ClientID        string `yaml:"clientId"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	RefreshInterval string `yaml:"refreshInterval"`
+}
+
+// Builtin reports whether the service ingests the data itself, without EMQX.
+func (i IngestionSettings) Builtin() bool {
+	return i.Mode == IngestionBuiltin
+}
+
+// DashboardSettings bounds the Influx queries of a dashboard request: at most
+// QueryWorkers run at once and all of them must end within QueryTimeout. A live
+// stream queries new points every StreamInterval; an experiment has at most
+// MaxStreams streams open at once.
+type DashboardSettings struct {
+	QueryWorkers   int    `yaml:"queryWorkers"`
+	QueryTimeout   string `yaml:"queryTimeout"`
+	StreamInterval string `yaml:"streamInterval"`
+	MaxStreams     int    `yaml:"maxStreams"`
+}
+
+// Timeout returns the parsed query timeout, validated at startup.
+func (d DashboardSettings) Timeout() time.Duration {
+	timeout, _ := time.ParseDuration(d.QueryTimeout)
+	return timeout
+}
+
+// Interval returns the parsed stream interval, validated at startup.
+func (d DashboardSettings) Interval() time.Duration {
+	interval, _ := time.ParseDuration(d.StreamInterval)
+	return interval
+}
+
+// JobSettings tunes the background workers provisioning EMQX. Durations use the
+// time.ParseDuration syntax ("500ms", "30s", "10m").
+type JobSettings struct {
+	Workers      int    `yaml:"workers"`
+	MaxAttempts  int    `yaml:"maxAttempts"`
+	BackoffBase  string `yaml:"backoffBase"`
+	BackoffMax   string `yaml:"backoffMax"`
+	PollInterval string `yaml:"pollInterval"`
+	LockTimeout  string `yaml:"lockTimeout"`
+}
+
+// Durations returns the parsed backoff base, backoff cap, poll interval and lock
+// timeout. They are validated at startup, so parse errors cannot happen here.
+func (j JobSettings) Durations() (backoffBase, backoffMax, pollInterval, lockTimeout time.Duration) {
+	backoffBase, _ = time.ParseDuration(j.BackoffBase)
+	backoffMax, _ = time.ParseDuration(j.BackoffMax)
+	pollInterval, _ = time.ParseDuration(j.PollInterval)
+	lockTimeout, _ = time.ParseDuration(j.LockTimeout)
+	return
+}
+
+// SettingsError lists every problem found while loading the configuration.
+type SettingsError struct {
+	Problems []string
+}
+
+func (e *SettingsError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func defaultSettings() *Settings {
+	return &Settings{
+		Server: ServerSettings{
+			Port:        8080,
+			CORSOrigins: []string{"http://localhost:5173"},
+		},
+		Mongo: MongoSettings{
+			Database: "configurations",
+		},
+		Jobs: JobSettings{
+			Workers:      2,
+			MaxAttempts:  8,
+			BackoffBase:  "5s",
+			BackoffMax:   "10m",
+			PollInterval: "1s",
+			LockTimeout:  "5m",
+		},
+		MQTT: MQTTSettings{
+			TopicTemplate:           topic.DefaultTemplate,
+			WhiteboardTopicTemplate: topic.DefaultWhiteboardTemplate,
+		},
+		Ingestion: IngestionSettings{
+			Mode:            IngestionEMQX,
+			ClientID:        "qiot-configuration-service",
+			RefreshInterval: "30s",
+		},
+		Dashboard: DashboardSettings{
+			QueryWorkers:   8,
+			QueryTimeout:   "30s",
+			StreamInterval: "2s",
+			MaxStreams:     4,
+		},
+	}
+}
+
+// LoadSettings reads the file named by CONFIG_FILE (or config.yaml when present),
+// applies the environment overrides and validates the result. Every variable can
+// also be given as <NAME>_FILE pointing to a file holding the value (Docker secrets).
+func LoadSettings() (*Settings, error) {
+	settings := defaultSettings()
+	problems := []string{}
+
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = DefaultSettingsFile
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalWithOptions(data, settings, yaml.DisallowUnknownField()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+		}
+	case explicit || !errors.Is(err, fs.ErrNotExist):
+		problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+	}
+
+	bindings := []struct {
+		env    string
+		target *string
+	}{
+		{"MONGO_URI", &settings.Mongo.URI},
+		{"MONGO_DATABASE", &settings.Mongo.Database},
+		{"INFLUX_URI", &settings.Influx.URI},
+		{"INFLUX_TOKEN", &settings.Influx.Token},
+		{"INFLUX_ORG", &settings.Influx.Org},
+		{"INFLUX_BUCKET", &settings.Influx.Bucket},
+		{"EMQX_HOST", &settings.EMQX.Host},
+		{"EMQX_API_PORT", &settings.EMQX.APIPort},
+		{"EMQX_USER_TOKEN", &settings.EMQX.User},
+		{"EMQX_TOKEN", &settings.EMQX.Password},
+		{"EMQX_INFLUX_CONNECTOR", &settings.EMQX.Connector},
+		{"JOB_BACKOFF_BASE", &settings.Jobs.BackoffBase},
+		{"JOB_BACKOFF_MAX", &settings.Jobs.BackoffMax},
+		{"JOB_POLL_INTERVAL", &settings.Jobs.PollInterval},
+		{"JOB_LOCK_TIMEOUT", &settings.Jobs.LockTimeout},
+		{"MQTT_TOPIC_TEMPLATE", &settings.MQTT.TopicTemplate},
+		{"MQTT_WHITEBOARD_TOPIC_TEMPLATE", &settings.MQTT.WhiteboardTopicTemplate},
+		{"INGESTION_MODE", &settings.Ingestion.Mode},
+		{"INGESTION_BROKER_URL", &settings.Ingestion.BrokerURL},
+		{"INGESTION_CLIENT_ID", &settings.Ingestion.ClientID},
+		{"INGESTION_USERNAME", &settings.Ingestion.Username},
+		{"INGESTION_PASSWORD", &settings.Ingestion.Password},
+		{"INGESTION_REFRESH_INTERVAL", &settings.Ingestion.RefreshInterval},
+		{"DASHBOARD_QUERY_TIMEOUT", &settings.Dashboard.QueryTimeout},
+		{"DASHBOARD_STREAM_INTERVAL", &settings.Dashboard.StreamInterval},
+	}
+	for _, binding := range bindings {
+		value, ok, err := lookupEnv(binding.env)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if ok {
+			*binding.target = value
+		}
+	}
+	intBindings := []struct {
+		env    string
+		target *int
+	}{
+		{"PORT", &settings.Server.Port},
+		{"JOB_WORKERS", &settings.Jobs.Workers},
+		{"JOB_MAX_ATTEMPTS", &settings.Jobs.MaxAttempts},
+		{"DASHBOARD_QUERY_WORKERS", &settings.Dashboard.QueryWorkers},
+		{"DASHBOARD_MAX_STREAMS", &settings.Dashboard.MaxStreams},
+	}
+	for _, binding := range intBindings {
+		value, ok, err := lookupEnv(binding.env)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if ok {
+			number, errNumber := strconv.Atoi(value)
+			if errNumber != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a number", binding.env, value))
+			} else {
+				*binding.target = number
+			}
+		}
+	}
+	if value, ok, err := lookupEnv("CORS_ALLOWED_ORIGINS"); err != nil {
+		problems = append(problems, err.Error())
+	} else if ok {
+		settings.Server.CORSOrigins = splitList(value)
+	}
+
+	problems = append(problems, settings.validate()...)
+	if len(problems) > 0 {
+		return nil, &SettingsError{Problems: problems}
+	}
+	return settings, nil
+}
+
+func (s *Settings) validate() []string {
+	problems := []string{}
+	// the EMQX management API is only used when EMQX rules ingest the data
+	emqx := !s.Ingestion.Builtin()
+	required := []struct {
+		name  string
+		env   string
+		value string
+		used  bool
+	}{
+		{"mongo.uri", "MONGO_URI", s.Mongo.URI, true},
+		{"mongo.database", "MONGO_DATABASE", s.Mongo.Database, true},
+		{"influx.uri", "INFLUX_URI", s.Influx.URI, true},
+		{"influx.token", "INFLUX_TOKEN", s.Influx.Token, true},
+		{"influx.org", "INFLUX_ORG", s.Influx.Org, true},
+		{"influx.bucket", "INFLUX_BUCKET", s.Influx.Bucket, true},
+		{"emqx.host", "EMQX_HOST", s.EMQX.Host, emqx},
+		{"emqx.apiPort", "EMQX_API_PORT", s.EMQX.APIPort, emqx},
+		{"emqx.user", "EMQX_USER_TOKEN", s.EMQX.User, emqx},
+		{"emqx.password", "EMQX_TOKEN", s.EMQX.Password, emqx},
+		{"emqx.connector", "EMQX_INFLUX_CONNECTOR", s.EMQX.Connector, emqx},
+		{"ingestion.brokerUrl", "INGESTION_BROKER_URL", s.Ingestion.BrokerURL, !emqx},
+		{"ingestion.clientId", "INGESTION_CLIENT_ID", s.Ingestion.ClientID, !emqx},
+	}
+	for _, r := range required {
+		if r.used && strings.TrimSpace(r.value) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (set %s or %s_FILE)", r.name, r.env, r.env))
+		}
+	}
+	if s.Server.Port < 1 || s.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port %d is out of range", s.Server.Port))
+	}
+	if len(s.Server.CORSOrigins) == 0 {
+		problems = append(problems, "server.corsOrigins must contain at least one origin")
+	}
+	for _, origin := range s.Server.CORSOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("server.corsOrigins: %q is not a valid origin", origin))
+		}
+	}
+	if s.Influx.URI != "" {
+		if u, err := url.Parse(s.Influx.URI); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("influx.uri: %q is not a valid URL", s.Influx.URI))
+		}
+	}
+	if s.EMQX.APIPort != "" {
+		if port, err := strconv.Atoi(s.EMQX.APIPort); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("emqx.apiPort: %q is not a valid port", s.EMQX.APIPort))
+		}
+	}
+	if s.Jobs.Workers < 1 {
+		problems = append(problems, "jobs.workers must be at least 1")
+	}
+	if s.Jobs.MaxAttempts < 1 {
+		problems = append(problems, "jobs.maxAttempts must be at least 1")
+	}
+	if s.Dashboard.QueryWorkers < 1 {
+		problems = append(problems, "dashboard.queryWorkers must be at least 1")
+	}
+	if s.Dashboard.MaxStreams < 1 {
+		problems = append(problems, "dashboard.maxStreams must be at least 1")
+	}
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"jobs.backoffBase", s.Jobs.BackoffBase},
+		{"jobs.backoffMax", s.Jobs.BackoffMax},
+		{"jobs.pollInterval", s.Jobs.PollInterval},
+		{"jobs.lockTimeout", s.Jobs.LockTimeout},
+		{"ingestion.refreshInterval", s.Ingestion.RefreshInterval},
+		{"dashboard.queryTimeout", s.Dashboard.QueryTimeout},
+		{"dashboard.streamInterval", s.Dashboard.StreamInterval},
+	}
+	for _, d := range durations {
+		if parsed, err := time.ParseDuration(d.value); err != nil || parsed <= 0 {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a positive duration", d.name, d.value))
+		}
+	}
+	if s.Ingestion.Mode != IngestionEMQX && s.Ingestion.Mode != IngestionBuiltin {
+		problems = append(problems, fmt.Sprintf("ingestion.mode: %q is not %s or %s", s.Ingestion.Mode, IngestionEMQX, IngestionBuiltin))
+	}
+	if s.Ingestion.BrokerURL != "" {
+		if u, err := url.Parse(s.Ingestion.BrokerURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("ingestion.brokerUrl: %q is not a valid URL (e.g. tcp://localhost:1883)", s.Ingestion.BrokerURL))
+		}
+	}
+	if _, err := topic.Parse(s.MQTT.TopicTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("mqtt.topicTemplate: %v", err))
+	}
+	if _, err := topic.Parse(s.MQTT.WhiteboardTopicTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("mqtt.whiteboardTopicTemplate: %v", err))
+	}
+	return problems
+}
+
+// lookupEnv returns the value of name, or the trimmed content of the file named by name_FILE.
+func lookupEnv(name string) (string, bool, error) {
+	value, hasValue := os.LookupEnv(name)
+	file, hasFile := os.LookupEnv(name + "_FILE")
+	switch {
+	case hasValue && hasFile:
+		return "", false, fmt.Errorf("%s and %s_FILE are both set", name, name)
+	case hasFile:
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		return strings.TrimSpace(string(content)), true, nil
+	case hasValue:
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+func splitList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
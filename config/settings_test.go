@@ -0,0 +1,182 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// settingsEnv lists the variables read by LoadSettings; each may also be given as <NAME>_FILE.
+var settingsEnv = []string{
+	"CONFIG_FILE", "PORT", "CORS_ALLOWED_ORIGINS", "MONGO_URI", "MONGO_DATABASE",
+	"INFLUX_URI", "INFLUX_TOKEN", "INFLUX_ORG", "INFLUX_BUCKET",
+	"EMQX_HOST", "EMQX_API_PORT", "EMQX_USER_TOKEN", "EMQX_TOKEN", "EMQX_INFLUX_CONNECTOR",
+	"JOB_WORKERS", "JOB_MAX_ATTEMPTS", "JOB_BACKOFF_BASE", "JOB_BACKOFF_MAX", "JOB_POLL_INTERVAL", "JOB_LOCK_TIMEOUT",
+	"MQTT_TOPIC_TEMPLATE", "MQTT_WHITEBOARD_TOPIC_TEMPLATE",
+	"INGESTION_MODE", "INGESTION_BROKER_URL", "INGESTION_CLIENT_ID", "INGESTION_USERNAME", "INGESTION_PASSWORD", "INGESTION_REFRESH_INTERVAL",
+	"DASHBOARD_QUERY_WORKERS", "DASHBOARD_QUERY_TIMEOUT", "DASHBOARD_STREAM_INTERVAL", "DASHBOARD_MAX_STREAMS",
+}
+
+// clearSettingsEnv unsets the settings variables for the duration of the test.
+func clearSettingsEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range settingsEnv {
+		for _, variable := range []string{name, name + "_FILE"} {
+			t.Setenv(variable, "")
+			os.Unsetenv(variable)
+		}
+	}
+}
+
+const completeYAML = `
+mongo:
+  uri: mongodb://mongo:27017
+influx:
+  uri: http://influx:8086
+  token: yaml-token
+  org: staging-org
+  bucket: staging-bucket
+emqx:
+  host: emqx
+  apiPort: "18083"
+  user: key
+  password: secret
+  connector: InfluxStaging
+`
+
+func TestLoadSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		// files are written to the test directory; the variable holds their path
+		files    map[string]string
+		check    func(t *testing.T, s *Settings)
+		problems []string
+	}{
+		{
+			name: "yaml",
+			yaml: completeYAML,
+			check: func(t *testing.T, s *Settings) {
+				if s.Influx.Org != "staging-org" || s.Influx.Bucket != "staging-bucket" || s.EMQX.Connector != "InfluxStaging" || s.Influx.Token != "yaml-token" {
+					t.Errorf("influx = %+v, emqx = %+v, want the values of the file", s.Influx, s.EMQX)
+				}
+				// the defaults fill what the file leaves out
+				if s.Server.Port != 8080 || s.Mongo.Database != "configurations" || s.Jobs.Workers != 2 || len(s.Server.CORSOrigins) != 1 || s.Server.CORSOrigins[0] != "http://localhost:5173" {
+					t.Errorf("settings = %+v, want the defaults", s)
+				}
+			},
+		},
+		{
+			name: "env overrides",
+			yaml: completeYAML,
+			env:  map[string]string{"INFLUX_BUCKET": "prod-bucket", "PORT": "9090", "CORS_ALLOWED_ORIGINS": "https://a.example, https://b.example"},
+			check: func(t *testing.T, s *Settings) {
+				if s.Influx.Bucket != "prod-bucket" || s.Influx.Org != "staging-org" || s.Server.Port != 9090 {
+					t.Errorf("bucket %q, org %q, port %d, want prod-bucket, staging-org, 9090", s.Influx.Bucket, s.Influx.Org, s.Server.Port)
+				}
+				if strings.Join(s.Server.CORSOrigins, " ") != "https://a.example https://b.example" {
+					t.Errorf("CORS origins = %v", s.Server.CORSOrigins)
+				}
+			},
+		},
+		{
+			name:  "file secrets",
+			yaml:  completeYAML,
+			files: map[string]string{"INFLUX_TOKEN_FILE": "file-token\n", "EMQX_TOKEN_FILE": "  file-secret  "},
+			check: func(t *testing.T, s *Settings) {
+				if s.Influx.Token != "file-token" || s.EMQX.Password != "file-secret" {
+					t.Errorf("token %q, password %q, want the trimmed file contents", s.Influx.Token, s.EMQX.Password)
+				}
+			},
+		},
+		{
+			name: "builtin ingestion",
+			yaml: "mongo: {uri: mongodb://m}\ninflux: {uri: http://i, token: t, org: o, bucket: b}\n",
+			env:  map[string]string{"INGESTION_MODE": "builtin", "INGESTION_BROKER_URL": "tcp://mosquitto:1883"},
+			check: func(t *testing.T, s *Settings) {
+				if !s.Ingestion.Builtin() || s.Ingestion.BrokerURL != "tcp://mosquitto:1883" {
+					t.Errorf("ingestion = %+v", s.Ingestion)
+				}
+			},
+		},
+		{
+			name:  "problems are aggregated",
+			yaml:  "influx:\n  uri: http://influx:8086\n",
+			env:   map[string]string{"PORT": "eighty", "INFLUX_TOKEN": "a", "CORS_ALLOWED_ORIGINS": "localhost"},
+			files: map[string]string{"INFLUX_TOKEN_FILE": "b"},
+			problems: []string{
+				"INFLUX_TOKEN and INFLUX_TOKEN_FILE are both set",
+				`PORT: "eighty" is not a number`,
+				"mongo.uri is required (set MONGO_URI or MONGO_URI_FILE)",
+				"influx.token is required",
+				"influx.org is required",
+				"influx.bucket is required",
+				"emqx.host is required",
+				"emqx.connector is required",
+				`server.corsOrigins: "localhost" is not a valid origin`,
+			},
+		},
+		{
+			name:     "unknown key",
+			yaml:     completeYAML + "influx_org: x\n",
+			problems: []string{"settings.yaml", "influx_org"},
+		},
+		{
+			name:     "missing secret file",
+			yaml:     completeYAML,
+			env:      map[string]string{"EMQX_TOKEN_FILE": "/nonexistent/secret"},
+			problems: []string{"EMQX_TOKEN_FILE: open /nonexistent/secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearSettingsEnv(t)
+			dir := t.TempDir()
+			path := filepath.Join(dir, "settings.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", path)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			for name, content := range tt.files {
+				file := filepath.Join(dir, name)
+				if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(name, file)
+			}
+
+			settings, err := LoadSettings()
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Fatalf("LoadSettings: %v", err)
+				}
+				tt.check(t, settings)
+				return
+			}
+			var settingsError *SettingsError
+			if !errors.As(err, &settingsError) {
+				t.Fatalf("LoadSettings = %+v, %v, want a SettingsError", settings, err)
+			}
+			for _, want := range tt.problems {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error does not contain %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSettingsMissingConfigFile(t *testing.T) {
+	clearSettingsEnv(t)
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	var settingsError *SettingsError
+	if _, err := LoadSettings(); !errors.As(err, &settingsError) || !strings.Contains(err.Error(), "missing.yaml") {
+		t.Errorf("LoadSettings = %v, want a SettingsError naming the file", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package ingest turns the MQTT messages published by the gateways into
+// InfluxDB points, applying in Go the rules generated by package rulegen. It is
+// used when the broker has no rule engine (e.g. Mosquitto) and the service
+// writes the data itself.
+package ingest
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"qiot-configuration-service/rulegen"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// ErrInvalidMessage is returned for payloads that cannot be decoded or miss
+// the values of a definition.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// jqPath is the subset of jq accepted for use_jq fields: a plain path such as
+// ".data.values[0]".
+var jqPath = regexp.MustCompile(`^\.?[A-Za-z0-9_]+(\[[0-9]+\])*(\.[A-Za-z0-9_]+(\[[0-9]+\])*)*$`)
+
+// Points decodes a JSON payload received on the topic of d and returns the
+// points the EMQX rule and action of d would write, timestamped at (see
+// Evaluate). Values that could not be written are reported in the returned
+// error, together with the points that could still be built.
+func Points(d rulegen.Definition, payload []byte, at time.Time) ([]*write.Point, error) {
+	message, err := DecodeMessage(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidMessage, d.Topic, err)
+	}
+	points, errs := Evaluate(d, message, at)
+	if len(errs) > 0 {
+		return points, fmt.Errorf("%w: %s: %w", ErrInvalidMessage, d.Topic, errors.Join(errs...))
+	}
+	return points, nil
+}
+
+// DecodeMessage decodes a JSON payload, keeping numbers as json.Number.
+func DecodeMessage(payload []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var message interface{}
+	if err := decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Evaluate applies d to a decoded message:
+//
+//   - structParser and jsonPayloadParser, single measurement: one point with
+//     the fields read at their path (the whole payload when the path is empty);
+//   - jsonArrayParser: one point per element of the array at ArrayPath, fields
+//     relative to the element.
+//
+// Envelope tags and fields are read from the payload root. Missing tags are
+// left out (see MissingTags); missing or malformed field values are left out
+// and returned as errors.
+func Evaluate(d rulegen.Definition, message interface{}, at time.Time) ([]*write.Point, []error) {
+	elements := []interface{}{message}
+	if d.Parser == rulegen.JSONArrayParser {
+		array, err := Lookup(message, d.ArrayPath)
+		if err != nil {
+			return nil, []error{fmt.Errorf("array: %w", err)}
+		}
+		elements, _ = array.([]interface{})
+		if elements == nil {
+			return nil, []error{fmt.Errorf("array: %s is not an array", d.ArrayPath)}
+		}
+	}
+
+	tags := map[string]string{}
+	for _, t := range d.Tags {
+		if t.Path == "" {
+			tags[t.Name] = t.Value
+			continue
+		}
+		if value, err := Lookup(message, t.Path); err == nil {
+			if s, ok := tagValue(value); ok {
+				tags[t.Name] = s
+			}
+		}
+	}
+
+	points := []*write.Point{}
+	errs := []error{}
+	for i, element := range elements {
+		fields := map[string]interface{}{}
+		for _, f := range d.Fields {
+			value, err := fieldValue(d, f, message, element, i)
+			if err == nil {
+				value, err = convert(value, f.Type)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("field %s: %w", f.Name, err))
+				continue
+			}
+			fields[f.Name] = value
+		}
+		if len(fields) > 0 {
+			points = append(points, write.NewPoint(d.Measurement, tags, fields, at))
+		}
+	}
+	return points, errs
+}
+
+// MissingTags returns the names of the tags of d without a value in the message.
+func MissingTags(d rulegen.Definition, message interface{}) []string {
+	missing := []string{}
+	for _, t := range d.Tags {
+		if t.Path == "" {
+			continue
+		}
+		value, err := Lookup(message, t.Path)
+		if _, ok := tagValue(value); err != nil || !ok {
+			missing = append(missing, t.Name)
+		}
+	}
+	return missing
+}
+
+// fieldValue reads a field like the SQL column generated for it (see rulegen);
+// index is the position of element in the array of jsonArrayParser.
+func fieldValue(d rulegen.Definition, f rulegen.Field, message interface{}, element interface{}, index int) (interface{}, error) {
+	source, walked := message, "payload"
+	if d.Parser == rulegen.JSONArrayParser && !f.Gateway {
+		source, walked = element, fmt.Sprintf("payload.%s[%d]", d.ArrayPath, index)
+	}
+	if d.UseJQ && f.Path != "" && !f.Gateway {
+		if !jqPath.MatchString(f.Path) {
+			return nil, fmt.Errorf("jq expression %q is not supported by the built-in ingestion", f.Path)
+		}
+		return lookup(source, strings.TrimPrefix(f.Path, "."), walked)
+	}
+	return lookup(source, f.Path, walked)
+}
+
+// Lookup follows a dotted path ("a.b", "a[0].b") from a decoded message; an
+// empty path returns the message itself.
+func Lookup(value interface{}, path string) (interface{}, error) {
+	return lookup(value, path, "payload")
+}
+
+// lookup is Lookup from a value named walked in the errors.
+func lookup(value interface{}, path string, walked string) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		name, indexes, _ := strings.Cut(key, "[")
+		if name != "" {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("path %s: %s is not an object", path, walked)
+			}
+			if value, ok = object[name]; !ok {
+				return nil, fmt.Errorf("path %s: %s has no key %q", path, walked, name)
+			}
+			walked += "." + name
+		}
+		for indexes != "" {
+			text, rest, _ := strings.Cut(indexes, "]")
+			index, err := strconv.Atoi(text)
+			list, ok := value.([]interface{})
+			if err != nil || !ok || index < 0 || index >= len(list) {
+				return nil, fmt.Errorf("path %s: %s has no element %s", path, walked, text)
+			}
+			value = list[index]
+			walked += "[" + text + "]"
+			indexes = strings.TrimPrefix(rest, "[")
+		}
+	}
+	return value, nil
+}
+
+// convert applies the Influx type of a field. Untyped JSON fields keep numbers
+// (as floats) and booleans; other values are rejected, as EMQX would write an
+// invalid line.
+func convert(value interface{}, fieldType string) (interface{}, error) {
+	text := fmt.Sprint(value)
+	if n, ok := value.(json.Number); ok {
+		text = n.String()
+	}
+	switch fieldType {
+	case rulegen.TypeInteger:
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, nil
+		}
+	case rulegen.TypeUnsigned:
+		if n, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return n, nil
+		}
+	case rulegen.TypeString:
+		switch value.(type) {
+		case map[string]interface{}, []interface{}, nil:
+		default:
+			return text, nil
+		}
+	case rulegen.TypeBoolean:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b, nil
+		}
+	default:
+		if b, ok := value.(bool); ok && fieldType == "" {
+			return b, nil
+		}
+		switch value.(type) {
+		case json.Number, string, float64, int64, uint64:
+			if f, err := strconv.ParseFloat(text, 64); err == nil {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is not a valid %s value", text, cmp.Or(fieldType, "numeric"))
+}
+
+func tagValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,263 @@
+package ingest
+
+import (
+	"errors"
+	"qiot-configuration-service/rulegen"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testExperimentId = "665f1c2e8b3e4a0012345678"
+
+var testTime = time.Unix(1700000000, 0).UTC()
+
+// definition generates the definition of a device with a single source.
+func definition(t *testing.T, device bson.M) rulegen.Definition {
+	t.Helper()
+	device["shortName"] = "dev"
+	definitions := rulegen.Generate(bson.M{"experimentId": testExperimentId, "devices": bson.M{"sensor_0": device}})
+	if len(definitions) != 1 {
+		t.Fatalf("Generate = %d definitions, want 1", len(definitions))
+	}
+	return definitions[0]
+}
+
+func measure(parser string, config interface{}) bson.M {
+	return bson.M{
+		"services": []bson.M{},
+		"movesense_whiteboard": bson.M{"measures": []bson.M{{
+			"name":      "measure",
+			"mqttTopic": "qiot/dev/measure",
+			parser:      config,
+		}}},
+	}
+}
+
+// lines returns the line protocol of points, in seconds.
+func lines(points []*write.Point) []string {
+	result := []string{}
+	for _, p := range points {
+		result = append(result, strings.TrimSuffix(write.PointToLineProtocol(p, time.Second), "\n"))
+	}
+	return result
+}
+
+func TestPoints(t *testing.T) {
+	// points sort their tags by name
+	tags := "deviceAddress=AA:01,deviceName=dev,experimentId=" + testExperimentId + ",gatewayName=gw1"
+	tests := []struct {
+		name    string
+		device  bson.M
+		payload string
+		want    []string
+		errs    []string
+	}{
+		{
+			name: "structParser",
+			device: bson.M{"services": []bson.M{{"characteristics": []bson.M{{
+				"name":      "values",
+				"mqttTopic": "qiot/dev/values",
+				"structParser": bson.M{"fields": bson.A{
+					bson.M{"name": "temperature", "type": "int16", "scale": 0.01},
+					bson.M{"name": "counter", "type": "uint32"},
+					bson.M{"name": "level"},
+					bson.M{"name": "alarm", "type": "bool"},
+					bson.M{"name": "label", "type": "string", "length": 4},
+				}},
+			}}}}},
+			payload: `{"APP_TAG_NAME": "app", "deviceAddress": "AA:01", "deviceName": "dev", "gatewayName": "gw1",
+				"gatewayBattery": 87, "rssi": -60, "temperature": 21.5, "counter": 4000000000, "level": -3, "alarm": true, "label": "ab"}`,
+			want: []string{"dev_values,appTagName=app," + tags + " alarm=true,counter=4000000000u,gatewayBattery=87i,label=\"ab\",level=-3i,rssi=-60i,temperature=21.5 1700000000"},
+		},
+		{
+			name: "jsonPayloadParser",
+			device: measure(rulegen.JSONPayloadParser, bson.M{"fields": bson.A{
+				bson.M{"name": "average", "path": "Body.average", "type": "float"},
+				bson.M{"name": "first", "path": "Body.samples[0]", "type": "integer"},
+				bson.M{"name": "ok", "path": "Body.ok"},
+			}}),
+			payload: `{"deviceAddress": "AA:01", "deviceName": "dev", "gatewayName": "gw1", "Body": {"average": 72.25, "samples": [3, 4], "ok": false}}`,
+			want:    []string{"dev_measure," + tags + " average=72.25,first=3i,ok=false 1700000000"},
+			// like the rule, the default envelope selects the whole payload as the battery
+			errs: []string{"field gatewayBattery"},
+		},
+		{
+			name: "jsonPayloadParser with jq",
+			device: measure(rulegen.JSONPayloadParser, bson.M{"use_jq": true, "fields": bson.A{
+				bson.M{"name": "x", "path": ".Body.values[1].x", "type": "float"},
+				bson.M{"name": "y", "path": ".Body | .y"},
+			}}),
+			payload: `{"deviceAddress": "AA:01", "deviceName": "dev", "gatewayName": "gw1", "Body": {"values": [{"x": 1}, {"x": 2.5}], "y": 1}}`,
+			want:    []string{"dev_measure," + tags + " x=2.5 1700000000"},
+			errs:    []string{`field y: jq expression ".Body | .y" is not supported`, "field gatewayBattery"},
+		},
+		{
+			name: "jsonArrayParser",
+			device: measure(rulegen.JSONArrayParser, bson.M{"arrayPath": "Body.samples", "fields": bson.A{
+				bson.M{"name": "x", "path": "x", "type": "float"},
+				bson.M{"name": "n", "path": "n", "type": "unsigned"},
+				bson.M{"name": "raw"},
+			}}),
+			payload: `{"deviceAddress": "AA:01", "deviceName": "dev", "gatewayName": "gw1", "Body": {"samples": [{"x": 1.5, "n": 1}, {"x": -2, "n": -1}, 7]}}`,
+			want: []string{
+				"dev_measure," + tags + " n=1u,x=1.5 1700000000",
+				"dev_measure," + tags + " x=-2 1700000000",
+				"dev_measure," + tags + " raw=7 1700000000",
+			},
+			errs: []string{
+				"field raw: map[n:1 x:1.5] is not a valid numeric value",
+				"field n: -1 is not a valid unsigned value",
+				"field x: path x: payload.Body.samples[2] is not an object",
+			},
+		},
+		{
+			name: "SingleMeasurementParser",
+			device: measure(rulegen.SingleMeasurementParser, bson.A{
+				bson.M{"name": "ecg", "path": "Body.Samples[1]", "type": "integer"},
+				bson.M{"name": "status", "path": "Body.Status", "type": "string"},
+			}),
+			payload: `{"deviceAddress": "AA:01", "deviceName": "dev", "Body": {"Samples": [10, -20], "Status": 3}}`,
+			// a missing tag is left out
+			want: []string{"dev_measure,deviceAddress=AA:01,deviceName=dev,experimentId=" + testExperimentId + " ecg=-20i,status=\"3\" 1700000000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.device["address"] = "AA:01"
+			d := definition(t, tt.device)
+			points, err := Points(d, []byte(tt.payload), testTime)
+			if got := lines(points); !slices.Equal(got, tt.want) {
+				t.Errorf("Points =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("Points error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Fatalf("Points error = %v, want ErrInvalidMessage", err)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPointsInvalidMessages(t *testing.T) {
+	d := definition(t, measure(rulegen.JSONArrayParser, bson.M{"arrayPath": "Body.samples", "fields": bson.A{bson.M{"name": "x", "path": "x"}}}))
+	for payload, want := range map[string]string{
+		`{"Body": `:                  "qiot/dev/measure",
+		`{"Body": {}}`:               `path Body.samples: payload.Body has no key "samples"`,
+		`{"Body": {"samples": {}}}`:  "Body.samples is not an array",
+		`{"Body": {"samples": "x"}}`: "Body.samples is not an array",
+	} {
+		points, err := Points(d, []byte(payload), testTime)
+		if len(points) != 0 || !errors.Is(err, ErrInvalidMessage) || !strings.Contains(err.Error(), want) {
+			t.Errorf("Points(%s) = %v, %v, want an error containing %q", payload, lines(points), err, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	message, err := DecodeMessage([]byte(`{"a": {"b": [1, {"c": "x"}, [true]]}, "big": 12345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want interface{}
+		err  string
+	}{
+		{"a.b[0]", json.Number("1"), ""},
+		{"a.b[1].c", "x", ""},
+		{"a.b[2][0]", true, ""},
+		{"big", json.Number("12345678901234567890"), ""},
+		{"a.x", nil, `path a.x: payload.a has no key "x"`},
+		{"a.b[3]", nil, "path a.b[3]: payload.a.b has no element 3"},
+		{"a.b[-1]", nil, "has no element -1"},
+		{"a.b[x]", nil, "has no element x"},
+		{"a.b[0].c", nil, "path a.b[0].c: payload.a.b[0] is not an object"},
+		{"a[0]", nil, "path a[0]: payload.a has no element 0"},
+	}
+	for _, tt := range tests {
+		got, err := Lookup(message, tt.path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Lookup(%s) = %v, %v, want an error containing %q", tt.path, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %#v, %v, want %#v", tt.path, got, err, tt.want)
+		}
+	}
+	if got, err := Lookup(message, ""); err != nil || !reflect.DeepEqual(got, message) {
+		t.Errorf("Lookup of the empty path = %v, %v, want the message", got, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value     interface{}
+		fieldType string
+		want      interface{}
+	}{
+		{json.Number("-42"), rulegen.TypeInteger, int64(-42)},
+		{"42", rulegen.TypeInteger, int64(42)},
+		{json.Number("18446744073709551615"), rulegen.TypeUnsigned, uint64(18446744073709551615)},
+		{json.Number("1.5"), rulegen.TypeFloat, 1.5},
+		{json.Number("3"), rulegen.TypeFloat, 3.0},
+		{"2.5", rulegen.TypeFloat, 2.5},
+		{json.Number("7"), "", 7.0},
+		{true, "", true},
+		{"true", rulegen.TypeBoolean, true},
+		{false, rulegen.TypeBoolean, false},
+		{"text", rulegen.TypeString, "text"},
+		{json.Number("12"), rulegen.TypeString, "12"},
+		{true, rulegen.TypeString, "true"},
+	}
+	for _, tt := range tests {
+		got, err := convert(tt.value, tt.fieldType)
+		if err != nil || got != tt.want {
+			t.Errorf("convert(%#v, %q) = %#v, %v, want %#v", tt.value, tt.fieldType, got, err, tt.want)
+		}
+	}
+	invalid := []struct {
+		value     interface{}
+		fieldType string
+	}{
+		{json.Number("1.5"), rulegen.TypeInteger},
+		{json.Number("9223372036854775808"), rulegen.TypeInteger},
+		{json.Number("-1"), rulegen.TypeUnsigned},
+		{"abc", rulegen.TypeFloat},
+		{true, rulegen.TypeFloat},
+		{"yes", rulegen.TypeBoolean},
+		{map[string]interface{}{}, rulegen.TypeString},
+		{[]interface{}{}, ""},
+		{nil, ""},
+	}
+	for _, tt := range invalid {
+		if got, err := convert(tt.value, tt.fieldType); err == nil {
+			t.Errorf("convert(%#v, %q) = %#v, want an error", tt.value, tt.fieldType, got)
+		}
+	}
+}
+
+func TestMissingTags(t *testing.T) {
+	d := definition(t, measure(rulegen.SingleMeasurementParser, bson.A{bson.M{"name": "v"}}))
+	message, _ := DecodeMessage([]byte(`{"deviceName": "dev", "deviceAddress": "", "gatewayName": {"id": 1}}`))
+	if got := MissingTags(d, message); !slices.Equal(got, []string{"deviceAddress", "gatewayName"}) {
+		t.Errorf("MissingTags = %v, want deviceAddress and gatewayName", got)
+	}
+}
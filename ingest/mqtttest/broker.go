@@ -0,0 +1,337 @@
+// Package mqtttest provides a minimal in-process MQTT 3.1.1 broker, to exercise
+// the built-in ingestion without an external broker:
+//
+//	broker := mqtttest.NewBroker()
+//	defer broker.Close()
+//	settings.BrokerURL = broker.URL()
+//	...
+//	broker.Publish("qiot/<experimentId>/sensor/aabbcc/temperature", payload)
+//
+// It accepts any client, delivers every message with QoS 0 and keeps no
+// sessions or retained messages.
+package mqtttest
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// MQTT control packet types.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+var errMalformed = errors.New("mqtttest: malformed packet")
+
+// Broker is an in-process MQTT broker listening on a local TCP port.
+type Broker struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	clients map[*client]bool
+	wg      sync.WaitGroup
+}
+
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	id      string
+	filters map[string]bool
+}
+
+// NewBroker starts a broker on a free port of 127.0.0.1. It panics when it
+// cannot listen, like httptest.NewServer.
+func NewBroker() *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to listen on a port: %v", err))
+	}
+	b := &Broker{listener: listener, clients: map[*client]bool{}}
+	b.wg.Add(1)
+	go b.serve()
+	return b
+}
+
+// URL returns the address clients connect to, e.g. "tcp://127.0.0.1:40123".
+func (b *Broker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Close stops the broker and disconnects every client.
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+	b.mu.Lock()
+	for c := range b.clients {
+		_ = c.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// Publish delivers a message to the clients subscribed to a matching filter.
+func (b *Broker) Publish(topic string, payload []byte) {
+	b.mu.Lock()
+	receivers := []*client{}
+	for c := range b.clients {
+		for filter := range c.filters {
+			if Match(filter, topic) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	packet := publishPacket(topic, payload)
+	for _, c := range receivers {
+		_ = c.write(packet)
+	}
+}
+
+// Subscriptions returns the filters subscribed by any client, sorted.
+func (b *Broker) Subscriptions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	filters := map[string]bool{}
+	for c := range b.clients {
+		maps.Copy(filters, c.filters)
+	}
+	return slices.Sorted(maps.Keys(filters))
+}
+
+// Match reports whether a topic matches a filter with + and # wildcards.
+func Match(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn, filters: map[string]bool{}}
+		b.mu.Lock()
+		b.clients[c] = true
+		b.mu.Unlock()
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			_ = b.handle(c)
+			b.mu.Lock()
+			delete(b.clients, c)
+			b.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// handle reads the packets of a client until it disconnects.
+func (b *Broker) handle(c *client) error {
+	reader := bufio.NewReader(c.conn)
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return err
+		}
+		p := &parser{data: body}
+		switch header >> 4 {
+		case packetConnect:
+			p.string() // protocol name
+			p.byte()   // protocol level
+			p.byte()   // connect flags
+			p.uint16() // keep alive
+			c.id = p.string()
+			if p.err != nil {
+				return p.err
+			}
+			err = c.write([]byte{packetConnack << 4, 2, 0, 0})
+		case packetPublish:
+			qos := (header >> 1) & 3
+			topic := p.string()
+			var id uint16
+			if qos > 0 {
+				id = p.uint16()
+			}
+			if p.err != nil {
+				return p.err
+			}
+			b.Publish(topic, p.data)
+			switch qos {
+			case 1:
+				err = c.write(ack(packetPuback<<4, id))
+			case 2:
+				err = c.write(ack(packetPubrec<<4, id))
+			}
+		case packetPubrel:
+			err = c.write(ack(packetPubcomp<<4, p.uint16()))
+		case packetSubscribe:
+			id := p.uint16()
+			granted := []byte{}
+			for len(p.data) > 0 && p.err == nil {
+				filter := p.string()
+				p.byte() // requested QoS: every message is delivered with QoS 0
+				b.mu.Lock()
+				c.filters[filter] = true
+				b.mu.Unlock()
+				granted = append(granted, 0)
+			}
+			if p.err != nil {
+				return p.err
+			}
+			err = c.write(packet(packetSuback<<4, binary.BigEndian.AppendUint16(nil, id), granted))
+		case packetUnsubscribe:
+			id := p.uint16()
+			for len(p.data) > 0 && p.err == nil {
+				filter := p.string()
+				b.mu.Lock()
+				delete(c.filters, filter)
+				b.mu.Unlock()
+			}
+			if p.err != nil {
+				return p.err
+			}
+			err = c.write(ack(packetUnsuback<<4, id))
+		case packetPingreq:
+			err = c.write([]byte{packetPingresp << 4, 0})
+		case packetDisconnect:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) write(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// readPacket reads the fixed header and the body of a packet.
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errMalformed
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return header, body, err
+}
+
+func packet(header byte, parts ...[]byte) []byte {
+	body := slices.Concat(parts...)
+	result := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 128
+		}
+		result = append(result, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(result, body...)
+}
+
+func publishPacket(topic string, payload []byte) []byte {
+	return packet(packetPublish<<4, encodeString(topic), payload)
+}
+
+func ack(header byte, id uint16) []byte {
+	return packet(header, binary.BigEndian.AppendUint16(nil, id))
+}
+
+func encodeString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// parser reads the fields of a packet body; the first error sticks.
+type parser struct {
+	data []byte
+	err  error
+}
+
+func (p *parser) byte() byte {
+	if p.err != nil || len(p.data) < 1 {
+		p.err = cmp.Or(p.err, errMalformed)
+		return 0
+	}
+	b := p.data[0]
+	p.data = p.data[1:]
+	return b
+}
+
+func (p *parser) uint16() uint16 {
+	if p.err != nil || len(p.data) < 2 {
+		p.err = cmp.Or(p.err, errMalformed)
+		return 0
+	}
+	v := binary.BigEndian.Uint16(p.data)
+	p.data = p.data[2:]
+	return v
+}
+
+func (p *parser) string() string {
+	length := int(p.uint16())
+	if p.err != nil || len(p.data) < length {
+		p.err = cmp.Or(p.err, errMalformed)
+		return ""
+	}
+	s := string(p.data[:length])
+	p.data = p.data[length:]
+	return s
+}
@@ -0,0 +1,27 @@
+package mqtttest
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"qiot/a/b", "qiot/a/b", true},
+		{"qiot/a/b", "qiot/a/c", false},
+		{"qiot/a", "qiot/a/b", false},
+		{"qiot/a/b", "qiot/a", false},
+		{"qiot/+/b", "qiot/a/b", true},
+		{"qiot/+", "qiot/a/b", false},
+		{"qiot/#", "qiot/a/b", true},
+		// # also matches the parent level
+		{"qiot/#", "qiot", true},
+		{"#", "qiot/a", true},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"qiot-configuration-service/api"
 	"qiot-configuration-service/config"
+	"qiot-configuration-service/service"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -11,14 +20,26 @@ import (
 
 func main() {
 
-	appConfiguration := config.NewAppConfiguration()
+	settings, err := config.LoadSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
+	appConfiguration := config.NewAppConfiguration(settings)
+	// the background workers stop at SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	service.NewJobService(appConfiguration).Start(ctx)
+	if settings.Ingestion.Builtin() {
+		service.NewIngestionWorker(appConfiguration).Start(ctx)
+	}
 
 	router := gin.Default()
+	router.Use(api.RequestID())
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:5173", "http://vmi2209617.contaboserver.net:8899"},
+		AllowOrigins:     settings.Server.CORSOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Request-ID"},
+		ExposeHeaders:    []string{"Content-Length", "X-Request-ID"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -26,6 +47,20 @@ func main() {
 	api.NewSensorAPI(appConfiguration, router)
 	api.NewExperimentAPI(appConfiguration, router)
 	api.NewDashboardAPI(appConfiguration, router)
+	api.NewJobAPI(appConfiguration, router)
+	api.NewGatewayProfileAPI(appConfiguration, router)
 
-	router.Run(":8080")
+	server := &http.Server{Addr: fmt.Sprintf(":%d", settings.Server.Port), Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("error while shutting down:", err)
+	}
 }
@@ -0,0 +1,119 @@
+package rulegen
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// Envelope declares which values of the message envelope published by the
+// gateway (around the sensor values) are written with every point, as tags or
+// as fields. Paths are relative to the payload root and default to the name.
+type Envelope struct {
+	Tags   []Field `json:"tags" bson:"tags"`
+	Fields []Field `json:"fields" bson:"fields"`
+}
+
+var (
+	envelopeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envelopePath = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+)
+
+// DefaultEnvelope is the envelope of the gateways publishing before envelopes
+// were configurable. It differs by parser: BLE struct payloads also carry the
+// app tag and the RSSI.
+func DefaultEnvelope(parser string) Envelope {
+	switch parser {
+	case StructParser:
+		return Envelope{
+			Tags: []Field{
+				{Name: "appTagName", Path: "APP_TAG_NAME"},
+				{Name: "deviceAddress", Path: "deviceAddress"},
+				{Name: "deviceName", Path: "deviceName"},
+				{Name: "gatewayName", Path: "gatewayName"},
+			},
+			Fields: []Field{
+				{Name: "gatewayBattery", Path: "gatewayBattery", Type: TypeInteger},
+				{Name: "rssi", Path: "rssi", Type: TypeInteger},
+			},
+		}
+	case JSONPayloadParser:
+		envelope := DefaultEnvelope("")
+		// without a path, as the rules created before envelopes select it
+		envelope.Fields = []Field{{Name: "gatewayBattery", Type: TypeInteger}}
+		return envelope
+	}
+	return Envelope{
+		Tags: []Field{
+			{Name: "deviceName", Path: "deviceName"},
+			{Name: "deviceAddress", Path: "deviceAddress"},
+			{Name: "gatewayName", Path: "gatewayName"},
+		},
+		Fields: []Field{},
+	}
+}
+
+// EnvelopeFor returns the envelope declared by a device (its "gateway" object,
+// resolved from the gateway profile when the sensor uses one), or the default
+// envelope of the parser. A stored envelope that no longer parses is logged
+// and replaced by the default one.
+func EnvelopeFor(device map[string]interface{}, parser string) Envelope {
+	if gateway, ok := device["gateway"]; ok {
+		envelope, err := ParseEnvelope(gateway)
+		if err == nil {
+			return envelope
+		}
+		log.Printf("Device %s: invalid gateway envelope, using the default one: %v", GetString(device, "name"), err)
+	}
+	return DefaultEnvelope(parser)
+}
+
+// ParseEnvelope reads and validates an envelope document:
+//
+//	{"tags": [{"name": "gatewayName"}], "fields": [{"name": "rssi", "type": "int"}]}
+func ParseEnvelope(v interface{}) (Envelope, error) {
+	document, ok := object(v)
+	if !ok {
+		return Envelope{}, errors.New("gateway envelope must be an object with tags and fields")
+	}
+	envelope := Envelope{Tags: []Field{}, Fields: []Field{}}
+	errs := []error{}
+	names := map[string]bool{"experimentId": true}
+	for _, section := range []string{"tags", "fields"} {
+		for i, item := range objects(document[section]) {
+			f := Field{}
+			f.Name, _ = item["name"].(string)
+			f.Path, _ = item["path"].(string)
+			if f.Path == "" {
+				f.Path = f.Name
+			}
+			switch {
+			case !envelopeName.MatchString(f.Name):
+				errs = append(errs, fmt.Errorf("gateway %s #%d: invalid name %q", section, i, f.Name))
+				continue
+			case names[f.Name]:
+				errs = append(errs, fmt.Errorf("gateway %s %s: name already used", section, f.Name))
+				continue
+			case !envelopePath.MatchString(f.Path):
+				errs = append(errs, fmt.Errorf("gateway %s %s: invalid path %q", section, f.Name, f.Path))
+				continue
+			}
+			names[f.Name] = true
+			if section == "tags" {
+				envelope.Tags = append(envelope.Tags, f)
+				continue
+			}
+			declared, _ := item["type"].(string)
+			fieldType, err := StructFieldType(declared)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("gateway fields %s: %w", f.Name, err))
+				continue
+			}
+			f.Type = fieldType
+			f.Unit, _ = item["unit"].(string)
+			envelope.Fields = append(envelope.Fields, f)
+		}
+	}
+	return envelope, errors.Join(errs...)
+}
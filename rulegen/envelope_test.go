@@ -0,0 +1,70 @@
+package rulegen
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// An envelope stored with its Influx types, as gateway profiles are, parses
+// to the same envelope.
+func TestParseEnvelopeInfluxTypes(t *testing.T) {
+	declared := bson.M{
+		"tags": primitive.A{bson.M{"name": "gatewayName"}},
+		"fields": primitive.A{
+			bson.M{"name": "battery", "type": "uint8"},
+			bson.M{"name": "rssi", "type": "int"},
+			bson.M{"name": "voltage", "type": "double", "unit": "V"},
+			bson.M{"name": "charging", "type": "bool"},
+			bson.M{"name": "firmware", "type": "char"},
+		},
+	}
+	envelope, err := ParseEnvelope(declared)
+	if err != nil {
+		t.Fatalf("ParseEnvelope: %v", err)
+	}
+	stored := bson.M{"tags": primitive.A{}, "fields": primitive.A{}}
+	for _, f := range envelope.Tags {
+		stored["tags"] = append(stored["tags"].(primitive.A), bson.M{"name": f.Name, "path": f.Path})
+	}
+	for _, f := range envelope.Fields {
+		stored["fields"] = append(stored["fields"].(primitive.A), bson.M{"name": f.Name, "path": f.Path, "type": f.Type, "unit": f.Unit})
+	}
+	again, err := ParseEnvelope(stored)
+	if err != nil {
+		t.Fatalf("ParseEnvelope(stored): %v", err)
+	}
+	if !reflect.DeepEqual(again, envelope) {
+		t.Errorf("stored envelope parses to %+v, want %+v", again, envelope)
+	}
+	if got := EnvelopeFor(bson.M{"gateway": stored}, StructParser); !reflect.DeepEqual(got, envelope) {
+		t.Errorf("EnvelopeFor = %+v, want the stored envelope", got)
+	}
+}
+
+func TestStructFieldType(t *testing.T) {
+	tests := map[string]string{
+		"": TypeInteger, "int24": TypeInteger, "integer": TypeInteger, " INT ": TypeInteger,
+		"uint": TypeUnsigned, "uint64": TypeUnsigned, "unsigned": TypeUnsigned,
+		"float": TypeFloat, "double": TypeFloat, "float32": TypeFloat,
+		"bool": TypeBoolean, "boolean": TypeBoolean,
+		"string": TypeString, "char": TypeString,
+	}
+	for declared, want := range tests {
+		if got, err := StructFieldType(declared); err != nil || got != want {
+			t.Errorf("StructFieldType(%q) = %q, %v, want %q", declared, got, err, want)
+		}
+	}
+	if got, err := StructFieldType("decimal"); err == nil {
+		t.Errorf("StructFieldType(decimal) = %q, want an error", got)
+	}
+}
+
+func TestEnvelopeForInvalid(t *testing.T) {
+	device := bson.M{"name": "d1", "gateway": bson.M{"fields": primitive.A{bson.M{"name": "rssi", "type": "decimal"}}}}
+	if got := EnvelopeFor(device, JSONPayloadParser); !reflect.DeepEqual(got, DefaultEnvelope(JSONPayloadParser)) {
+		t.Errorf("EnvelopeFor = %+v, want the default envelope", got)
+	}
+}
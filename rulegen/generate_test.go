@@ -0,0 +1,193 @@
+package rulegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// go test ./rulegen -update rewrites the golden files.
+var update = flag.Bool("update", false, "rewrite the golden files of the generated definitions")
+
+// bleDevice is a complete BLE device with one characteristic.
+func bleDevice(shortName string, address string, characteristic bson.M) bson.M {
+	return bson.M{
+		"name":      shortName + " sensor",
+		"shortName": shortName,
+		"address":   address,
+		"services": []bson.M{{
+			"uuid":            "180a",
+			"characteristics": []bson.M{characteristic},
+		}},
+	}
+}
+
+// movesenseDevice is a complete Movesense device with the given measures.
+func movesenseDevice(shortName string, address string, measures ...bson.M) bson.M {
+	return bson.M{
+		"name":                 shortName + " sensor",
+		"shortName":            shortName,
+		"address":              address,
+		"services":             []bson.M{},
+		"movesense_whiteboard": bson.M{"measures": measures},
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tests := map[string]bson.M{
+		StructParser: {
+			"experimentId": "665f1c2e8b3e4a0012345678",
+			"devices": bson.M{
+				"sensor_0": bleDevice("THERMO", "AA:BB:CC:DD:EE:01", bson.M{
+					"name":      "Temperature & Humidity",
+					"uuid":      "2a6e",
+					"mqttTopic": "qiot/665f1c2e8b3e4a0012345678/thermo/aabbccddee01/temperaturehumidity",
+					"structParser": bson.M{
+						"endianness": "little",
+						"fields": bson.A{
+							bson.M{"name": "temperature", "type": "int16", "scale": 0.01, "unit": "°C"},
+							bson.M{"name": "humidity", "type": "uint8"},
+							bson.M{"name": "pressure", "type": "float32"},
+							bson.M{"name": "alarm", "type": "bool"},
+							bson.M{"name": "label", "type": "string", "length": 4},
+							bson.M{"name": "count", "type": "uint8"},
+							bson.M{"name": "history", "repeat": "count", "fields": bson.A{bson.M{"name": "value", "type": "int16"}}},
+						},
+					},
+				}),
+				// a device declaring its envelope
+				"sensor_1": func() bson.M {
+					device := bleDevice("beacon", "AA:BB:CC:DD:EE:02", bson.M{
+						"name":         "Battery",
+						"mqttTopic":    "qiot/665f1c2e8b3e4a0012345678/beacon/aabbccddee02/battery",
+						"structParser": bson.M{"fields": bson.A{bson.M{"name": "level"}}},
+					})
+					device["gateway"] = bson.M{
+						"tags":   primitive.A{bson.M{"name": "gatewayName"}, bson.M{"name": "zone", "path": "meta.zone"}},
+						"fields": primitive.A{bson.M{"name": "snr", "type": "float"}, bson.M{"name": "hops", "path": "meta.hops", "type": "unsigned"}},
+					}
+					return device
+				}(),
+				// skipped: the characteristic has no topic
+				"sensor_2": bleDevice("skipped", "AA:BB:CC:DD:EE:03", bson.M{
+					"name":         "No topic",
+					"structParser": bson.M{"fields": bson.A{bson.M{"name": "v"}}},
+				}),
+			},
+		},
+		JSONPayloadParser: {
+			"experimentId": "665f1c2e8b3e4a0012345678",
+			"devices": bson.M{
+				"sensor_0": movesenseDevice("MS", "0C:8C:DC:00:00:01",
+					bson.M{
+						"name":      "Meas/Temp",
+						"mqttTopic": "qiot/665f1c2e8b3e4a0012345678/ms/0c8cdc000001/meastemp",
+						JSONPayloadParser: bson.M{"fields": bson.A{
+							bson.M{"name": "temperature", "path": "Body.Measurement", "type": "float", "unit": "°C"},
+							bson.M{"name": "timestamp", "path": "Body.Timestamp", "type": "integer"},
+							bson.M{"name": "raw"},
+						}},
+					},
+					bson.M{
+						"name":      "Meas/HR",
+						"mqttTopic": "qiot/665f1c2e8b3e4a0012345678/ms/0c8cdc000001/meashr",
+						JSONPayloadParser: bson.M{"use_jq": true, "fields": bson.A{
+							bson.M{"name": "average", "path": "Body.average", "type": "float"},
+							bson.M{"name": "status", "path": "Body.status", "type": "string"},
+							bson.M{"name": "whole"},
+						}},
+					},
+				),
+				"sensor_1": func() bson.M {
+					device := movesenseDevice("custom", "0C:8C:DC:00:00:02", bson.M{
+						"name":            "Meas/Acc",
+						"mqttTopic":       "qiot/665f1c2e8b3e4a0012345678/custom/0c8cdc000002/measacc",
+						JSONPayloadParser: bson.M{"fields": bson.A{bson.M{"name": "x", "path": "Body.x", "type": "float"}}},
+					})
+					device["gateway"] = bson.M{
+						"tags":   primitive.A{bson.M{"name": "deviceName"}},
+						"fields": primitive.A{bson.M{"name": "gatewayBattery", "path": "gw.battery", "type": "int"}},
+					}
+					return device
+				}(),
+			},
+		},
+		JSONArrayParser: {
+			"experimentId": "665f1c2e8b3e4a0012345678",
+			"devices": bson.M{
+				"sensor_0": movesenseDevice("MS", "0C:8C:DC:00:00:01", bson.M{
+					"name":      "Meas/Acc/13",
+					"mqttTopic": "qiot/665f1c2e8b3e4a0012345678/ms/0c8cdc000001/measacc13",
+					JSONArrayParser: bson.M{
+						"arrayPath": "Body.ArrayAcc",
+						"fields": bson.A{
+							bson.M{"name": "x", "path": "x", "type": "float"},
+							bson.M{"name": "y", "path": "y", "type": "float"},
+							bson.M{"name": "z", "path": "z", "type": "float"},
+							bson.M{"name": "sample"},
+						},
+					},
+				}),
+			},
+		},
+		SingleMeasurementParser: {
+			"experimentId": "665f1c2e8b3e4a0012345678",
+			"devices": bson.M{
+				"sensor_0": movesenseDevice("MS", "0C:8C:DC:00:00:01", bson.M{
+					"name":      "Meas/ECG",
+					"mqttTopic": "qiot/665f1c2e8b3e4a0012345678/ms/0c8cdc000001/measecg",
+					SingleMeasurementParser: bson.A{
+						bson.M{"name": "ecg", "path": "Body.Samples", "type": "integer"},
+						bson.M{"name": "value"},
+					},
+				}),
+			},
+		},
+	}
+	for name, experiment := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := json.MarshalIndent(Generate(experiment), "", "  ")
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			got = append(got, '\n')
+			golden := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test ./rulegen -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Generate differs from %s (run go test ./rulegen -update and review the diff):\n%s", golden, got)
+			}
+		})
+	}
+}
+
+// Definitions do not depend on the experiment id being set.
+func TestGenerateWithoutExperimentId(t *testing.T) {
+	definitions := Generate(bson.M{"devices": bson.M{
+		"sensor_0": movesenseDevice("MS", "0C:8C:DC:00:00:01", bson.M{
+			"name":                  "Meas/ECG",
+			"mqttTopic":             "qiot/ms/0c8cdc000001/measecg",
+			SingleMeasurementParser: bson.A{bson.M{"name": "ecg", "path": "Body.Samples", "type": "integer"}},
+		}),
+	}})
+	if len(definitions) != 1 {
+		t.Fatalf("Generate = %d definitions, want 1", len(definitions))
+	}
+	want := "ms_measecg,deviceAddress=${deviceAddress},deviceName=${deviceName},gatewayName=${gatewayName} ecg=${ecg}i"
+	if got := definitions[0].WriteSyntax; got != want {
+		t.Errorf("WriteSyntax = %s, want %s", got, want)
+	}
+}
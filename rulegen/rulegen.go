@@ -0,0 +1,294 @@
+// Package rulegen computes the EMQX rules and InfluxDB actions wanted for a
+// complete experiment (as returned by ExperimentService.GetCompleteExperimentById).
+// It only transforms data: the result can be inspected or diffed before
+// anything is sent to EMQX.
+package rulegen
+
+import (
+	"fmt"
+	"maps"
+	"qiot-configuration-service/topic"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Parser kinds, named after the sensor document keys declaring them.
+const (
+	StructParser            = "structParser"
+	JSONPayloadParser       = "jsonPayloadParser"
+	JSONArrayParser         = "jsonArrayParser"
+	SingleMeasurementParser = "SingleMeasurementParser"
+)
+
+// arrayAlias names the current element in the FOREACH of jsonArrayParser rules.
+const arrayAlias = "sample_item"
+
+// Tag is an Influx tag of the written points; Value is a literal or an EMQX
+// placeholder such as ${payload.deviceName}, Path the payload value it comes from.
+type Tag struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	Value string `json:"value"`
+}
+
+// Field is an Influx field read from the MQTT payload. Path is relative to the
+// payload (or to the array element for jsonArrayParser); empty means the whole
+// value. Gateway fields come from the envelope and are always read from the payload root.
+// Unit only documents the values.
+type Field struct {
+	Name    string `json:"name" bson:"name"`
+	Path    string `json:"path,omitempty" bson:"path,omitempty"`
+	Type    string `json:"type,omitempty" bson:"type,omitempty"`
+	Gateway bool   `json:"gateway,omitempty" bson:"-"`
+	Unit    string `json:"unit,omitempty" bson:"unit,omitempty"`
+}
+
+// Definition is a rule and the InfluxDB action it feeds, generated for one
+// characteristic or measure of an experiment. SQL and WriteSyntax are rendered
+// from the other fields.
+type Definition struct {
+	Device      string  `json:"device"`
+	Source      string  `json:"source"`
+	Topic       string  `json:"topic"`
+	Parser      string  `json:"parser"`
+	ArrayPath   string  `json:"arrayPath,omitempty"`
+	UseJQ       bool    `json:"useJq,omitempty"`
+	Measurement string  `json:"measurement"`
+	Tags        []Tag   `json:"tags"`
+	Fields      []Field `json:"fields"`
+
+	ActionName  string `json:"actionName"`
+	ActionDesc  string `json:"actionDescription"`
+	WriteSyntax string `json:"writeSyntax"`
+	RuleID      string `json:"ruleId"`
+	RuleName    string `json:"ruleName"`
+	RuleDesc    string `json:"ruleDescription"`
+	SQL         string `json:"sql"`
+}
+
+var nonAlpha = regexp.MustCompile(`[^a-z0-9]`)
+
+// Generate returns the definitions of a complete experiment, devices in name order.
+func Generate(experiment bson.M) []Definition {
+	definitions := []Definition{}
+	experimentId := GetString(experiment, "experimentId")
+	devices, _ := experiment["devices"].(bson.M)
+
+	for _, deviceName := range slices.Sorted(maps.Keys(devices)) {
+		deviceMap, ok := devices[deviceName].(bson.M)
+		if !ok {
+			continue
+		}
+		deviceShort := strings.ToLower(GetString(deviceMap, "shortName"))
+
+		services, _ := deviceMap["services"].([]primitive.M)
+		for _, service := range services {
+			characteristics, _ := service["characteristics"].([]primitive.M)
+			for _, characteristic := range characteristics {
+				sp, ok := characteristic["structParser"].(primitive.M)
+				if !ok {
+					continue
+				}
+				d, ok := newDefinition(experimentId, deviceName, deviceShort, characteristic)
+				if !ok {
+					continue
+				}
+				d.Parser = StructParser
+				d.Fields = StructFields(sp)
+				definitions = append(definitions, d.render(EnvelopeFor(deviceMap, StructParser)))
+			}
+		}
+
+		mw, _ := deviceMap["movesense_whiteboard"].(bson.M)
+		measures, _ := mw["measures"].([]bson.M)
+		for _, measure := range measures {
+			d, ok := newDefinition(experimentId, deviceName, deviceShort, measure)
+			if !ok {
+				continue
+			}
+			if jp, ok := measure[JSONPayloadParser].(bson.M); ok {
+				d.Parser = JSONPayloadParser
+				d.UseJQ, _ = jp["use_jq"].(bool)
+				d.Fields = jsonFields(Documents(jp["fields"]))
+			} else if ja, ok := measure[JSONArrayParser].(bson.M); ok {
+				d.Parser = JSONArrayParser
+				d.ArrayPath = GetString(ja, "arrayPath")
+				d.Fields = jsonFields(Documents(ja["fields"]))
+			} else if smp, ok := measure[SingleMeasurementParser].(bson.A); ok {
+				d.Parser = SingleMeasurementParser
+				d.Fields = jsonFields(Documents(smp))
+			} else {
+				continue
+			}
+			definitions = append(definitions, d.render(EnvelopeFor(deviceMap, d.Parser)))
+		}
+	}
+	return definitions
+}
+
+// newDefinition fills the names shared by every parser; ok is false when the
+// device short name or the source name is missing, or the topic is missing or invalid.
+func newDefinition(experimentId string, deviceName string, deviceShort string, source bson.M) (Definition, bool) {
+	sourceName := GetString(source, "name")
+	clean := nonAlpha.ReplaceAllString(strings.ToLower(sourceName), "")
+	mqttTopic := GetString(source, "mqttTopic")
+	if deviceShort == "" || clean == "" || !topic.ValidFilter(mqttTopic) {
+		return Definition{}, false
+	}
+	measurement := deviceShort + "_" + clean
+	return Definition{
+		Device:      deviceName,
+		Source:      sourceName,
+		Topic:       mqttTopic,
+		Measurement: measurement,
+		ActionName:  "action_" + measurement + "_" + experimentId,
+		ActionDesc:  fmt.Sprintf("InfluxDB action for %s - %s", deviceName, sourceName),
+		RuleID:      "rule_id_" + measurement + "_" + experimentId,
+		RuleName:    "rule_" + measurement + "_" + experimentId,
+		RuleDesc:    fmt.Sprintf("Rule for %s - %s", deviceName, sourceName),
+		Tags:        experimentTags(experimentId),
+	}, true
+}
+
+func experimentTags(experimentId string) []Tag {
+	if experimentId == "" {
+		return []Tag{}
+	}
+	return []Tag{{Name: "experimentId", Value: experimentId}}
+}
+
+// jsonFields reads the fields of a JSON parser. Declared types are normalised
+// to Influx types; an untyped field, or one stored with an unknown type before
+// types were validated, is written as it is.
+func jsonFields(documents []bson.M) []Field {
+	fields := []Field{}
+	for _, f := range documents {
+		fieldType := GetString(f, "type")
+		if t, err := StructFieldType(fieldType); fieldType != "" && err == nil {
+			fieldType = t
+		}
+		fields = append(fields, Field{Name: GetString(f, "name"), Path: GetString(f, "path"), Type: fieldType, Unit: GetString(f, "unit")})
+	}
+	return fields
+}
+
+// render adds the envelope tags and fields, then renders SQL and write syntax.
+// Tags are written sorted by name after experimentId; fields keep their order,
+// envelope fields last.
+func (d Definition) render(envelope Envelope) Definition {
+	tags := slices.SortedFunc(slices.Values(envelope.Tags), func(a, b Field) int { return strings.Compare(a.Name, b.Name) })
+	for _, f := range envelope.Fields {
+		f.Gateway = true
+		d.Fields = append(d.Fields, f)
+	}
+
+	if d.Parser == StructParser {
+		// the rule selects the whole payload: values are referenced through it
+		for _, t := range tags {
+			d.Tags = append(d.Tags, Tag{Name: t.Name, Path: t.Path, Value: "${payload." + t.Path + "}"})
+		}
+		d.SQL = fmt.Sprintf(`SELECT * FROM "%s"`, d.Topic)
+		d.WriteSyntax = d.lineProtocol(func(f Field) string { return "payload." + f.Path })
+		return d
+	}
+
+	// the JSON parsers select every value under an alias
+	for _, t := range tags {
+		d.Tags = append(d.Tags, Tag{Name: t.Name, Path: t.Path, Value: "${" + t.Name + "}"})
+	}
+	columns := []string{}
+	for _, t := range envelope.Tags {
+		columns = append(columns, fmt.Sprintf("payload.%s as %s", t.Path, t.Name))
+	}
+	for _, f := range d.Fields {
+		columns = append(columns, d.column(f))
+	}
+	if d.Parser == JSONArrayParser {
+		d.SQL = fmt.Sprintf("FOREACH payload.%s as %s DO %s FROM \"%s\"", d.ArrayPath, arrayAlias, strings.Join(columns, ", "), d.Topic)
+	} else {
+		d.SQL = fmt.Sprintf("SELECT %s FROM \"%s\"", strings.Join(columns, ", "), d.Topic)
+	}
+	d.WriteSyntax = d.lineProtocol(func(f Field) string { return f.Name })
+	return d
+}
+
+// column is the SQL expression selecting a field of a JSON parser.
+func (d Definition) column(f Field) string {
+	source := "payload"
+	if d.Parser == JSONArrayParser && !f.Gateway {
+		source = arrayAlias
+	}
+	switch {
+	case f.Gateway && f.Path != "":
+		return fmt.Sprintf("payload.%s as %s", f.Path, f.Name)
+	case d.UseJQ && f.Path != "":
+		return fmt.Sprintf("first(jq('.%s', payload)) as %s", f.Path, f.Name)
+	case f.Path != "":
+		return fmt.Sprintf("%s.%s as %s", source, f.Path, f.Name)
+	}
+	return fmt.Sprintf("%s as %s", source, f.Name)
+}
+
+// lineProtocol renders the Influx write syntax; ref gives the placeholder of a
+// field value. Integers get the "i" suffix, unsigned integers "u", strings are
+// quoted; floats, booleans and untyped JSON fields are written as they are.
+func (d Definition) lineProtocol(ref func(Field) string) string {
+	series := []string{d.Measurement}
+	for _, t := range d.Tags {
+		series = append(series, t.Name+"="+t.Value)
+	}
+	values := []string{}
+	for _, f := range d.Fields {
+		value := fmt.Sprintf("${%s}", ref(f))
+		switch f.Type {
+		case TypeInteger:
+			value += "i"
+		case TypeUnsigned:
+			value += "u"
+		case TypeString:
+			value = `"` + value + `"`
+		}
+		values = append(values, f.Name+"="+value)
+	}
+	return strings.Join(series, ",") + " " + strings.Join(values, ",")
+}
+
+// Documents returns the sub-documents of a list, skipping other values.
+func Documents(v interface{}) []bson.M {
+	list, _ := v.(bson.A)
+	result := []bson.M{}
+	for _, item := range list {
+		if m, ok := item.(bson.M); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// GetString safely extracts a string field from a document: other values are
+// returned as their String() or JSON form, missing ones as "".
+func GetString(m map[string]interface{}, key string) string {
+	if m == nil {
+		return ""
+	}
+	if v, ok := m[key]; ok && v != nil {
+		switch t := v.(type) {
+		case string:
+			return t
+		case fmt.Stringer:
+			return t.String()
+		default:
+			// attempt JSON encode -> string
+			bs, err := json.Marshal(v)
+			if err == nil {
+				return string(bs)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package rulegen
+
+import (
+	"errors"
+	"fmt"
+	"qiot-configuration-service/structparser"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Influx field types of a generated write syntax.
+const (
+	TypeInteger  = "integer"
+	TypeUnsigned = "unsigned"
+	TypeFloat    = "float"
+	TypeBoolean  = "boolean"
+	TypeString   = "string"
+)
+
+// fieldTypes maps the types accepted in a structParser field to their Influx
+// type. The Influx types themselves are accepted, as envelopes are stored with them.
+var fieldTypes = map[string]string{
+	"int": TypeInteger, "int8": TypeInteger, "int16": TypeInteger, "int24": TypeInteger, "int32": TypeInteger, "int64": TypeInteger, "integer": TypeInteger,
+	"uint": TypeUnsigned, "unsigned": TypeUnsigned, "uint8": TypeUnsigned, "uint16": TypeUnsigned, "uint24": TypeUnsigned, "uint32": TypeUnsigned, "uint64": TypeUnsigned,
+	"float": TypeFloat, "float32": TypeFloat, "float64": TypeFloat, "double": TypeFloat,
+	"bool": TypeBoolean, "boolean": TypeBoolean,
+	"string": TypeString, "char": TypeString,
+}
+
+// StructFieldType returns the Influx type of a structParser field type. A
+// missing type is an integer, as every struct field was before types were honoured.
+func StructFieldType(declared string) (string, error) {
+	declared = strings.ToLower(strings.TrimSpace(declared))
+	if declared == "" {
+		return TypeInteger, nil
+	}
+	if t, ok := fieldTypes[declared]; ok {
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown field type %q (use int, uint, float, bool, string or an Influx type)", declared)
+}
+
+// ValidateSensor checks the structParser of every characteristic (see package
+// structparser), the field types of the JSON parsers of every Movesense measure
+// and the gateway envelope of a sensor document, as stored or as decoded from a
+// request body. The existence of a referenced gateway profile is
+// not checked.
+func ValidateSensor(sensor map[string]interface{}) error {
+	errs := []error{}
+	if gateway, ok := sensor["gateway"]; ok {
+		if _, err := ParseEnvelope(gateway); err != nil {
+			errs = append(errs, err)
+		}
+		if _, ok := sensor["gatewayProfile"]; ok {
+			errs = append(errs, errors.New("gateway and gatewayProfile cannot be both set"))
+		}
+	}
+	if profile, ok := sensor["gatewayProfile"]; ok {
+		if name, _ := profile.(string); name == "" {
+			errs = append(errs, errors.New("gatewayProfile must be the name of a gateway profile"))
+		}
+	}
+	for _, service := range objects(sensor["services"]) {
+		for _, characteristic := range objects(service["characteristics"]) {
+			sp, ok := characteristic["structParser"]
+			if !ok {
+				continue
+			}
+			if _, err := structparser.Parse(sp); err != nil {
+				characteristicName, _ := characteristic["name"].(string)
+				errs = append(errs, fmt.Errorf("characteristic %q: %w", characteristicName, err))
+			}
+		}
+	}
+	for _, measure := range measures(sensor) {
+		measureName, _ := measure["name"].(string)
+		for _, field := range measureFields(measure) {
+			declared, ok := field["type"]
+			if !ok || declared == nil || declared == "" {
+				// untyped JSON values are written as they are
+				continue
+			}
+			name, _ := field["name"].(string)
+			typeName, ok := declared.(string)
+			if !ok {
+				errs = append(errs, fmt.Errorf("measure %q, field %q: type must be a string", measureName, name))
+				continue
+			}
+			if _, err := StructFieldType(typeName); err != nil {
+				errs = append(errs, fmt.Errorf("measure %q, field %q: %w", measureName, name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// measures returns the Movesense measures of a sensor document; sensors with a
+// dynamicSchema keep them under dynamicJson.
+func measures(sensor map[string]interface{}) []map[string]interface{} {
+	whiteboard, ok := object(sensor["movesense_whiteboard"])
+	if !ok {
+		dynamic, _ := object(sensor["dynamicJson"])
+		whiteboard, _ = object(dynamic["movesense_whiteboard"])
+	}
+	return objects(whiteboard["measures"])
+}
+
+// measureFields returns the fields of the JSON parser of a measure.
+func measureFields(measure map[string]interface{}) []map[string]interface{} {
+	for _, parser := range []string{JSONPayloadParser, JSONArrayParser} {
+		if config, ok := object(measure[parser]); ok {
+			return objects(config["fields"])
+		}
+	}
+	return objects(measure[SingleMeasurementParser])
+}
+
+// object accepts both bson documents and the plain maps decoded from JSON.
+func object(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case primitive.M:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+// objects returns the documents of a list, skipping other values.
+func objects(v interface{}) []map[string]interface{} {
+	var items []interface{}
+	switch l := v.(type) {
+	case primitive.A:
+		items = l
+	case []interface{}:
+		items = l
+	case []primitive.M:
+		for _, m := range l {
+			items = append(items, m)
+		}
+	}
+	result := []map[string]interface{}{}
+	for _, item := range items {
+		if m, ok := object(item); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// StructFields returns the Influx fields written for a structParser: its
+// values in order, scaled ones as floats. Repeated blocks are not written. A
+// stored structParser that no longer parses is read field by field, unknown
+// types as integers.
+func StructFields(structParser map[string]interface{}) []Field {
+	fields := []Field{}
+	layout, err := structparser.Parse(structParser)
+	if err != nil {
+		for _, f := range objects(structParser["fields"]) {
+			name, _ := f["name"].(string)
+			declared, _ := f["type"].(string)
+			fieldType, err := StructFieldType(declared)
+			if err != nil {
+				fieldType = TypeInteger
+			}
+			unit, _ := f["unit"].(string)
+			fields = append(fields, Field{Name: name, Path: name, Type: fieldType, Unit: unit})
+		}
+		return fields
+	}
+	for _, f := range layout.Fields {
+		if f.Type == structparser.TypeBlock {
+			continue
+		}
+		fieldType, _ := StructFieldType(f.Type)
+		if f.Scaled() {
+			fieldType = TypeFloat
+		}
+		// struct fields are published flat in the payload
+		fields = append(fields, Field{Name: f.Name, Path: f.Name, Type: fieldType, Unit: f.Unit})
+	}
+	return fields
+}
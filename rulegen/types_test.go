@@ -0,0 +1,56 @@
+package rulegen
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestValidateSensorMeasures(t *testing.T) {
+	sensor := func(measure bson.M) map[string]interface{} {
+		return bson.M{"movesense_whiteboard": bson.M{"measures": bson.A{measure}}}
+	}
+	valid := []map[string]interface{}{
+		sensor(bson.M{"name": "Meas/HR", JSONPayloadParser: bson.M{"fields": bson.A{
+			bson.M{"name": "average", "type": "float"}, bson.M{"name": "count", "type": "uint16"}, bson.M{"name": "raw"},
+		}}}),
+		sensor(bson.M{"name": "Meas/ECG", SingleMeasurementParser: bson.A{bson.M{"name": "ecg", "type": "integer"}}}),
+		// decoded from a request body
+		{"dynamicJson": map[string]interface{}{"movesense_whiteboard": map[string]interface{}{"measures": []interface{}{
+			map[string]interface{}{"name": "Meas/Acc", JSONArrayParser: map[string]interface{}{"fields": []interface{}{
+				map[string]interface{}{"name": "x", "type": "double"},
+			}}},
+		}}}},
+	}
+	for _, s := range valid {
+		if err := ValidateSensor(s); err != nil {
+			t.Errorf("ValidateSensor(%v): %v", s, err)
+		}
+	}
+	invalid := map[string]map[string]interface{}{
+		`measure "Meas/HR", field "average": unknown field type "decimal"`: sensor(bson.M{"name": "Meas/HR", JSONPayloadParser: bson.M{"fields": bson.A{bson.M{"name": "average", "type": "decimal"}}}}),
+		`measure "Meas/ECG", field "ecg": type must be a string`:           sensor(bson.M{"name": "Meas/ECG", SingleMeasurementParser: bson.A{bson.M{"name": "ecg", "type": 3}}}),
+		`measure "Meas/Acc", field "x": unknown field type "vector"`: {"dynamicJson": bson.M{"movesense_whiteboard": bson.M{"measures": bson.A{
+			bson.M{"name": "Meas/Acc", JSONArrayParser: bson.M{"fields": bson.A{bson.M{"name": "x", "type": "vector"}}}},
+		}}}},
+	}
+	for want, s := range invalid {
+		if err := ValidateSensor(s); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ValidateSensor(%v) = %v, want an error containing %q", s, err, want)
+		}
+	}
+}
+
+// JSON field types are normalised like struct field types.
+func TestJSONFieldTypes(t *testing.T) {
+	fields := jsonFields([]bson.M{
+		{"name": "a", "type": "int"}, {"name": "b", "type": "double"}, {"name": "c"}, {"name": "d", "type": "legacy"},
+	})
+	want := []string{TypeInteger, TypeFloat, "", "legacy"}
+	for i, f := range fields {
+		if f.Type != want[i] {
+			t.Errorf("field %s type = %q, want %q", f.Name, f.Type, want[i])
+		}
+	}
+}
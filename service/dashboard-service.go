@@ -1,9 +1,18 @@
 package service
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -12,88 +21,288 @@ import (
 type DashboardService struct {
 	AppConfig         *config.AppConfiguration
 	ExperimentService *ExperimentService
+
+	streamsMu sync.Mutex
+	// streams counts the live streams open per experiment
+	streams map[string]int
 }
+
+// ElementToQuery is a series of the experiment: a field of a characteristic
+// (Service is its UUID) or of a Movesense measure (Service is empty) of a device.
 type ElementToQuery struct {
+	Org           string
 	Bucket        string
 	SensorName    string
 	DeviceAddress string
 	Measurement   string
 	Field         string
+	Device        string
+	Service       string
+	Source        string
 }
 
 func NewDashboardService(appConfig *config.AppConfiguration) *DashboardService {
 	return &DashboardService{
 		AppConfig:         appConfig,
 		ExperimentService: NewExperimentService(appConfig),
+		streams:           map[string]int{},
 	}
 }
-func (ds *DashboardService) GetDashboardData(experimentId string, characteristicId string) ([]bson.M, error) {
-	nonAlpha := regexp.MustCompile(`[^a-z0-9]`)
-	//devo fare una query a influx per deviceAddress = deviceAddress e _measurement = measurement
+
+// GetDashboardData returns the series of a service of the experiment devices.
+// With includeGateway the envelope fields written by the gateway (battery,
+// RSSI...) are returned too.
+// The series are queried concurrently; the first failed query fails the request.
+func (ds *DashboardService) GetDashboardData(ctx context.Context, experimentId string, characteristicId string, params config.QueryParams, includeGateway bool) ([]bson.M, error) {
 	experiment, err := ds.ExperimentService.GetCompleteExperimentById(experimentId)
 	if err != nil {
 		return nil, err
 	}
+	window, err := defaultQueryWindow(experiment, params)
+	if err != nil {
+		return nil, err
+	}
+	elementToQuery := ds.dashboardSeries(experiment, characteristicId, includeGateway)
+	if len(elementToQuery) == 0 {
+		return nil, fmt.Errorf("no series for service %s in experiment %s: %w", characteristicId, experimentId, config.ErrNotFound)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ds.AppConfig.Settings.Dashboard.Timeout())
+	defer cancel()
+	result := []bson.M{}
+	for i, series := range ds.querySeries(ctx, experimentId, elementToQuery, window) {
+		if series.err != nil {
+			return nil, series.err
+		}
+		element := elementToQuery[i]
+		categories, data := categoriesAndData(series.points)
+		result = append(
+			result,
+			bson.M{
+				"id":         seriesID(element),
+				"sensorName": element.SensorName + " - " + element.Measurement + " - " + element.Field,
+				"categories": categories,
+				"data":       data,
+			},
+		)
+	}
+	return result, nil
+}
+
+// ExperimentDashboard holds every series of an experiment, grouped by device,
+// then by service and characteristic or by Movesense measure. Partial is set
+// when some queries failed; their series carry the error.
+type ExperimentDashboard struct {
+	ExperimentID string            `json:"experimentId"`
+	Start        time.Time         `json:"start"`
+	Stop         time.Time         `json:"stop"`
+	Every        string            `json:"every,omitempty"`
+	Fn           string            `json:"fn,omitempty"`
+	Devices      []DeviceDashboard `json:"devices"`
+	Series       int               `json:"series"`
+	Failed       int               `json:"failed"`
+	Partial      bool              `json:"partial"`
+}
+
+type DeviceDashboard struct {
+	Name     string             `json:"name"`
+	Address  string             `json:"address"`
+	Services []ServiceDashboard `json:"services"`
+	Measures []SourceDashboard  `json:"measures"`
+}
+
+type ServiceDashboard struct {
+	UUID            string            `json:"uuid"`
+	Characteristics []SourceDashboard `json:"characteristics"`
+}
+
+// SourceDashboard is a characteristic or a measure and its series, one per field.
+type SourceDashboard struct {
+	Name        string            `json:"name"`
+	Measurement string            `json:"measurement"`
+	Series      []DashboardSeries `json:"series"`
+}
+
+// DashboardSeries is the data of a field; Error is set when its query failed.
+type DashboardSeries struct {
+	ID         string    `json:"id"`
+	Field      string    `json:"field"`
+	Categories []string  `json:"categories"`
+	Data       []float64 `json:"data"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// GetExperimentDashboard returns every series of the experiment. The queries
+// run concurrently under a single deadline; failed ones are reported per
+// series and only fail the request when every query failed.
+func (ds *DashboardService) GetExperimentDashboard(ctx context.Context, experimentId string, params config.QueryParams, includeGateway bool) (*ExperimentDashboard, error) {
+	experiment, err := ds.ExperimentService.GetCompleteExperimentById(experimentId)
+	if err != nil {
+		return nil, err
+	}
+	window, err := defaultQueryWindow(experiment, params)
+	if err != nil {
+		return nil, err
+	}
+	elements := ds.dashboardSeries(experiment, "", includeGateway)
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("no series in experiment %s: %w", experimentId, config.ErrNotFound)
+	}
+	ctx, cancel := context.WithTimeout(ctx, ds.AppConfig.Settings.Dashboard.Timeout())
+	defer cancel()
+	results := ds.querySeries(ctx, experimentId, elements, window)
+
+	dashboard := &ExperimentDashboard{
+		ExperimentID: experimentId,
+		Start:        window.Start,
+		Stop:         window.Stop,
+		Fn:           window.Fn,
+		Devices:      []DeviceDashboard{},
+		Series:       len(elements),
+	}
+	if window.Every > 0 {
+		dashboard.Every = window.Every.String()
+	}
+	var firstErr error
+	for i, element := range elements {
+		series := DashboardSeries{
+			ID:         seriesID(element),
+			Field:      element.Field,
+			Categories: []string{},
+			Data:       []float64{},
+		}
+		if err := results[i].err; err != nil {
+			series.Error = err.Error()
+			dashboard.Failed++
+			firstErr = cmp.Or(firstErr, err)
+		} else {
+			series.Categories, series.Data = categoriesAndData(results[i].points)
+		}
+		// elements are grouped by device and source: only the last group can match
+		if len(dashboard.Devices) == 0 || dashboard.Devices[len(dashboard.Devices)-1].Name != element.Device {
+			dashboard.Devices = append(dashboard.Devices, DeviceDashboard{
+				Name:     element.Device,
+				Address:  element.DeviceAddress,
+				Services: []ServiceDashboard{},
+				Measures: []SourceDashboard{},
+			})
+		}
+		device := &dashboard.Devices[len(dashboard.Devices)-1]
+		sources := &device.Measures
+		if element.Service != "" {
+			if len(device.Services) == 0 || device.Services[len(device.Services)-1].UUID != element.Service {
+				device.Services = append(device.Services, ServiceDashboard{UUID: element.Service, Characteristics: []SourceDashboard{}})
+			}
+			sources = &device.Services[len(device.Services)-1].Characteristics
+		}
+		if len(*sources) == 0 || (*sources)[len(*sources)-1].Measurement != element.Measurement {
+			*sources = append(*sources, SourceDashboard{Name: element.Source, Measurement: element.Measurement, Series: []DashboardSeries{}})
+		}
+		source := &(*sources)[len(*sources)-1]
+		source.Series = append(source.Series, series)
+	}
+	if dashboard.Failed == len(elements) {
+		if errors.Is(firstErr, config.ErrTimeout) {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("%w: every dashboard query failed: %w", config.ErrUpstream, firstErr)
+	}
+	dashboard.Partial = dashboard.Failed > 0
+	return dashboard, nil
+}
+
+// dashboardSeries lists the series of the experiment devices, devices in name
+// order: the fields of the characteristics of the service with the given UUID
+// (of every service when empty) and of the Movesense measures. With
+// includeGateway the envelope fields are listed too.
+func (ds *DashboardService) dashboardSeries(experiment bson.M, serviceUuid string, includeGateway bool) []ElementToQuery {
+	nonAlpha := regexp.MustCompile(`[^a-z0-9]`)
+	target := ds.AppConfig.TargetFor(experiment)
 	elementToQuery := []ElementToQuery{}
-	devices := experiment["devices"].(primitive.M)
-	for _, device := range devices {
-		deviceMap := device.(primitive.M)
-		name := strings.ToLower(deviceMap["name"].(string))
-		deviceShort := strings.ToLower(getString(deviceMap, "shortName"))
-		for _, service := range deviceMap["services"].([]primitive.M) {
-			if service["uuid"].(string) != characteristicId {
+	devices, _ := experiment["devices"].(primitive.M)
+	for _, deviceName := range slices.Sorted(maps.Keys(devices)) {
+		deviceMap, ok := devices[deviceName].(primitive.M)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(rulegen.GetString(deviceMap, "name"))
+		deviceShort := strings.ToLower(rulegen.GetString(deviceMap, "shortName"))
+		services, _ := deviceMap["services"].([]primitive.M)
+		for _, service := range services {
+			if serviceUuid != "" && rulegen.GetString(service, "uuid") != serviceUuid {
 				continue
 			}
-			for _, characteristic := range service["characteristics"].([]primitive.M) {
+			characteristics, _ := service["characteristics"].([]primitive.M)
+			for _, characteristic := range characteristics {
 				characteristicMap := characteristic
-				characteristicName := strings.ToLower(strings.Replace(characteristicMap["name"].(string), " ", "", -1))
+				characteristicName := strings.ToLower(strings.Replace(rulegen.GetString(characteristicMap, "name"), " ", "", -1))
 				clean := nonAlpha.ReplaceAllString(characteristicName, "")
 				if deviceShort == "" || clean == "" {
 					continue
 				}
 				measureName := deviceShort + "_" + clean
 				finalName := name + "_" + characteristicName
-				structParser := characteristicMap["structParser"].(primitive.M)
-				for _, field := range structParser["fields"].(primitive.A) {
-					fieldMap := field.(primitive.M)
+				structParser, ok := characteristicMap["structParser"].(primitive.M)
+				if !ok {
+					continue
+				}
+				fieldNames := []string{}
+				for _, field := range rulegen.StructFields(structParser) {
+					fieldNames = append(fieldNames, field.Name)
+				}
+				if includeGateway {
+					fieldNames = append(fieldNames, gatewayFields(deviceMap, rulegen.StructParser)...)
+				}
+				for _, field := range fieldNames {
 					element := ElementToQuery{
-						Bucket:        "iotproject_bucket",
+						Org:           target.Org,
+						Bucket:        target.Bucket,
 						SensorName:    finalName,
 						Measurement:   measureName,
-						DeviceAddress: deviceMap["address"].(string),
-						Field:         fieldMap["name"].(string),
+						DeviceAddress: rulegen.GetString(deviceMap, "address"),
+						Field:         field,
+						Device:        deviceName,
+						Service:       rulegen.GetString(service, "uuid"),
+						Source:        rulegen.GetString(characteristicMap, "name"),
 					}
 					elementToQuery = append(elementToQuery, element)
 				}
 			}
 		}
 
-		if wbs, ok := deviceMap["movesense_whiteboard"]; ok {
-			if measures, ok := wbs.(primitive.M)["measures"]; ok {
-				for _, measure := range measures.([]primitive.M) {
-					mname := strings.ToLower(getString(measure, "name"))
+		if wbs, ok := deviceMap["movesense_whiteboard"].(primitive.M); ok {
+			if measures, ok := wbs["measures"].([]primitive.M); ok {
+				for _, measure := range measures {
+					mname := strings.ToLower(rulegen.GetString(measure, "name"))
 					clean := nonAlpha.ReplaceAllString(mname, "")
 					if deviceShort == "" || clean == "" {
 						continue
 					}
 					measureName := deviceShort + "_" + clean
 					if jp, ok := measure["jsonPayloadParser"].(bson.M); ok {
-						fields := []bson.M{}
+						fieldNames := []string{}
 						if farr, ok := jp["fields"].(bson.A); ok {
 							for _, fi := range farr {
 								if fm, ok := fi.(bson.M); ok {
-									fields = append(fields, fm)
+									fieldNames = append(fieldNames, rulegen.GetString(fm, "name"))
 								}
 							}
 						}
-						element := ElementToQuery{
-							Bucket:        "iotproject_bucket",
-							SensorName:    mname,
-							Measurement:   strings.ToLower(strings.Replace(measureName, " ", "", -1)),
-							DeviceAddress: deviceMap["address"].(string),
-							Field:         "",
+						if includeGateway {
+							fieldNames = append(fieldNames, gatewayFields(deviceMap, rulegen.JSONPayloadParser)...)
+						}
+						for _, fname := range fieldNames {
+							element := ElementToQuery{
+								Org:           target.Org,
+								Bucket:        target.Bucket,
+								SensorName:    mname,
+								Measurement:   strings.ToLower(strings.Replace(measureName, " ", "", -1)),
+								DeviceAddress: rulegen.GetString(deviceMap, "address"),
+								Field:         fname,
+								Device:        deviceName,
+								Source:        rulegen.GetString(measure, "name"),
+							}
+							elementToQuery = append(elementToQuery, element)
 						}
-						elementToQuery = append(elementToQuery, element)
 					} else if ja, ok := measure["jsonArrayParser"].(bson.M); ok {
 						fields := []bson.M{}
 						if farr, ok := ja["fields"].(bson.A); ok {
@@ -103,51 +312,147 @@ func (ds *DashboardService) GetDashboardData(experimentId string, characteristic
 								}
 							}
 						}
+						fieldNames := []string{}
 						for _, f := range fields {
-							fname := getString(f, "name")
+							fieldNames = append(fieldNames, rulegen.GetString(f, "name"))
+						}
+						if includeGateway {
+							fieldNames = append(fieldNames, gatewayFields(deviceMap, rulegen.JSONArrayParser)...)
+						}
+						for _, fname := range fieldNames {
 							element := ElementToQuery{
-								Bucket:        "iotproject_bucket",
+								Org:           target.Org,
+								Bucket:        target.Bucket,
 								SensorName:    mname,
 								Measurement:   strings.ToLower(strings.Replace(measureName, " ", "", -1)),
-								DeviceAddress: deviceMap["address"].(string),
+								DeviceAddress: rulegen.GetString(deviceMap, "address"),
 								Field:         fname,
+								Device:        deviceName,
+								Source:        rulegen.GetString(measure, "name"),
 							}
 							elementToQuery = append(elementToQuery, element)
 						}
 					} else if smp, ok := measure["SingleMeasurementParser"].(bson.A); ok {
+						fieldNames := []string{}
 						for _, fi := range smp {
 							if fm, ok := fi.(bson.M); ok {
-								fname := getString(fm, "name")
-								element := ElementToQuery{
-									Bucket:        "iotproject_bucket",
-									SensorName:    mname,
-									Measurement:   strings.ToLower(strings.Replace(measureName, " ", "", -1)),
-									DeviceAddress: deviceMap["address"].(string),
-									Field:         fname,
-								}
-								elementToQuery = append(elementToQuery, element)
+								fieldNames = append(fieldNames, rulegen.GetString(fm, "name"))
+							}
+						}
+						if includeGateway {
+							fieldNames = append(fieldNames, gatewayFields(deviceMap, rulegen.SingleMeasurementParser)...)
+						}
+						for _, fname := range fieldNames {
+							element := ElementToQuery{
+								Org:           target.Org,
+								Bucket:        target.Bucket,
+								SensorName:    mname,
+								Measurement:   strings.ToLower(strings.Replace(measureName, " ", "", -1)),
+								DeviceAddress: rulegen.GetString(deviceMap, "address"),
+								Field:         fname,
+								Device:        deviceName,
+								Source:        rulegen.GetString(measure, "name"),
 							}
+							elementToQuery = append(elementToQuery, element)
 						}
 					}
 				}
 			}
 		}
 	}
-	result := []bson.M{}
-	for _, element := range elementToQuery {
-		categories, data, err := ds.AppConfig.Influx.ExecuteQuery(experimentId, element.Bucket, element.DeviceAddress, element.Measurement, element.Field)
+	return elementToQuery
+}
+
+// seriesResult is the outcome of the query of one series.
+type seriesResult struct {
+	points []config.Point
+	err    error
+}
+
+// categoriesAndData splits points into the times (RFC3339) and values returned by the dashboards.
+func categoriesAndData(points []config.Point) ([]string, []float64) {
+	categories := make([]string, 0, len(points))
+	data := make([]float64, 0, len(points))
+	for _, p := range points {
+		categories = append(categories, p.Time.Format(time.RFC3339))
+		data = append(data, p.Value)
+	}
+	return categories, data
+}
+
+// querySeries runs the queries of the series on the query workers; results
+// are in the order of the series. Series not queried before ctx is done fail
+// with its error.
+func (ds *DashboardService) querySeries(ctx context.Context, experimentId string, elements []ElementToQuery, window config.QueryWindow) []seriesResult {
+	results := make([]seriesResult, len(elements))
+	ds.runQueries(len(elements), func(i int) {
+		element := elements[i]
+		if err := ctx.Err(); err != nil {
+			results[i].err = queryError(err)
+			return
+		}
+		points, err := ds.AppConfig.Influx.QueryPoints(ctx, experimentId, element.Org, element.Bucket, element.DeviceAddress, element.Measurement, element.Field, window)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				err = queryError(ctx.Err())
+			}
+			results[i].err = err
+			return
 		}
-		result = append(
-			result,
-			bson.M{
-				"id":         element.SensorName + element.Measurement + element.Field,
-				"sensorName": element.SensorName + " - " + element.Measurement + " - " + element.Field,
-				"categories": categories,
-				"data":       data,
-			},
-		)
+		results[i].points = points
+	})
+	return results
+}
+
+// runQueries calls query for every index below n on at most the configured
+// number of workers, and returns once every call has returned.
+func (ds *DashboardService) runQueries(n int, query func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(ds.AppConfig.Settings.Dashboard.QueryWorkers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				query(i)
+			}
+		}()
 	}
-	return result, nil
+	for i := range n {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// queryError turns the error of a done request context into a sentinel error.
+func queryError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: dashboard query deadline exceeded", config.ErrTimeout)
+	}
+	return err
+}
+
+// gatewayFields lists the envelope fields written with the points of a device.
+func gatewayFields(device bson.M, parser string) []string {
+	names := []string{}
+	for _, f := range rulegen.EnvelopeFor(device, parser).Fields {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// defaultQueryWindow resolves the query parameters, defaulting to the running
+// window of the experiment (capped to the maximum query range) or, for
+// experiments never started, to the last few seconds.
+func defaultQueryWindow(experiment bson.M, params config.QueryParams) (config.QueryWindow, error) {
+	stop := time.Now().UTC()
+	start := stop.Add(-config.DefaultQueryRange)
+	if runStart, runStop, ok := RunningWindow(experiment); ok {
+		start, stop = runStart, runStop
+		if stop.Sub(start) > config.MaxQueryRange {
+			start = stop.Add(-config.MaxQueryRange)
+		}
+	}
+	return config.ParseQueryWindow(params, start, stop)
 }
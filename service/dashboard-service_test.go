@@ -0,0 +1,52 @@
+package service
+
+import (
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDashboardSeries(t *testing.T) {
+	experiment := testExperiment("665f1c2e8b3e4a0012345678", StatusRunning)
+	movesense := experiment["devices"].(bson.M)["sensor_1"].(bson.M)
+	movesense["movesense_whiteboard"] = bson.M{"measures": []bson.M{{
+		"name": "Meas/Acc",
+		rulegen.JSONPayloadParser: bson.M{"fields": bson.A{
+			bson.M{"name": "x", "path": "Body.ArrayAcc.0.x", "type": "float"},
+			bson.M{"name": "y", "path": "Body.ArrayAcc.0.y", "type": "float"},
+		}},
+	}}}
+	ds := &DashboardService{AppConfig: &config.AppConfiguration{InfluxTarget: config.InfluxTarget{Org: "org", Bucket: "bucket"}}}
+
+	tests := []struct {
+		name           string
+		includeGateway bool
+		want           []string
+	}{
+		{name: "measure fields", want: []string{"thermo_temperature.temperature", "ms_measacc.x", "ms_measacc.y"}},
+		{name: "with the gateway", includeGateway: true, want: []string{
+			"thermo_temperature.temperature", "thermo_temperature.gatewayBattery", "thermo_temperature.rssi",
+			"ms_measacc.x", "ms_measacc.y", "ms_measacc.gatewayBattery",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, element := range ds.dashboardSeries(experiment, "", tt.includeGateway) {
+				if element.Org != "org" || element.Bucket != "bucket" {
+					t.Errorf("series %s.%s read from %s/%s, want org/bucket", element.Measurement, element.Field, element.Org, element.Bucket)
+				}
+				if element.Device == "sensor_1" && (element.Source != "Meas/Acc" || element.DeviceAddress != "0C:8C:DC:00:00:01") {
+					t.Errorf("series %s.%s = %+v, want the Meas/Acc measure of the movesense", element.Measurement, element.Field, element)
+				}
+				got = append(got, element.Measurement+"."+element.Field)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"qiot-configuration-service/config"
+	"slices"
+	"sync"
+	"time"
+)
+
+// streamDelay keeps the polls of a live stream a little behind now, so points
+// still being written when a poll runs are read by the next one.
+const streamDelay = time.Second
+
+// DashboardStream follows the series of an experiment, returning at each poll
+// the points written since the previous one. It holds one of the stream slots
+// of the experiment until closed.
+type DashboardStream struct {
+	ds           *DashboardService
+	experimentId string
+	elements     []ElementToQuery
+	// since is, per series, the time from which points are still to be sent
+	since   []time.Time
+	release sync.Once
+}
+
+// StreamSeries describes a series of a live stream.
+type StreamSeries struct {
+	ID          string `json:"id"`
+	Device      string `json:"device"`
+	Service     string `json:"service,omitempty"`
+	Source      string `json:"source"`
+	Measurement string `json:"measurement"`
+	Field       string `json:"field"`
+}
+
+// StreamUpdate holds the new points of a series, or the error of its query.
+type StreamUpdate struct {
+	ID         string    `json:"id"`
+	Categories []string  `json:"categories,omitempty"`
+	Data       []float64 `json:"data,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// OpenStream starts a live stream of the series of the experiment (see
+// GetExperimentDashboard), or of the series with the given IDs. The first poll
+// returns the points since params.Start (default the last few seconds, at most
+// MaxRawQueryRange ago). It fails with ErrTooManyRequests when the experiment
+// already has the maximum number of streams open.
+func (ds *DashboardService) OpenStream(experimentId string, ids []string, params config.QueryParams, includeGateway bool) (*DashboardStream, error) {
+	now := time.Now().UTC()
+	window, err := config.ParseQueryWindow(config.QueryParams{Start: params.Start}, now.Add(-config.DefaultQueryRange), now)
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(window.Start) > config.MaxRawQueryRange {
+		return nil, fmt.Errorf("%w: a stream starts at most %s ago", config.ErrInvalidQuery, config.MaxRawQueryRange)
+	}
+	experiment, err := ds.ExperimentService.GetCompleteExperimentById(experimentId)
+	if err != nil {
+		return nil, err
+	}
+	elements := ds.dashboardSeries(experiment, "", includeGateway)
+	if len(ids) > 0 {
+		selected := []ElementToQuery{}
+		for _, element := range elements {
+			if slices.Contains(ids, seriesID(element)) {
+				selected = append(selected, element)
+			}
+		}
+		if len(selected) < len(ids) {
+			missing := []string{}
+			for _, id := range ids {
+				if !slices.ContainsFunc(selected, func(e ElementToQuery) bool { return seriesID(e) == id }) {
+					missing = append(missing, id)
+				}
+			}
+			return nil, fmt.Errorf("%w: unknown series %v in experiment %s", config.ErrValidation, missing, experimentId)
+		}
+		elements = selected
+	}
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("no series in experiment %s: %w", experimentId, config.ErrNotFound)
+	}
+
+	ds.streamsMu.Lock()
+	defer ds.streamsMu.Unlock()
+	if limit := ds.AppConfig.Settings.Dashboard.MaxStreams; ds.streams[experimentId] >= limit {
+		return nil, fmt.Errorf("%w: experiment %s already has %d live streams open", config.ErrTooManyRequests, experimentId, limit)
+	}
+	ds.streams[experimentId]++
+	since := make([]time.Time, len(elements))
+	for i := range since {
+		since[i] = window.Start
+	}
+	return &DashboardStream{ds: ds, experimentId: experimentId, elements: elements, since: since}, nil
+}
+
+// Series returns the series followed by the stream.
+func (s *DashboardStream) Series() []StreamSeries {
+	series := []StreamSeries{}
+	for _, e := range s.elements {
+		series = append(series, StreamSeries{
+			ID:          seriesID(e),
+			Device:      e.Device,
+			Service:     e.Service,
+			Source:      e.Source,
+			Measurement: e.Measurement,
+			Field:       e.Field,
+		})
+	}
+	return series
+}
+
+// Poll queries the points written since the previous poll, concurrently and
+// under the dashboard query deadline. Only series with new points or a failed
+// query are returned; a failed series is queried again from the same time at
+// the next poll. Polls must not run concurrently.
+func (s *DashboardStream) Poll(ctx context.Context) []StreamUpdate {
+	stop := time.Now().UTC().Add(-streamDelay)
+	// a series failing for long is resumed at most MaxRawQueryRange back
+	oldest := stop.Add(-config.MaxRawQueryRange)
+	for i := range s.since {
+		if s.since[i].Before(oldest) {
+			s.since[i] = oldest
+		}
+	}
+	start := slices.MinFunc(s.since, time.Time.Compare)
+	if !start.Before(stop) {
+		return []StreamUpdate{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.ds.AppConfig.Settings.Dashboard.Timeout())
+	defer cancel()
+	results := s.ds.querySeries(ctx, s.experimentId, s.elements, config.QueryWindow{Start: start, Stop: stop})
+	updates := []StreamUpdate{}
+	for i, result := range results {
+		id := seriesID(s.elements[i])
+		if result.err != nil {
+			updates = append(updates, StreamUpdate{ID: id, Error: result.err.Error()})
+			continue
+		}
+		// the query starts at the earliest series: drop what this one already sent
+		points := slices.DeleteFunc(result.points, func(p config.Point) bool { return p.Time.Before(s.since[i]) })
+		s.since[i] = stop
+		if len(points) == 0 {
+			continue
+		}
+		categories, data := categoriesAndData(points)
+		updates = append(updates, StreamUpdate{ID: id, Categories: categories, Data: data})
+	}
+	return updates
+}
+
+// Close releases the stream slot; it can be called more than once.
+func (s *DashboardStream) Close() {
+	s.release.Do(func() {
+		s.ds.streamsMu.Lock()
+		defer s.ds.streamsMu.Unlock()
+		s.ds.streams[s.experimentId]--
+		if s.ds.streams[s.experimentId] <= 0 {
+			delete(s.ds.streams, s.experimentId)
+		}
+	})
+}
+
+// seriesID is the id of a series in the dashboard responses.
+func seriesID(e ElementToQuery) string {
+	return e.SensorName + e.Measurement + e.Field
+}
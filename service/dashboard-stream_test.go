@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/topic"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// storedExperiment returns the mock responses of an experiment with a BLE
+// thermometer, as read by GetCompleteExperimentById.
+func storedExperiment(oid primitive.ObjectID) []bson.D {
+	sensorId := primitive.NewObjectID()
+	return []bson.D{
+		mtest.CreateCursorResponse(0, "db.experiments", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: oid},
+			{Key: "status", Value: StatusRunning},
+			{Key: "devices", Value: bson.A{bson.D{
+				{Key: "sensorId", Value: sensorId.Hex()},
+				{Key: "macAddress", Value: "AA:BB:CC:DD:EE:01"},
+				{Key: "enabledServices", Value: bson.A{"180a"}},
+			}}},
+		}),
+		mtest.CreateCursorResponse(0, "db.configurations", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: sensorId},
+			{Key: "name", Value: "thermometer"},
+			{Key: "shortName", Value: "thermo"},
+			{Key: "services", Value: bson.A{bson.D{
+				{Key: "uuid", Value: "180a"},
+				{Key: "characteristics", Value: bson.A{bson.D{
+					{Key: "name", Value: "Temperature"},
+					{Key: "structParser", Value: bson.D{{Key: "fields", Value: bson.A{bson.D{{Key: "name", Value: "temperature"}, {Key: "type", Value: "int16"}}}}}},
+				}}},
+			}}},
+		}),
+	}
+}
+
+func TestOpenStreamSlots(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("slots", func(mt *mtest.T) {
+		settings := &config.Settings{Dashboard: config.DashboardSettings{MaxStreams: 2}}
+		ds := NewDashboardService(&config.AppConfiguration{Settings: settings, Mongo: &config.MongoClient{Database: mt.DB}, Topics: topic.Legacy()})
+		experiment, other := primitive.NewObjectID(), primitive.NewObjectID()
+		open := func(oid primitive.ObjectID) (*DashboardStream, error) {
+			mt.AddMockResponses(storedExperiment(oid)...)
+			return ds.OpenStream(oid.Hex(), nil, config.QueryParams{}, false)
+		}
+
+		first, err := open(experiment)
+		if err != nil {
+			mt.Fatalf("OpenStream: %v", err)
+		}
+		if series := first.Series(); len(series) != 1 || series[0].Field != "temperature" || series[0].ID != seriesID(first.elements[0]) {
+			mt.Errorf("series = %+v, want the temperature", series)
+		}
+		second, err := open(experiment)
+		if err != nil {
+			mt.Fatalf("OpenStream: %v", err)
+		}
+		if _, err := open(experiment); !errors.Is(err, config.ErrTooManyRequests) {
+			mt.Fatalf("third OpenStream = %v, want ErrTooManyRequests", err)
+		}
+		// the slots are counted per experiment
+		third, err := open(other)
+		if err != nil {
+			mt.Fatalf("OpenStream of another experiment: %v", err)
+		}
+
+		// closing twice releases a single slot
+		first.Close()
+		first.Close()
+		if got := ds.streams[experiment.Hex()]; got != 1 {
+			mt.Errorf("%d streams open, want 1", got)
+		}
+		again, err := open(experiment)
+		if err != nil {
+			mt.Fatalf("OpenStream after Close: %v", err)
+		}
+		if _, err := open(experiment); !errors.Is(err, config.ErrTooManyRequests) {
+			mt.Errorf("OpenStream = %v, want ErrTooManyRequests", err)
+		}
+
+		for _, s := range []*DashboardStream{second, third, again} {
+			s.Close()
+		}
+		if len(ds.streams) != 0 {
+			mt.Errorf("streams = %v, want none left", ds.streams)
+		}
+	})
+}
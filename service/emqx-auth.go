@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/goccy/go-json"
+)
+
+// Resource kinds of the MQTT credentials provisioned in EMQX.
+const (
+	KindUser = "user"
+	KindACL  = "acl"
+)
+
+// builtInAuthenticator is the id of the EMQX built-in database password authenticator.
+const builtInAuthenticator = "password_based:built_in_database"
+
+// ACLRule is an entry of the EMQX built-in database authorization rules of a user.
+type ACLRule struct {
+	Topic      string `json:"topic"`
+	Permission string `json:"permission"`
+	Action     string `json:"action"`
+}
+
+// CreateEMQXUser creates a user of the built-in database authenticator, or
+// resets its password when it already exists.
+func (c *Client) CreateEMQXUser(username, password string) (SyncItem, error) {
+	item := SyncItem{Kind: KindUser, Name: username, Operation: OperationCreate}
+	url := c.BaseURL + "/api/v5/authentication/" + neturl.PathEscape(builtInAuthenticator) + "/users"
+	bs, _ := json.Marshal(map[string]interface{}{"user_id": username, "password": password, "is_superuser": false})
+	c.Logger.Printf("--- Creating MQTT user: %s ---", username)
+	status, body, err := c.send(http.MethodPost, url, bs)
+	if err != nil {
+		return item, err
+	}
+	if status == http.StatusConflict {
+		item.Operation = OperationUpdate
+		bs, _ = json.Marshal(map[string]interface{}{"password": password, "is_superuser": false})
+		status, body, err = c.send(http.MethodPut, url+"/"+neturl.PathEscape(username), bs)
+		if err != nil {
+			return item, err
+		}
+	}
+	item.Status = status
+	if status >= 200 && status < 300 {
+		return item, nil
+	}
+	return item, fmt.Errorf("status %d: %s", status, body)
+}
+
+// DeleteEMQXUser deletes a built-in database user. A missing user counts as deleted.
+func (c *Client) DeleteEMQXUser(username string) (SyncItem, error) {
+	item := SyncItem{Kind: KindUser, Name: username, Operation: OperationDelete}
+	return c.deleteResource(item, c.BaseURL+"/api/v5/authentication/"+neturl.PathEscape(builtInAuthenticator)+"/users/"+neturl.PathEscape(username))
+}
+
+// SetEMQXUserACL sets the built-in database authorization rules of a user,
+// replacing the existing ones.
+func (c *Client) SetEMQXUserACL(username string, rules []ACLRule) (SyncItem, error) {
+	item := SyncItem{Kind: KindACL, Name: username, Operation: OperationCreate}
+	url := c.BaseURL + "/api/v5/authorization/sources/built_in_database/rules/users"
+	entry := map[string]interface{}{"username": username, "rules": rules}
+	bs, _ := json.Marshal([]interface{}{entry})
+	c.Logger.Printf("--- Setting ACL of MQTT user: %s ---", username)
+	status, body, err := c.send(http.MethodPost, url, bs)
+	if err != nil {
+		return item, err
+	}
+	if status == http.StatusConflict || status == http.StatusBadRequest {
+		item.Operation = OperationUpdate
+		bs, _ = json.Marshal(entry)
+		status, body, err = c.send(http.MethodPut, url+"/"+neturl.PathEscape(username), bs)
+		if err != nil {
+			return item, err
+		}
+	}
+	item.Status = status
+	if status >= 200 && status < 300 {
+		return item, nil
+	}
+	return item, fmt.Errorf("status %d: %s", status, body)
+}
+
+// DeleteEMQXUserACL deletes the authorization rules of a user. Missing rules count as deleted.
+func (c *Client) DeleteEMQXUserACL(username string) (SyncItem, error) {
+	item := SyncItem{Kind: KindACL, Name: username, Operation: OperationDelete}
+	return c.deleteResource(item, c.BaseURL+"/api/v5/authorization/sources/built_in_database/rules/users/"+neturl.PathEscape(username))
+}
+
+// send performs a request with a JSON body and returns the status and response body.
+func (c *Client) send(method, url string, payload []byte) (int, string, error) {
+	resp, err := c.doRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		c.Logger.Printf("%s %s request error: %v", method, url, err)
+		return 0, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	c.Logger.Printf("Status Code: %d\nResponse: %s\n", resp.StatusCode, string(body))
+	return resp.StatusCode, string(body), nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/goccy/go-json"
+)
+
+// EMQXClient is the part of the EMQX management API used by the service (rules,
+// actions, connectors, metrics, built-in database users and ACLs). Client
+// implements it over HTTP; tests can point a Client to an emqxtest.Server.
+type EMQXClient interface {
+	GetEMQXListActions() ([]map[string]interface{}, error)
+	CreateEMQXAction(actionName, description, influxWriteSyntax, connector string, currentActions []map[string]interface{}) (SyncItem, error)
+	DeleteEMQXAction(actionType, actionName string) (SyncItem, error)
+	GetEMQXActionMetrics(actionType, actionName string) (map[string]interface{}, error)
+
+	GetEMQXListRules() ([]map[string]interface{}, error)
+	CreateEMQXRule(ruleID, ruleName, description, sql, actionName string, enable bool) (SyncItem, error)
+	DeleteEMQXRule(ruleID string) (SyncItem, error)
+	SetEMQXRuleEnabled(ruleID string, enable bool) (SyncItem, error)
+	GetEMQXRuleMetrics(ruleID string) (map[string]interface{}, error)
+
+	GetEMQXListConnectors() ([]map[string]interface{}, error)
+
+	CreateEMQXUser(username, password string) (SyncItem, error)
+	DeleteEMQXUser(username string) (SyncItem, error)
+	SetEMQXUserACL(username string, rules []ACLRule) (SyncItem, error)
+	DeleteEMQXUserACL(username string) (SyncItem, error)
+}
+
+var _ EMQXClient = (*Client)(nil)
+
+// GetEMQXListConnectors returns the raw parsed JSON array of connectors.
+func (c *Client) GetEMQXListConnectors() ([]map[string]interface{}, error) {
+	var connectors []map[string]interface{}
+	if err := c.getJSON(c.BaseURL+"/api/v5/connectors", &connectors); err != nil {
+		return nil, err
+	}
+	return connectors, nil
+}
+
+// GetEMQXRuleMetrics returns the metrics of a rule ("metrics" holds the cluster
+// totals such as matched, passed, failed; "node_metrics" the per-node values).
+func (c *Client) GetEMQXRuleMetrics(ruleID string) (map[string]interface{}, error) {
+	var metrics map[string]interface{}
+	if err := c.getJSON(c.BaseURL+"/api/v5/rules/"+neturl.PathEscape(ruleID)+"/metrics", &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// GetEMQXActionMetrics returns the metrics of an action (success, failed, dropped, queuing...).
+func (c *Client) GetEMQXActionMetrics(actionType, actionName string) (map[string]interface{}, error) {
+	var metrics map[string]interface{}
+	url := c.BaseURL + "/api/v5/actions/" + neturl.PathEscape(actionType+":"+actionName) + "/metrics"
+	if err := c.getJSON(url, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// getJSON performs a GET and decodes the response body into target.
+func (c *Client) getJSON(url string, target interface{}) error {
+	resp, err := c.doRequest(http.MethodGet, url, nil)
+	if err != nil {
+		c.Logger.Printf("GET %s request error: %v", url, err)
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, target)
+}
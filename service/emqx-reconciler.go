@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"maps"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Plan operations and resource kinds.
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+
+	KindAction = "action"
+	KindRule   = "rule"
+)
+
+// PlanItem is a single change needed to bring EMQX in line with an experiment.
+type PlanItem struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Operation string `json:"operation"`
+	Reason    string `json:"reason,omitempty"`
+
+	resource   *rulegen.Definition
+	actionType string
+}
+
+// EMQXPlan lists the changes needed for an experiment, grouped by operation.
+type EMQXPlan struct {
+	ExperimentID string     `json:"experimentId"`
+	Create       []PlanItem `json:"create"`
+	Update       []PlanItem `json:"update"`
+	Delete       []PlanItem `json:"delete"`
+	Unchanged    int        `json:"unchanged"`
+
+	enable    bool
+	connector string
+}
+
+// PlanEMQX compares the resources wanted for a complete experiment, written
+// through connector, with the rules and actions of that experiment currently
+// configured in EMQX.
+func PlanEMQX(c EMQXClient, experiment bson.M, connector string) (*EMQXPlan, error) {
+	experimentId := rulegen.GetString(experiment, "experimentId")
+	actions, err := c.GetEMQXListActions()
+	if err != nil {
+		return nil, fmt.Errorf("%w: listing EMQX actions: %v", config.ErrUpstream, err)
+	}
+	rules, err := c.GetEMQXListRules()
+	if err != nil {
+		return nil, fmt.Errorf("%w: listing EMQX rules: %v", config.ErrUpstream, err)
+	}
+
+	plan := &EMQXPlan{
+		ExperimentID: experimentId,
+		Create:       []PlanItem{},
+		Update:       []PlanItem{},
+		Delete:       []PlanItem{},
+		enable:       ExperimentStatus(experiment) == StatusRunning,
+		connector:    connector,
+	}
+	currentActions := map[string]map[string]interface{}{}
+	for _, a := range actions {
+		if name := rulegen.GetString(a, "name"); isExperimentResource(name, "action_", experimentId) {
+			currentActions[name] = a
+		}
+	}
+	currentRules := map[string]map[string]interface{}{}
+	for _, r := range rules {
+		if id := rulegen.GetString(r, "id"); isExperimentResource(id, "rule_id_", experimentId) {
+			currentRules[id] = r
+		}
+	}
+
+	wantedActions := map[string]bool{}
+	wantedRules := map[string]bool{}
+	for _, resource := range rulegen.Generate(experiment) {
+		wantedActions[resource.ActionName] = true
+		wantedRules[resource.RuleID] = true
+
+		if current, ok := currentActions[resource.ActionName]; !ok {
+			plan.add(PlanItem{Kind: KindAction, Name: resource.ActionName, Operation: OperationCreate, resource: &resource})
+		} else if reason := actionDiff(resource, current, connector); reason != "" {
+			plan.add(PlanItem{Kind: KindAction, Name: resource.ActionName, Operation: OperationUpdate, Reason: reason, resource: &resource})
+		} else {
+			plan.Unchanged++
+		}
+
+		if current, ok := currentRules[resource.RuleID]; !ok {
+			plan.add(PlanItem{Kind: KindRule, Name: resource.RuleID, Operation: OperationCreate, resource: &resource})
+		} else if reason := ruleDiff(resource, current, plan.enable); reason != "" {
+			plan.add(PlanItem{Kind: KindRule, Name: resource.RuleID, Operation: OperationUpdate, Reason: reason, resource: &resource})
+		} else {
+			plan.Unchanged++
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(currentRules)) {
+		if !wantedRules[id] {
+			plan.add(PlanItem{Kind: KindRule, Name: id, Operation: OperationDelete, Reason: "no longer in experiment"})
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(currentActions)) {
+		if !wantedActions[name] {
+			actionType := rulegen.GetString(currentActions[name], "type")
+			if actionType == "" {
+				actionType = "influxdb"
+			}
+			plan.add(PlanItem{Kind: KindAction, Name: name, Operation: OperationDelete, Reason: "no longer in experiment", actionType: actionType})
+		}
+	}
+	return plan, nil
+}
+
+// ApplyEMQX executes a plan: actions are created or updated before the rules
+// using them, and rules are deleted before their actions. Every item is
+// attempted and recorded in the report.
+func ApplyEMQX(c EMQXClient, plan *EMQXPlan) (*SyncReport, error) {
+	report := newSyncReport(plan.ExperimentID)
+	actions, err := c.GetEMQXListActions()
+	if err != nil {
+		report.fail(fmt.Errorf("listing EMQX actions: %w", err))
+		return report.finish(), fmt.Errorf("%w: %s", config.ErrUpstream, report.Error)
+	}
+	upserts := append(slices.Clone(plan.Create), plan.Update...)
+	for _, kind := range []string{KindAction, KindRule} {
+		for _, item := range upserts {
+			if item.Kind != kind {
+				continue
+			}
+			r := item.resource
+			if kind == KindAction {
+				report.add(c.CreateEMQXAction(r.ActionName, r.ActionDesc, r.WriteSyntax, plan.connector, actions))
+			} else {
+				report.add(c.CreateEMQXRule(r.RuleID, r.RuleName, r.RuleDesc, r.SQL, r.ActionName, plan.enable))
+			}
+		}
+	}
+	for _, kind := range []string{KindRule, KindAction} {
+		for _, item := range plan.Delete {
+			if item.Kind != kind {
+				continue
+			}
+			if kind == KindRule {
+				report.add(c.DeleteEMQXRule(item.Name))
+			} else {
+				report.add(c.DeleteEMQXAction(item.actionType, item.Name))
+			}
+		}
+	}
+	report.finish()
+	if !report.Success {
+		return report, fmt.Errorf("%w: EMQX apply for experiment %s failed", config.ErrUpstream, plan.ExperimentID)
+	}
+	return report, nil
+}
+
+func (p *EMQXPlan) add(item PlanItem) {
+	switch item.Operation {
+	case OperationCreate:
+		p.Create = append(p.Create, item)
+	case OperationUpdate:
+		p.Update = append(p.Update, item)
+	case OperationDelete:
+		p.Delete = append(p.Delete, item)
+	}
+}
+
+// actionDiff describes how the configured action differs from the wanted one ("" when equal).
+func actionDiff(resource rulegen.Definition, current map[string]interface{}, connector string) string {
+	changes := []string{}
+	if rulegen.GetString(current, "connector") != connector {
+		changes = append(changes, "connector")
+	}
+	if rulegen.GetString(current, "description") != resource.ActionDesc {
+		changes = append(changes, "description")
+	}
+	parameters, _ := current["parameters"].(map[string]interface{})
+	if rulegen.GetString(parameters, "write_syntax") != resource.WriteSyntax {
+		changes = append(changes, "write_syntax")
+	}
+	if enabled, ok := current["enable"].(bool); ok && !enabled {
+		changes = append(changes, "enable")
+	}
+	return describeChanges(changes)
+}
+
+// ruleDiff describes how the configured rule differs from the wanted one ("" when equal).
+func ruleDiff(resource rulegen.Definition, current map[string]interface{}, enable bool) string {
+	changes := []string{}
+	if rulegen.GetString(current, "sql") != resource.SQL {
+		changes = append(changes, "sql")
+	}
+	if rulegen.GetString(current, "name") != resource.RuleName {
+		changes = append(changes, "name")
+	}
+	if rulegen.GetString(current, "description") != resource.RuleDesc {
+		changes = append(changes, "description")
+	}
+	if enabled, ok := current["enable"].(bool); ok && enabled != enable {
+		changes = append(changes, "enable")
+	}
+	wantedAction := "influxdb:" + resource.ActionName
+	currentActions, _ := current["actions"].([]interface{})
+	if len(currentActions) != 1 || fmt.Sprint(currentActions[0]) != wantedAction {
+		changes = append(changes, "actions")
+	}
+	return describeChanges(changes)
+}
+
+func describeChanges(changes []string) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	return strings.Join(changes, ", ") + " changed"
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"time"
+)
+
+// SyncItem is the outcome of one EMQX call made while syncing an experiment.
+type SyncItem struct {
+	Kind      string `json:"kind" bson:"kind"`
+	Name      string `json:"name" bson:"name"`
+	Operation string `json:"operation" bson:"operation"`
+	Status    int    `json:"status" bson:"status"`
+	Error     string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// SyncReport collects every EMQX call of a sync. It is returned to the API
+// caller and stored on the experiment document as "emqxSync".
+type SyncReport struct {
+	ExperimentID string     `json:"experimentId" bson:"experimentId"`
+	StartedAt    time.Time  `json:"startedAt" bson:"startedAt"`
+	FinishedAt   time.Time  `json:"finishedAt" bson:"finishedAt"`
+	Success      bool       `json:"success" bson:"success"`
+	Error        string     `json:"error,omitempty" bson:"error,omitempty"`
+	Items        []SyncItem `json:"items" bson:"items"`
+}
+
+func newSyncReport(experimentId string) *SyncReport {
+	return &SyncReport{
+		ExperimentID: experimentId,
+		StartedAt:    time.Now().UTC(),
+		Success:      true,
+		Items:        []SyncItem{},
+	}
+}
+
+// add records the result of a call; err is the error returned with the item, if any.
+func (r *SyncReport) add(item SyncItem, err error) {
+	if err != nil {
+		item.Error = err.Error()
+		r.Success = false
+	}
+	r.Items = append(r.Items, item)
+}
+
+// fail records an error that stopped the sync before (or between) the calls.
+func (r *SyncReport) fail(err error) {
+	r.Error = err.Error()
+	r.Success = false
+}
+
+func (r *SyncReport) finish() *SyncReport {
+	r.FinishedAt = time.Now().UTC()
+	return r
+}
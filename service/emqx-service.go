@@ -2,26 +2,29 @@ package service
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
-	"regexp"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
 	"strings"
 
 	"github.com/goccy/go-json"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Example usage:
-//   client := NewClientFromEnv()
+//   client := NewClient(appConfig.Settings.EMQX)
 //   actions, _ := client.GetEMQXListActions()
-//   _ = client.CreateEMQXAction("action_name", "desc", "write_syntax", actions)
-//   _ = client.CreateEMQXRule("id1", "rule_name", "desc", `SELECT * FROM "topic"`, "action_name")
-//   _ = client.ProcessYAMLAndSync()
+//   _, _ = client.CreateEMQXAction("action_name", "desc", "write_syntax", "Influx1", actions)
+//   _, _ = client.CreateEMQXRule("id1", "rule_name", "desc", `SELECT * FROM "topic"`, "action_name", true)
+//   _, _ = ProcessYAMLAndSync(client, completeExperiment, "Influx1")
 
+// Client is the EMQXClient talking to the EMQX v5 management API over HTTP.
 type Client struct {
 	BaseURL  string
 	User     string
@@ -31,22 +34,16 @@ type Client struct {
 	Logger   *log.Logger
 }
 
-// NewClientFromEnv builds a client using environment variables (as in the Python script).
-func NewClientFromEnv() *Client {
-	host := os.Getenv("EMQX_HOST")
-	port := os.Getenv("EMQX_API_PORT")
-
-	emqxUserToken := os.Getenv("EMQX_USER_TOKEN")
-	emqxToken := os.Getenv("EMQX_TOKEN")
-
-	base := fmt.Sprintf("http://%s:%s", host, port)
+// NewClient builds a client for the EMQX management API described by settings.
+func NewClient(settings config.EMQXSettings) *Client {
+	base := fmt.Sprintf("http://%s:%s", settings.Host, settings.APIPort)
 
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
 	return &Client{
 		BaseURL:  base,
-		User:     emqxUserToken,
-		Password: emqxToken,
+		User:     settings.User,
+		Password: settings.Password,
 		Client:   &http.Client{},
 		Headers: map[string]string{
 			"Content-Type": "application/json",
@@ -92,11 +89,12 @@ func (c *Client) GetEMQXListActions() ([]map[string]interface{}, error) {
 	return arr, nil
 }
 
-// CreateEMQXAction creates or updates an influxdb action. Returns true on success.
-func (c *Client) CreateEMQXAction(actionName, description, influxWriteSyntax string, currentActions []map[string]interface{}) (bool, error) {
+// CreateEMQXAction creates or updates an influxdb action writing through connector.
+// The error is set for transport failures and non-2xx responses.
+func (c *Client) CreateEMQXAction(actionName, description, influxWriteSyntax, connector string, currentActions []map[string]interface{}) (SyncItem, error) {
 	url := c.BaseURL + "/api/v5/actions"
 	payload := map[string]interface{}{
-		"connector":   "Influx1",
+		"connector":   connector,
 		"description": description,
 		"enable":      true,
 		"name":        actionName,
@@ -119,9 +117,11 @@ func (c *Client) CreateEMQXAction(actionName, description, influxWriteSyntax str
 		}
 	}
 
+	item := SyncItem{Kind: KindAction, Name: actionName, Operation: OperationCreate}
 	var resp *http.Response
 	var err error
 	if found != nil {
+		item.Operation = OperationUpdate
 		// copy created_at/last_modified_at if present
 		if v, ok := found["created_at"]; ok {
 			payload["created_at"] = v
@@ -145,32 +145,38 @@ func (c *Client) CreateEMQXAction(actionName, description, influxWriteSyntax str
 	}
 	if err != nil {
 		c.Logger.Printf("CreateEMQXAction request error: %v", err)
-		return false, err
+		return item, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	body, _ := io.ReadAll(resp.Body)
 	c.Logger.Printf("Status Code: %d\nResponse: %s\n", resp.StatusCode, string(body))
-	return resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+	item.Status = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return item, nil
+	}
+	return item, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
 }
 
-// CreateEMQXRule creates a rule linking a topic to an action. Returns true on success.
-func (c *Client) CreateEMQXRule(ruleID, ruleName, description, sql, actionName string) (bool, error) {
+// CreateEMQXRule creates a rule linking a topic to an action, updating it when it
+// already exists. The error is set for transport failures and non-2xx responses.
+func (c *Client) CreateEMQXRule(ruleID, ruleName, description, sql, actionName string, enable bool) (SyncItem, error) {
 	url := c.BaseURL + "/api/v5/rules"
 	payload := map[string]interface{}{
 		"sql":         sql,
 		"actions":     []string{fmt.Sprintf("influxdb:%s", actionName)},
 		"description": description,
-		"enable":      true,
+		"enable":      enable,
 		"metadata":    map[string]interface{}{},
 		"id":          ruleID,
 		"name":        ruleName,
 	}
+	item := SyncItem{Kind: KindRule, Name: ruleID, Operation: OperationCreate}
 	bs, _ := json.Marshal(payload)
 	c.Logger.Printf("--- Creating Rule: %s ---", ruleName)
 	resp, err := c.doRequest(http.MethodPost, url, bytes.NewReader(bs))
 	if err != nil {
 		c.Logger.Printf("CreateEMQXRule request error: %v", err)
-		return false, err
+		return item, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	body, _ := io.ReadAll(resp.Body)
@@ -179,257 +185,207 @@ func (c *Client) CreateEMQXRule(ruleID, ruleName, description, sql, actionName s
 	// If the resource already exists, attempt to update it with PUT
 	if resp.StatusCode != http.StatusCreated {
 		c.Logger.Printf("Rule %s already exists, attempting to update (PUT)", ruleID)
-		putURL := url + "/" + ruleID
+		item.Operation = OperationUpdate
+		putURL := url + "/" + neturl.PathEscape(ruleID)
 		// try PUT to update the existing rule
 		respPut, errPut := c.doRequest(http.MethodPut, putURL, bytes.NewReader(bs))
 		if errPut != nil {
 			c.Logger.Printf("CreateEMQXRule PUT request error: %v", errPut)
-			return false, errPut
+			return item, errPut
 		}
 		defer func() { _ = respPut.Body.Close() }()
 		bodyPut, _ := io.ReadAll(respPut.Body)
 		c.Logger.Printf("PUT Status Code: %d\nPUT Response: %s\n", respPut.StatusCode, string(bodyPut))
+		item.Status = respPut.StatusCode
 		if respPut.StatusCode >= 200 && respPut.StatusCode < 300 {
-			return true, nil
+			return item, nil
 		}
-		return false, fmt.Errorf("PUT failed: status %d: %s", respPut.StatusCode, string(bodyPut))
+		return item, fmt.Errorf("PUT failed: status %d: %s", respPut.StatusCode, string(bodyPut))
 	}
 
+	item.Status = resp.StatusCode
+	return item, nil
+}
+
+// GetEMQXListRules returns the raw parsed JSON list of rules, following pagination.
+func (c *Client) GetEMQXListRules() ([]map[string]interface{}, error) {
+	rules := []map[string]interface{}{}
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v5/rules?page=%d&limit=1000", c.BaseURL, page)
+		resp, err := c.doRequest(http.MethodGet, url, nil)
+		if err != nil {
+			c.Logger.Printf("GetEMQXListRules request error: %v", err)
+			return nil, err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+		}
+
+		var list struct {
+			Data []map[string]interface{} `json:"data"`
+			Meta struct {
+				HasNext bool `json:"hasnext"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, err
+		}
+		rules = append(rules, list.Data...)
+		if !list.Meta.HasNext || len(list.Data) == 0 {
+			return rules, nil
+		}
+	}
+}
+
+// DeleteEMQXRule deletes a rule by id. A rule that does not exist counts as deleted.
+func (c *Client) DeleteEMQXRule(ruleID string) (SyncItem, error) {
+	item := SyncItem{Kind: KindRule, Name: ruleID, Operation: OperationDelete}
+	return c.deleteResource(item, c.BaseURL+"/api/v5/rules/"+neturl.PathEscape(ruleID))
+}
+
+// DeleteEMQXAction deletes an action of the given type (e.g. "influxdb"). An action
+// that does not exist counts as deleted.
+func (c *Client) DeleteEMQXAction(actionType, actionName string) (SyncItem, error) {
+	item := SyncItem{Kind: KindAction, Name: actionName, Operation: OperationDelete}
+	return c.deleteResource(item, c.BaseURL+"/api/v5/actions/"+neturl.PathEscape(actionType+":"+actionName))
+}
+
+// SetEMQXRuleEnabled enables or disables an existing rule.
+func (c *Client) SetEMQXRuleEnabled(ruleID string, enable bool) (SyncItem, error) {
+	item := SyncItem{Kind: KindRule, Name: ruleID, Operation: OperationUpdate}
+	url := c.BaseURL + "/api/v5/rules/" + neturl.PathEscape(ruleID)
+	bs, _ := json.Marshal(map[string]interface{}{"enable": enable})
+	c.Logger.Printf("--- Setting rule %s enable=%t ---", ruleID, enable)
+	resp, err := c.doRequest(http.MethodPut, url, bytes.NewReader(bs))
+	if err != nil {
+		c.Logger.Printf("SetEMQXRuleEnabled request error: %v", err)
+		return item, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	c.Logger.Printf("Status Code: %d\nResponse: %s\n", resp.StatusCode, string(body))
+	item.Status = resp.StatusCode
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return true, nil
+		return item, nil
 	}
-	return false, fmt.Errorf("POST failed: status %d: %s", resp.StatusCode, string(body))
+	return item, fmt.Errorf("PUT failed: status %d: %s", resp.StatusCode, string(body))
 }
 
-// ProcessYAMLAndSync reads the YAML pointed by env YAML_FILE_PATH and creates actions+rules.
-// It mirrors the Python control flow but uses dynamic maps to avoid a large struct model.
-func (c *Client) ProcessYAMLAndSync(experiment bson.M) error {
-	actionsList, _ := c.GetEMQXListActions()
+// SetExperimentRulesEnabled enables or disables every rule (rule_id_*) of the experiment.
+func SetExperimentRulesEnabled(c EMQXClient, experimentId string, enable bool) error {
+	rules, err := c.GetEMQXListRules()
+	if err != nil {
+		return fmt.Errorf("%w: listing EMQX rules: %v", config.ErrUpstream, err)
+	}
+	errs := []error{}
+	for _, rule := range rules {
+		id := rulegen.GetString(rule, "id")
+		if !isExperimentResource(id, "rule_id_", experimentId) {
+			continue
+		}
+		if _, err := c.SetEMQXRuleEnabled(id, enable); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", id, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", config.ErrUpstream, errors.Join(errs...))
+	}
+	return nil
+}
 
-	nonAlpha := regexp.MustCompile(`[^a-z0-9]`)
+// isExperimentResource reports whether an EMQX rule id or action name was created for the experiment.
+func isExperimentResource(name string, prefix string, experimentId string) bool {
+	return strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "_"+experimentId)
+}
 
-	// extract experimentId from the passed experiment (GetCompleteExperimentById sets this)
-	experimentId := getString(experiment, "experimentId")
+func (c *Client) deleteResource(item SyncItem, url string) (SyncItem, error) {
+	c.Logger.Printf("--- Deleting: %s ---", url)
+	resp, err := c.doRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		c.Logger.Printf("delete request error: %v", err)
+		return item, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	c.Logger.Printf("Status Code: %d\nResponse: %s\n", resp.StatusCode, string(body))
+	item.Status = resp.StatusCode
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusNotFound {
+		return item, nil
+	}
+	return item, fmt.Errorf("DELETE failed: status %d: %s", resp.StatusCode, string(body))
+}
 
-	// devices were previously passed directly; now pull them from the experiment
-	devices, _ := experiment["devices"].(bson.M)
+// DeleteExperimentResources removes every rule (rule_id_*) and action (action_*)
+// created by ProcessYAMLAndSync for the experiment. Rules go first, since EMQX
+// refuses to delete an action still referenced by a rule.
+func DeleteExperimentResources(c EMQXClient, experimentId string) error {
+	errs := []error{}
 
-	for deviceName, dv := range devices {
-		deviceMap, ok := dv.(bson.M)
-		if !ok {
+	rules, err := c.GetEMQXListRules()
+	if err != nil {
+		return fmt.Errorf("%w: listing EMQX rules: %v", config.ErrUpstream, err)
+	}
+	for _, rule := range rules {
+		id := rulegen.GetString(rule, "id")
+		if !isExperimentResource(id, "rule_id_", experimentId) {
 			continue
 		}
-		deviceShort := strings.ToLower(getString(deviceMap, "shortName"))
-		services, _ := deviceMap["services"].([]primitive.M)
-		for _, s := range services {
-			smap := s
-			charList, _ := smap["characteristics"].([]primitive.M)
-			for _, ch := range charList {
-				chm := ch
-				if sp, ok := chm["structParser"]; ok {
-					name := strings.ToLower(getString(chm, "name"))
-					clean := nonAlpha.ReplaceAllString(name, "")
-					mqttTopic := getString(chm, "mqttTopic")
-					if deviceShort == "" || clean == "" || mqttTopic == "" {
-						continue
-					}
-					measureName := deviceShort + "_" + clean
-
-					// build fields list
-					fields := []primitive.M{}
-					if farr, ok := sp.(primitive.M)["fields"].(primitive.A); ok {
-						for _, fi := range farr {
-							fimap := fi.(bson.M)
-							fields = append(fields, fimap)
-						}
-					}
-					// add fixed fields
-					fields = append(fields, primitive.M{"name": "gatewayBattery"})
-					fields = append(fields, primitive.M{"name": "rssi"})
-
-					influxParts := []string{}
-					for _, f := range fields {
-						n := getString(f, "name")
-						influxParts = append(influxParts, fmt.Sprintf("%s=${payload.%s}i", n, n))
-					}
-					// include experimentId as a fixed tag if available
-					tagPrefix := measureName
-					if experimentId != "" {
-						tagPrefix = fmt.Sprintf("%s,experimentId=%s", measureName, experimentId)
-					}
-					writeSyntax := fmt.Sprintf("%s,appTagName=${payload.APP_TAG_NAME},deviceAddress=${payload.deviceAddress},deviceName=${payload.deviceName},gatewayName=${payload.gatewayName} %s",
-						tagPrefix, strings.Join(influxParts, ","))
-					sql := fmt.Sprintf(`SELECT * FROM "%s"`, mqttTopic)
-
-					actionName := "action_" + measureName + "_" + experimentId
-					actionDesc := fmt.Sprintf("InfluxDB action for %s - %s", deviceName, getString(chm, "name"))
-					_, _ = c.CreateEMQXAction(actionName, actionDesc, writeSyntax, actionsList)
-
-					ruleName := "rule_" + measureName + "_" + experimentId
-					ruleID := "rule_id_" + measureName + "_" + experimentId
-					ruleDesc := fmt.Sprintf("Rule for %s - %s", deviceName, getString(chm, "name"))
-					_, _ = c.CreateEMQXRule(ruleID, ruleName, ruleDesc, sql, actionName)
-				}
-			}
+		if _, err := c.DeleteEMQXRule(id); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", id, err))
 		}
+	}
 
-		// movesense_whiteboard measures
-		if mw, ok := deviceMap["movesense_whiteboard"].(bson.M); ok {
-			if measures, ok := mw["measures"].([]bson.M); ok {
-				for _, m := range measures {
-					mm := m
-					mname := strings.ToLower(getString(mm, "name"))
-					clean := nonAlpha.ReplaceAllString(mname, "")
-					mqttTopic := getString(mm, "mqttTopic")
-					if deviceShort == "" || clean == "" || mqttTopic == "" {
-						continue
-					}
-					measureName := deviceShort + "_" + clean
-					actionName := "action_" + measureName + "_" + experimentId
-					ruleName := "rule_" + measureName + "_" + experimentId
-					ruleID := "rule_id_" + measureName + "_" + experimentId
-					ruleDesc := fmt.Sprintf("Rule for %s - %s", deviceName, getString(mm, "name"))
-					actionDesc := fmt.Sprintf("InfluxDB action for %s - %s", deviceName, getString(mm, "name"))
-
-					// jsonPayloadParser
-					if jp, ok := mm["jsonPayloadParser"].(bson.M); ok {
-						fields := []bson.M{}
-						if farr, ok := jp["fields"].(bson.A); ok {
-							for _, fi := range farr {
-								if fm, ok := fi.(bson.M); ok {
-									fields = append(fields, fm)
-								}
-							}
-						}
-						// add fixed field
-						fields = append(fields, bson.M{"name": "gatewayBattery", "type": "integer"})
-						useJq := false
-						if uj, ok := jp["use_jq"].(bool); ok {
-							useJq = uj
-						}
-
-						selectParts := []string{"payload.deviceName as deviceName", "payload.deviceAddress as deviceAddress", "payload.gatewayName as gatewayName"}
-						influxParts := []string{}
-						for _, f := range fields {
-							fname := getString(f, "name")
-							fpath := getString(f, "path")
-							ftype := getString(f, "type")
-							if useJq && fpath != "" {
-								selectParts = append(selectParts, fmt.Sprintf("first(jq('.%s', payload)) as %s", fpath, fname))
-							} else {
-								if fpath != "" {
-									selectParts = append(selectParts, fmt.Sprintf("payload.%s as %s", fpath, fname))
-								} else {
-									selectParts = append(selectParts, fmt.Sprintf("payload as %s", fname))
-								}
-							}
-							if ftype == "integer" {
-								influxParts = append(influxParts, fmt.Sprintf("%s=${%s}i", fname, fname))
-							} else {
-								influxParts = append(influxParts, fmt.Sprintf("%s=${%s}", fname, fname))
-							}
-						}
-						sql := fmt.Sprintf("SELECT %s FROM \"%s\"", strings.Join(selectParts, ", "), mqttTopic)
-						tagPrefix := measureName
-						if experimentId != "" {
-							tagPrefix = fmt.Sprintf("%s,experimentId=%s", measureName, experimentId)
-						}
-						writeSyntax := fmt.Sprintf("%s,deviceAddress=${deviceAddress},deviceName=${deviceName},gatewayName=${gatewayName} %s", tagPrefix, strings.Join(influxParts, ","))
-						_, _ = c.CreateEMQXAction(actionName, actionDesc, writeSyntax, actionsList)
-						_, _ = c.CreateEMQXRule(ruleID, ruleName, ruleDesc, sql, actionName)
-					} else if ja, ok := mm["jsonArrayParser"].(bson.M); ok {
-						// jsonArrayParser
-						arrayPath := getString(ja, "arrayPath")
-						fields := []bson.M{}
-						if farr, ok := ja["fields"].(bson.A); ok {
-							for _, fi := range farr {
-								if fm, ok := fi.(bson.M); ok {
-									fields = append(fields, fm)
-								}
-							}
-						}
-						arrayAlias := "sample_item"
-						doParts := []string{"payload.deviceName as deviceName", "payload.deviceAddress as deviceAddress", "payload.gatewayName as gatewayName"}
-						influxParts := []string{}
-						for _, f := range fields {
-							fname := getString(f, "name")
-							ftype := getString(f, "type")
-							fpath := getString(f, "path")
-							if fpath != "" {
-								doParts = append(doParts, fmt.Sprintf("%s.%s as %s", arrayAlias, fpath, fname))
-							} else {
-								doParts = append(doParts, fmt.Sprintf("%s as %s", arrayAlias, fname))
-							}
-							if ftype == "integer" {
-								influxParts = append(influxParts, fmt.Sprintf("%s=${%s}i", fname, fname))
-							} else {
-								influxParts = append(influxParts, fmt.Sprintf("%s=${%s}", fname, fname))
-							}
-						}
-						sql := fmt.Sprintf("FOREACH payload.%s as %s DO %s FROM \"%s\"", arrayPath, arrayAlias, strings.Join(doParts, ", "), mqttTopic)
-						tagPrefix := measureName
-						if experimentId != "" {
-							tagPrefix = fmt.Sprintf("%s,experimentId=%s", measureName, experimentId)
-						}
-						writeSyntax := fmt.Sprintf("%s,deviceAddress=${deviceAddress},deviceName=${deviceName},gatewayName=${gatewayName} %s", tagPrefix, strings.Join(influxParts, ","))
-						_, _ = c.CreateEMQXAction(actionName, actionDesc, writeSyntax, actionsList)
-						_, _ = c.CreateEMQXRule(ruleID, ruleName, ruleDesc, sql, actionName)
-					} else if smp, ok := mm["SingleMeasurementParser"].(bson.A); ok {
-						// SingleMeasurementParser - fields are list of maps
-						selectParts := []string{"payload.deviceName as deviceName", "payload.deviceAddress as deviceAddress", "payload.gatewayName as gatewayName"}
-						influxParts := []string{}
-						for _, fi := range smp {
-							if fm, ok := fi.(bson.M); ok {
-								fname := getString(fm, "name")
-								fpath := getString(fm, "path")
-								ftype := getString(fm, "type")
-								if fpath != "" {
-									selectParts = append(selectParts, fmt.Sprintf("payload.%s as %s", fpath, fname))
-								} else {
-									selectParts = append(selectParts, fmt.Sprintf("payload as %s", fname))
-								}
-								if ftype == "integer" {
-									influxParts = append(influxParts, fmt.Sprintf("%s=${%s}i", fname, fname))
-								} else {
-									influxParts = append(influxParts, fmt.Sprintf("%s=${%s}", fname, fname))
-								}
-							}
-						}
-						sql := fmt.Sprintf("SELECT %s FROM \"%s\"", strings.Join(selectParts, ", "), mqttTopic)
-						tagPrefix := measureName
-						if experimentId != "" {
-							tagPrefix = fmt.Sprintf("%s,experimentId=%s", measureName, experimentId)
-						}
-						writeSyntax := fmt.Sprintf("%s,deviceAddress=${deviceAddress},deviceName=${deviceName},gatewayName=${gatewayName} %s", tagPrefix, strings.Join(influxParts, ","))
-						_, _ = c.CreateEMQXAction(actionName, actionDesc, writeSyntax, actionsList)
-						_, _ = c.CreateEMQXRule(ruleID, ruleName, ruleDesc, sql, actionName)
-					}
-				}
-			}
+	actions, err := c.GetEMQXListActions()
+	if err != nil {
+		return fmt.Errorf("%w: listing EMQX actions: %v", config.ErrUpstream, err)
+	}
+	for _, action := range actions {
+		name := rulegen.GetString(action, "name")
+		if !isExperimentResource(name, "action_", experimentId) {
+			continue
+		}
+		actionType := rulegen.GetString(action, "type")
+		if actionType == "" {
+			actionType = "influxdb"
+		}
+		if _, err := c.DeleteEMQXAction(actionType, name); err != nil {
+			errs = append(errs, fmt.Errorf("action %s: %w", name, err))
 		}
 	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", config.ErrUpstream, errors.Join(errs...))
+	}
 	return nil
 }
 
-// helper to safely extract string fields from map
-func getString(m map[string]interface{}, key string) string {
-	if m == nil {
-		return ""
+// ProcessYAMLAndSync creates or updates the actions and rules of a complete experiment
+// (as returned by GetCompleteExperimentById), writing through connector. The report
+// lists every call; the error wraps config.ErrUpstream when any of them failed.
+func ProcessYAMLAndSync(c EMQXClient, experiment bson.M, connector string) (*SyncReport, error) {
+	report := newSyncReport(rulegen.GetString(experiment, "experimentId"))
+	actionsList, err := c.GetEMQXListActions()
+	if err != nil {
+		report.fail(fmt.Errorf("listing EMQX actions: %w", err))
+		return report.finish(), fmt.Errorf("%w: %s", config.ErrUpstream, report.Error)
 	}
-	if v, ok := m[key]; ok && v != nil {
-		switch t := v.(type) {
-		case string:
-			return t
-		case fmt.Stringer:
-			return t.String()
-		default:
-			// attempt JSON encode -> string
-			bs, err := json.Marshal(v)
-			if err == nil {
-				return string(bs)
-			}
+	// rules only receive data while the experiment is running
+	enable := ExperimentStatus(experiment) == StatusRunning
+
+	for _, r := range rulegen.Generate(experiment) {
+		item, err := c.CreateEMQXAction(r.ActionName, r.ActionDesc, r.WriteSyntax, connector, actionsList)
+		report.add(item, err)
+		if err != nil {
+			// the rule would point to a missing action
+			continue
 		}
+		report.add(c.CreateEMQXRule(r.RuleID, r.RuleName, r.RuleDesc, r.SQL, r.ActionName, enable))
+	}
+	report.finish()
+	if !report.Success {
+		return report, fmt.Errorf("%w: EMQX sync of experiment %s failed", config.ErrUpstream, report.ExperimentID)
 	}
-	return ""
+	return report, nil
 }
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/service/emqxtest"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	testExperimentId  = "665f1c2e8b3e4a0012345678"
+	otherExperimentId = "665f1c2e8b3e4a0087654321"
+)
+
+// newTestClient returns a client of a fake EMQX, closed with the test.
+func newTestClient(t *testing.T) (*Client, *emqxtest.Server) {
+	t.Helper()
+	fake := emqxtest.NewServer()
+	t.Cleanup(fake.Close)
+	client := NewClient(config.EMQXSettings{})
+	client.BaseURL = fake.URL
+	client.Logger = log.New(io.Discard, "", 0)
+	return client, fake
+}
+
+// testExperiment is a complete experiment with a BLE and a Movesense device.
+func testExperiment(experimentId string, status string) bson.M {
+	return bson.M{
+		"experimentId": experimentId,
+		"status":       status,
+		"devices": bson.M{
+			"sensor_0": bson.M{
+				"name":      "thermometer",
+				"shortName": "thermo",
+				"address":   "AA:BB:CC:DD:EE:01",
+				"services": []bson.M{{
+					"uuid": "180a",
+					"characteristics": []bson.M{{
+						"name":         "Temperature",
+						"mqttTopic":    "qiot/" + experimentId + "/thermo/aabbccddee01/temperature",
+						"structParser": bson.M{"fields": bson.A{bson.M{"name": "temperature", "type": "int16", "scale": 0.01}}},
+					}},
+				}},
+			},
+			"sensor_1": bson.M{
+				"name":      "movesense",
+				"shortName": "ms",
+				"address":   "0C:8C:DC:00:00:01",
+				"services":  []bson.M{},
+				"movesense_whiteboard": bson.M{"measures": []bson.M{{
+					"name":                    "Meas/HR",
+					"mqttTopic":               "qiot/" + experimentId + "/ms/0c8cdc000001/meashr",
+					rulegen.JSONPayloadParser: bson.M{"fields": bson.A{bson.M{"name": "average", "path": "Body.average", "type": "float"}}},
+				}}},
+			},
+		},
+	}
+}
+
+// assertSynced checks that the fake holds exactly the rules and actions of
+// the experiments, with rules enabled as given.
+func assertSynced(t *testing.T, fake *emqxtest.Server, connector string, enable map[string]bool, experiments ...bson.M) {
+	t.Helper()
+	wantRules, wantActions := []string{}, []string{}
+	rules, actions := fake.Rules(), fake.Actions()
+	for _, experiment := range experiments {
+		experimentId := rulegen.GetString(experiment, "experimentId")
+		for _, d := range rulegen.Generate(experiment) {
+			wantRules = append(wantRules, d.RuleID)
+			wantActions = append(wantActions, "influxdb:"+d.ActionName)
+			rule, action := rules[d.RuleID], actions["influxdb:"+d.ActionName]
+			if rule == nil || action == nil {
+				continue
+			}
+			if rule["sql"] != d.SQL || rule["enable"] != enable[experimentId] {
+				t.Errorf("rule %s = sql %v enable %v, want %s enable %t", d.RuleID, rule["sql"], rule["enable"], d.SQL, enable[experimentId])
+			}
+			if got := rule["actions"].([]interface{}); len(got) != 1 || got[0] != "influxdb:"+d.ActionName {
+				t.Errorf("rule %s actions = %v", d.RuleID, got)
+			}
+			parameters, _ := action["parameters"].(map[string]interface{})
+			if parameters["write_syntax"] != d.WriteSyntax || action["connector"] != connector {
+				t.Errorf("action %s = %v, want write syntax %s through %s", d.ActionName, action, d.WriteSyntax, connector)
+			}
+		}
+	}
+	slices.Sort(wantRules)
+	slices.Sort(wantActions)
+	if got := slices.Sorted(maps.Keys(rules)); !slices.Equal(got, wantRules) {
+		t.Errorf("rules = %v, want %v", got, wantRules)
+	}
+	if got := slices.Sorted(maps.Keys(actions)); !slices.Equal(got, wantActions) {
+		t.Errorf("actions = %v, want %v", got, wantActions)
+	}
+}
+
+func TestProcessYAMLAndSync(t *testing.T) {
+	client, fake := newTestClient(t)
+	running := testExperiment(testExperimentId, StatusRunning)
+	draft := testExperiment(otherExperimentId, StatusDraft)
+
+	report, err := ProcessYAMLAndSync(client, running, "Influx1")
+	if err != nil {
+		t.Fatalf("ProcessYAMLAndSync: %v", err)
+	}
+	if !report.Success || len(report.Items) != 4 {
+		t.Errorf("report = %+v, want 4 successful items", report)
+	}
+	for _, item := range report.Items {
+		if item.Operation != OperationCreate || item.Status != http.StatusCreated {
+			t.Errorf("item %+v, want created", item)
+		}
+	}
+	if _, err := ProcessYAMLAndSync(client, draft, "Influx1"); err != nil {
+		t.Fatalf("ProcessYAMLAndSync(draft): %v", err)
+	}
+	// rules only receive data while the experiment is running
+	enable := map[string]bool{testExperimentId: true, otherExperimentId: false}
+	assertSynced(t, fake, "Influx1", enable, running, draft)
+
+	// a second sync updates the same resources
+	report, err = ProcessYAMLAndSync(client, running, "Influx1")
+	if err != nil {
+		t.Fatalf("ProcessYAMLAndSync again: %v", err)
+	}
+	for _, item := range report.Items {
+		if item.Operation != OperationUpdate || item.Status != http.StatusOK {
+			t.Errorf("item %+v, want updated", item)
+		}
+	}
+	assertSynced(t, fake, "Influx1", enable, running, draft)
+}
+
+func TestProcessYAMLAndSyncFailures(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.Fail(http.MethodPost, "/api/v5/actions", http.StatusInternalServerError)
+	report, err := ProcessYAMLAndSync(client, testExperiment(testExperimentId, StatusRunning), "Influx1")
+	if !errors.Is(err, config.ErrUpstream) {
+		t.Fatalf("ProcessYAMLAndSync = %v, want ErrUpstream", err)
+	}
+	if report.Success || len(report.Items) != 2 {
+		t.Errorf("report = %+v, want the 2 failed actions only", report)
+	}
+	// a rule is not created without its action
+	if rules := fake.Rules(); len(rules) != 0 {
+		t.Errorf("rules = %v, want none", rules)
+	}
+
+	fake.Fail(http.MethodPost, "/api/v5/actions", 0)
+	fake.Fail(http.MethodGet, "/api/v5/actions", http.StatusServiceUnavailable)
+	report, err = ProcessYAMLAndSync(client, testExperiment(testExperimentId, StatusRunning), "Influx1")
+	if !errors.Is(err, config.ErrUpstream) || report.Error == "" {
+		t.Errorf("ProcessYAMLAndSync = %+v, %v, want a failed report", report, err)
+	}
+}
+
+func TestSetExperimentRulesEnabled(t *testing.T) {
+	client, fake := newTestClient(t)
+	experiment := testExperiment(testExperimentId, StatusRunning)
+	other := testExperiment(otherExperimentId, StatusRunning)
+	for _, e := range []bson.M{experiment, other} {
+		if _, err := ProcessYAMLAndSync(client, e, "Influx1"); err != nil {
+			t.Fatalf("ProcessYAMLAndSync: %v", err)
+		}
+	}
+
+	if err := SetExperimentRulesEnabled(client, testExperimentId, false); err != nil {
+		t.Fatalf("SetExperimentRulesEnabled(false): %v", err)
+	}
+	assertSynced(t, fake, "Influx1", map[string]bool{testExperimentId: false, otherExperimentId: true}, experiment, other)
+	if err := SetExperimentRulesEnabled(client, testExperimentId, true); err != nil {
+		t.Fatalf("SetExperimentRulesEnabled(true): %v", err)
+	}
+	assertSynced(t, fake, "Influx1", map[string]bool{testExperimentId: true, otherExperimentId: true}, experiment, other)
+
+	fake.Fail(http.MethodPut, "/api/v5/rules/rule_id_ms_meashr_"+testExperimentId, http.StatusInternalServerError)
+	if err := SetExperimentRulesEnabled(client, testExperimentId, false); !errors.Is(err, config.ErrUpstream) {
+		t.Errorf("SetExperimentRulesEnabled = %v, want ErrUpstream", err)
+	}
+	// the other rules are still toggled
+	if rule := fake.Rules()["rule_id_thermo_temperature_"+testExperimentId]; rule["enable"] != false {
+		t.Errorf("rule = %v, want disabled", rule)
+	}
+}
+
+func TestDeleteExperimentResources(t *testing.T) {
+	client, fake := newTestClient(t)
+	other := testExperiment(otherExperimentId, StatusRunning)
+	for _, e := range []bson.M{testExperiment(testExperimentId, StatusRunning), other} {
+		if _, err := ProcessYAMLAndSync(client, e, "Influx1"); err != nil {
+			t.Fatalf("ProcessYAMLAndSync: %v", err)
+		}
+	}
+
+	if err := DeleteExperimentResources(client, testExperimentId); err != nil {
+		t.Fatalf("DeleteExperimentResources: %v", err)
+	}
+	assertSynced(t, fake, "Influx1", map[string]bool{otherExperimentId: true}, other)
+	// deleting again finds nothing to delete
+	if err := DeleteExperimentResources(client, testExperimentId); err != nil {
+		t.Errorf("DeleteExperimentResources again: %v", err)
+	}
+
+	fake.Fail(http.MethodDelete, "/api/v5/rules/rule_id_ms_meashr_"+otherExperimentId, http.StatusInternalServerError)
+	if err := DeleteExperimentResources(client, otherExperimentId); !errors.Is(err, config.ErrUpstream) {
+		t.Fatalf("DeleteExperimentResources = %v, want ErrUpstream", err)
+	}
+	// the action of the rule left in place cannot be deleted either
+	if got := slices.Sorted(maps.Keys(fake.Actions())); !slices.Equal(got, []string{"influxdb:action_ms_meashr_" + otherExperimentId}) {
+		t.Errorf("actions = %v, want the one still used", got)
+	}
+}
+
+func TestPlanAndApplyEMQX(t *testing.T) {
+	client, fake := newTestClient(t)
+	experiment := testExperiment(testExperimentId, StatusRunning)
+
+	plan, err := PlanEMQX(client, experiment, "Influx1")
+	if err != nil {
+		t.Fatalf("PlanEMQX: %v", err)
+	}
+	if len(plan.Create) != 4 || len(plan.Update) != 0 || len(plan.Delete) != 0 || plan.Unchanged != 0 {
+		t.Errorf("plan = %+v, want 4 creations", plan)
+	}
+	if report, err := ApplyEMQX(client, plan); err != nil || !report.Success {
+		t.Fatalf("ApplyEMQX = %+v, %v", report, err)
+	}
+	assertSynced(t, fake, "Influx1", map[string]bool{testExperimentId: true}, experiment)
+
+	plan, err = PlanEMQX(client, experiment, "Influx1")
+	if err != nil {
+		t.Fatalf("PlanEMQX: %v", err)
+	}
+	if len(plan.Create)+len(plan.Update)+len(plan.Delete) != 0 || plan.Unchanged != 4 {
+		t.Errorf("plan = %+v, want everything unchanged", plan)
+	}
+
+	// pause, drop the Movesense device and write through another connector
+	changed := testExperiment(testExperimentId, StatusPaused)
+	delete(changed["devices"].(bson.M), "sensor_1")
+	plan, err = PlanEMQX(client, changed, "Influx2")
+	if err != nil {
+		t.Fatalf("PlanEMQX: %v", err)
+	}
+	operations := map[string]string{}
+	for _, items := range [][]PlanItem{plan.Create, plan.Update, plan.Delete} {
+		for _, item := range items {
+			operations[item.Kind+" "+item.Name] = item.Operation
+			if item.Operation != OperationCreate && item.Reason == "" {
+				t.Errorf("item %+v has no reason", item)
+			}
+		}
+	}
+	want := map[string]string{
+		"action action_thermo_temperature_" + testExperimentId: OperationUpdate,
+		"rule rule_id_thermo_temperature_" + testExperimentId:  OperationUpdate,
+		"action action_ms_meashr_" + testExperimentId:          OperationDelete,
+		"rule rule_id_ms_meashr_" + testExperimentId:           OperationDelete,
+	}
+	if !maps.Equal(operations, want) {
+		t.Errorf("plan operations = %v, want %v", operations, want)
+	}
+	if report, err := ApplyEMQX(client, plan); err != nil || !report.Success {
+		t.Fatalf("ApplyEMQX = %+v, %v", report, err)
+	}
+	assertSynced(t, fake, "Influx2", map[string]bool{testExperimentId: false}, changed)
+}
+
+func TestEMQXCredentials(t *testing.T) {
+	client, fake := newTestClient(t)
+	username := "gw1_" + testExperimentId
+	rules := []ACLRule{
+		{Topic: "qiot/" + testExperimentId + "/#", Permission: "allow", Action: "publish"},
+		{Topic: "#", Permission: "deny", Action: "all"},
+	}
+
+	item, err := client.CreateEMQXUser(username, "first")
+	if err != nil || item.Operation != OperationCreate {
+		t.Fatalf("CreateEMQXUser = %+v, %v", item, err)
+	}
+	if item, err = client.SetEMQXUserACL(username, rules); err != nil || item.Operation != OperationCreate {
+		t.Fatalf("SetEMQXUserACL = %+v, %v", item, err)
+	}
+	// provisioning again resets the password and replaces the rules
+	if item, err = client.CreateEMQXUser(username, "second"); err != nil || item.Operation != OperationUpdate {
+		t.Fatalf("CreateEMQXUser again = %+v, %v", item, err)
+	}
+	if item, err = client.SetEMQXUserACL(username, rules[1:]); err != nil || item.Operation != OperationUpdate {
+		t.Fatalf("SetEMQXUserACL again = %+v, %v", item, err)
+	}
+	user := fake.Users()[username]
+	if user["password"] != "second" || user["is_superuser"] != false {
+		t.Errorf("user = %v, want password second", user)
+	}
+	acl := fake.ACLs()[username]
+	if len(acl) != 1 || acl[0].(map[string]interface{})["topic"] != "#" {
+		t.Errorf("ACL = %v, want the deny rule only", acl)
+	}
+
+	for i := 0; i < 2; i++ {
+		// missing users and rules count as deleted
+		if _, err := client.DeleteEMQXUserACL(username); err != nil {
+			t.Errorf("DeleteEMQXUserACL: %v", err)
+		}
+		if _, err := client.DeleteEMQXUser(username); err != nil {
+			t.Errorf("DeleteEMQXUser: %v", err)
+		}
+	}
+	if len(fake.Users()) != 0 || len(fake.ACLs()) != 0 {
+		t.Errorf("users = %v, ACLs = %v, want none", fake.Users(), fake.ACLs())
+	}
+}
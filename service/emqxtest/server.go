@@ -0,0 +1,432 @@
+// Package emqxtest provides an in-memory fake of the EMQX v5 management API
+// (actions, rules, connectors and their metrics, built-in database users and
+// their ACLs), to exercise the service
+// without a broker:
+//
+//	fake := emqxtest.NewServer()
+//	defer fake.Close()
+//	client := service.NewClient(config.EMQXSettings{})
+//	client.BaseURL = fake.URL
+//	es.EMQX = client
+package emqxtest
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+// Server is a fake EMQX management API. Its state is kept in memory and can be
+// inspected with Actions, Rules, Users and ACLs.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	actions    map[string]map[string]interface{}
+	rules      map[string]map[string]interface{}
+	connectors []map[string]interface{}
+	metrics    map[string]map[string]interface{}
+	users      map[string]map[string]interface{}
+	acls       map[string][]interface{}
+	failures   map[string]int
+}
+
+// NewServer starts a fake EMQX with one influxdb connector named Influx1.
+func NewServer() *Server {
+	s := &Server{
+		actions:    map[string]map[string]interface{}{},
+		rules:      map[string]map[string]interface{}{},
+		connectors: []map[string]interface{}{{"type": "influxdb", "name": "Influx1", "enable": true, "status": "connected"}},
+		metrics:    map[string]map[string]interface{}{},
+		users:      map[string]map[string]interface{}{},
+		acls:       map[string][]interface{}{},
+		failures:   map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v5/actions", s.listActions)
+	mux.HandleFunc("POST /api/v5/actions", s.createAction)
+	mux.HandleFunc("PUT /api/v5/actions/{id}", s.updateAction)
+	mux.HandleFunc("DELETE /api/v5/actions/{id}", s.deleteAction)
+	mux.HandleFunc("GET /api/v5/actions/{id}/metrics", s.getMetrics)
+	mux.HandleFunc("GET /api/v5/rules", s.listRules)
+	mux.HandleFunc("POST /api/v5/rules", s.createRule)
+	mux.HandleFunc("PUT /api/v5/rules/{id}", s.updateRule)
+	mux.HandleFunc("DELETE /api/v5/rules/{id}", s.deleteRule)
+	mux.HandleFunc("GET /api/v5/rules/{id}/metrics", s.getMetrics)
+	mux.HandleFunc("GET /api/v5/connectors", s.listConnectors)
+	mux.HandleFunc("POST /api/v5/authentication/{authenticator}/users", s.createUser)
+	mux.HandleFunc("PUT /api/v5/authentication/{authenticator}/users/{user}", s.updateUser)
+	mux.HandleFunc("DELETE /api/v5/authentication/{authenticator}/users/{user}", s.deleteUser)
+	mux.HandleFunc("POST /api/v5/authorization/sources/built_in_database/rules/users", s.createACLs)
+	mux.HandleFunc("PUT /api/v5/authorization/sources/built_in_database/rules/users/{user}", s.updateACL)
+	mux.HandleFunc("DELETE /api/v5/authorization/sources/built_in_database/rules/users/{user}", s.deleteACL)
+	s.Server = httptest.NewServer(s.failing(mux))
+	return s
+}
+
+// Actions returns a copy of the configured actions, keyed by "type:name".
+func (s *Server) Actions() map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.actions)
+}
+
+// Rules returns a copy of the configured rules, keyed by id.
+func (s *Server) Rules() map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.rules)
+}
+
+// Users returns a copy of the built-in database users, keyed by user id.
+func (s *Server) Users() map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.users)
+}
+
+// ACLs returns a copy of the built-in database authorization rules, keyed by username.
+func (s *Server) ACLs() map[string][]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.acls)
+}
+
+// SetConnectors replaces the connectors returned by GET /api/v5/connectors.
+func (s *Server) SetConnectors(connectors []map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectors = connectors
+}
+
+// SetMetrics sets the "metrics" object returned for a rule id or an action "type:name".
+func (s *Server) SetMetrics(id string, metrics map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics[id] = metrics
+}
+
+// Fail makes every request with the given method and path (e.g. "POST",
+// "/api/v5/rules") answer with status; a status of 0 removes the failure.
+func (s *Server) Fail(method string, path string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status == 0 {
+		delete(s.failures, method+" "+path)
+		return
+	}
+	s.failures[method+" "+path] = status
+}
+
+func (s *Server) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		status, ok := s.failures[r.Method+" "+r.URL.Path]
+		s.mu.Unlock()
+		if ok {
+			writeError(w, status, "INJECTED_FAILURE", "failure injected by emqxtest")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listActions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actions := []map[string]interface{}{}
+	for _, id := range slices.Sorted(maps.Keys(s.actions)) {
+		actions = append(actions, s.actions[id])
+	}
+	writeJSON(w, http.StatusOK, actions)
+}
+
+func (s *Server) createAction(w http.ResponseWriter, r *http.Request) {
+	action, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	actionType, _ := action["type"].(string)
+	name, _ := action["name"].(string)
+	if actionType == "" || name == "" {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", "type and name are required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := actionType + ":" + name
+	if _, exists := s.actions[id]; exists {
+		writeError(w, http.StatusBadRequest, "ALREADY_EXISTS", "action already exists")
+		return
+	}
+	s.actions[id] = action
+	writeJSON(w, http.StatusCreated, action)
+}
+
+func (s *Server) updateAction(w http.ResponseWriter, r *http.Request) {
+	update, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	if _, exists := s.actions[id]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "action not found")
+		return
+	}
+	actionType, name, _ := strings.Cut(id, ":")
+	update["type"] = actionType
+	update["name"] = name
+	s.actions[id] = update
+	writeJSON(w, http.StatusOK, update)
+}
+
+func (s *Server) deleteAction(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	if _, exists := s.actions[id]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "action not found")
+		return
+	}
+	// like EMQX, refuse to delete an action still used by a rule
+	for _, rule := range s.rules {
+		if actions, ok := rule["actions"].([]interface{}); ok && slices.Contains(actions, interface{}(id)) {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", "action is used by rule "+rule["id"].(string))
+			return
+		}
+	}
+	delete(s.actions, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	page, limit := 1, 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && v > 0 {
+		page = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := slices.Sorted(maps.Keys(s.rules))
+	from := min((page-1)*limit, len(ids))
+	to := min(from+limit, len(ids))
+	data := []map[string]interface{}{}
+	for _, id := range ids[from:to] {
+		data = append(data, s.rules[id])
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": data,
+		"meta": map[string]interface{}{"page": page, "limit": limit, "count": len(ids), "hasnext": to < len(ids)},
+	})
+}
+
+func (s *Server) createRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	id, _ := rule["id"].(string)
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", "id is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.rules[id]; exists {
+		writeError(w, http.StatusBadRequest, "ALREADY_EXISTS", "rule already exists")
+		return
+	}
+	if _, ok := rule["enable"]; !ok {
+		rule["enable"] = true
+	}
+	s.rules[id] = rule
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (s *Server) updateRule(w http.ResponseWriter, r *http.Request) {
+	update, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	rule, exists := s.rules[id]
+	if !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "rule not found")
+		return
+	}
+	// EMQX merges the given fields into the rule (a PUT with only "enable" toggles it)
+	maps.Copy(rule, update)
+	rule["id"] = id
+	writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	if _, exists := s.rules[id]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "rule not found")
+		return
+	}
+	delete(s.rules, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("id")
+	_, isRule := s.rules[id]
+	_, isAction := s.actions[id]
+	if !isRule && !isAction {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "resource not found")
+		return
+	}
+	metrics, ok := s.metrics[id]
+	if !ok {
+		metrics = map[string]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"metrics": metrics, "node_metrics": []interface{}{}})
+}
+
+func (s *Server) listConnectors(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.connectors)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	id, _ := user["user_id"].(string)
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", "user_id is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[id]; exists {
+		writeError(w, http.StatusConflict, "ALREADY_EXISTS", "user already exists")
+		return
+	}
+	s.users[id] = user
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"user_id": id, "is_superuser": user["is_superuser"]})
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	update, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("user")
+	user, exists := s.users[id]
+	if !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "user not found")
+		return
+	}
+	maps.Copy(user, update)
+	user["user_id"] = id
+	writeJSON(w, http.StatusOK, map[string]interface{}{"user_id": id, "is_superuser": user["is_superuser"]})
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := r.PathValue("user")
+	if _, exists := s.users[id]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "user not found")
+		return
+	}
+	delete(s.users, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) createACLs(w http.ResponseWriter, r *http.Request) {
+	var entries []map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		username, _ := entry["username"].(string)
+		if username == "" {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", "username is required")
+			return
+		}
+		if _, exists := s.acls[username]; exists {
+			writeError(w, http.StatusConflict, "ALREADY_EXISTS", "rules of user already exist")
+			return
+		}
+	}
+	for _, entry := range entries {
+		rules, _ := entry["rules"].([]interface{})
+		s.acls[entry["username"].(string)] = rules
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) updateACL(w http.ResponseWriter, r *http.Request) {
+	entry, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username := r.PathValue("user")
+	if _, exists := s.acls[username]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "rules of user not found")
+		return
+	}
+	rules, _ := entry["rules"].([]interface{})
+	s.acls[username] = rules
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteACL(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username := r.PathValue("user")
+	if _, exists := s.acls[username]; !exists {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "rules of user not found")
+		return
+	}
+	delete(s.acls, username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
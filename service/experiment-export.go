@@ -0,0 +1,572 @@
+package service
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Formats and layouts of an experiment export.
+const (
+	ExportCSV     = "csv"
+	ExportParquet = "parquet"
+	// ExportByMeasurement writes a file per measurement: a row per time and device.
+	ExportByMeasurement = "measurement"
+	// ExportWide writes a single file: a row per time, a column per series.
+	ExportWide = "wide"
+)
+
+// exportRowGroupRows bounds the rows a Parquet file holds in memory before
+// writing them out.
+const exportRowGroupRows = 10000
+
+// ExportRequest selects what an export writes. Start and stop default to the
+// running window of the experiment; Devices lists device keys, names or
+// addresses (every device when empty).
+type ExportRequest struct {
+	Format         string
+	Layout         string
+	Params         config.QueryParams
+	Devices        []string
+	IncludeGateway bool
+}
+
+// ExportMetadata is the metadata.json sidecar of an export: the devices and,
+// per file, the meaning, type and unit of each column.
+type ExportMetadata struct {
+	ExperimentID string         `json:"experimentId"`
+	Start        time.Time      `json:"start"`
+	Stop         time.Time      `json:"stop"`
+	Format       string         `json:"format"`
+	Layout       string         `json:"layout"`
+	ExportedAt   time.Time      `json:"exportedAt"`
+	Devices      []ExportDevice `json:"devices"`
+	Files        []ExportFile   `json:"files"`
+}
+
+type ExportDevice struct {
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	ShortName string `json:"shortName,omitempty"`
+	Address   string `json:"address"`
+}
+
+// ExportFile describes a data file of the export; Rows is its number of rows.
+type ExportFile struct {
+	Name    string         `json:"name"`
+	Rows    int64          `json:"rows"`
+	Columns []ExportColumn `json:"columns"`
+}
+
+// ExportColumn describes a column: time, device and deviceAddress (strings),
+// or the values of a field, typed as in Influx.
+type ExportColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Measurement string `json:"measurement,omitempty"`
+	Field       string `json:"field,omitempty"`
+	Gateway     bool   `json:"gateway,omitempty"`
+}
+
+// columnTime is the type of the time column; the other columns have an Influx type.
+const columnTime = "time"
+
+type ExportService struct {
+	AppConfig        *config.AppConfiguration
+	DashboardService *DashboardService
+}
+
+func NewExportService(appConfig *config.AppConfiguration) *ExportService {
+	return &ExportService{
+		AppConfig:        appConfig,
+		DashboardService: NewDashboardService(appConfig),
+	}
+}
+
+// Export is a prepared export of an experiment, written by WriteTo.
+type Export struct {
+	es           *ExportService
+	experimentId string
+	org          string
+	bucket       string
+	metadata     ExportMetadata
+	files        []exportFile
+	// devices maps the device addresses to their keys
+	devices map[string]string
+}
+
+// exportFile is a data file and the query filling it. The keys of the
+// columns are the record columns holding their values.
+type exportFile struct {
+	measurements []string
+	addresses    []string
+	fields       []string
+	keys         []string
+}
+
+// PrepareExport resolves the series of the experiment as the dashboards do
+// (see GetExperimentDashboard) and checks the request, so that every error is
+// known before the export is written. The values are exported as written,
+// never aggregated.
+func (es *ExportService) PrepareExport(experimentId string, request ExportRequest) (*Export, error) {
+	format := strings.ToLower(cmp.Or(request.Format, ExportCSV))
+	if format != ExportCSV && format != ExportParquet {
+		return nil, fmt.Errorf("%w: unknown format %q (use csv or parquet)", config.ErrValidation, request.Format)
+	}
+	layout := strings.ToLower(cmp.Or(request.Layout, ExportByMeasurement))
+	if layout != ExportByMeasurement && layout != ExportWide {
+		return nil, fmt.Errorf("%w: unknown layout %q (use measurement or wide)", config.ErrValidation, request.Layout)
+	}
+	experiment, err := es.DashboardService.ExperimentService.GetCompleteExperimentById(experimentId)
+	if err != nil {
+		return nil, err
+	}
+	window, err := defaultQueryWindow(experiment, config.QueryParams{Start: request.Params.Start, Stop: request.Params.Stop})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := experimentDevices(experiment)
+	selected, err := selectDevices(devices, request.Devices, experimentId)
+	if err != nil {
+		return nil, err
+	}
+	definitions := sourceDefinitions(experiment)
+	export := &Export{
+		es:           es,
+		experimentId: experimentId,
+		devices:      map[string]string{},
+		metadata: ExportMetadata{
+			ExperimentID: experimentId,
+			Start:        window.Start,
+			Stop:         window.Stop,
+			Format:       format,
+			Layout:       layout,
+			Devices:      []ExportDevice{},
+			Files:        []ExportFile{},
+		},
+	}
+	for _, element := range es.DashboardService.dashboardSeries(experiment, "", request.IncludeGateway) {
+		if len(selected) > 0 && !selected[element.Device] {
+			continue
+		}
+		export.org, export.bucket = element.Org, element.Bucket
+		if _, ok := export.devices[element.DeviceAddress]; !ok {
+			export.devices[element.DeviceAddress] = element.Device
+			export.metadata.Devices = append(export.metadata.Devices, devices[element.Device])
+		}
+		for _, column := range seriesColumns(element, definitions[element.Device+"/"+element.Measurement], request.IncludeGateway) {
+			export.add(column, element.DeviceAddress, layout)
+		}
+	}
+	if len(export.files) == 0 {
+		return nil, fmt.Errorf("no series to export in experiment %s: %w", experimentId, config.ErrNotFound)
+	}
+	for i := range export.metadata.Files {
+		export.metadata.Files[i].Name += "." + format
+	}
+	return export, nil
+}
+
+// experimentDevices returns the devices of a complete experiment by key.
+func experimentDevices(experiment bson.M) map[string]ExportDevice {
+	devices := map[string]ExportDevice{}
+	documents, _ := experiment["devices"].(primitive.M)
+	for key, d := range documents {
+		if device, ok := d.(primitive.M); ok {
+			devices[key] = ExportDevice{Key: key, Name: rulegen.GetString(device, "name"), ShortName: rulegen.GetString(device, "shortName"), Address: rulegen.GetString(device, "address")}
+		}
+	}
+	return devices
+}
+
+// selectDevices returns the keys of the devices matching the wanted keys,
+// names or addresses; it is empty when nothing is wanted. An unmatched value
+// is a validation error.
+func selectDevices(devices map[string]ExportDevice, wanted []string, experimentId string) (map[string]bool, error) {
+	selected := map[string]bool{}
+	unknown := []string{}
+	for _, w := range wanted {
+		found := false
+		for key, device := range devices {
+			if w == key || w == device.Name || strings.EqualFold(w, device.Address) {
+				selected[key] = true
+				found = true
+			}
+		}
+		if !found {
+			unknown = append(unknown, w)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("%w: unknown devices %v in experiment %s", config.ErrValidation, unknown, experimentId)
+	}
+	return selected, nil
+}
+
+// sourceDefinitions returns the rule definitions of the experiment keyed by
+// device and measurement, as used by seriesColumns.
+func sourceDefinitions(experiment bson.M) map[string]rulegen.Definition {
+	definitions := map[string]rulegen.Definition{}
+	for _, d := range rulegen.Generate(experiment) {
+		definitions[d.Device+"/"+d.Measurement] = d
+	}
+	return definitions
+}
+
+// seriesColumns returns the fields of a series as columns, typed from the rule
+// of its source (float when unknown). A series of every field of a measure is
+// expanded to the fields of its parser.
+func seriesColumns(element ElementToQuery, definition rulegen.Definition, includeGateway bool) []ExportColumn {
+	column := func(f rulegen.Field) ExportColumn {
+		return ExportColumn{
+			Name:        f.Name,
+			Type:        cmp.Or(f.Type, rulegen.TypeFloat),
+			Unit:        f.Unit,
+			Device:      element.Device,
+			Service:     element.Service,
+			Source:      element.Source,
+			Measurement: element.Measurement,
+			Field:       f.Name,
+			Gateway:     f.Gateway,
+		}
+	}
+	columns := []ExportColumn{}
+	for _, f := range definition.Fields {
+		if element.Field == f.Name || (element.Field == "" && (includeGateway || !f.Gateway)) {
+			columns = append(columns, column(f))
+		}
+	}
+	if len(columns) == 0 && element.Field != "" {
+		columns = append(columns, column(rulegen.Field{Name: element.Field}))
+	}
+	return columns
+}
+
+// add places the column of a series in its file: the file of its measurement,
+// shared by the devices of the same sensor, or the single wide file.
+func (e *Export) add(column ExportColumn, address string, layout string) {
+	name, key := column.Measurement, column.Field
+	if layout == ExportWide {
+		name = "data"
+		// pivoted columns are named after the values of the column key, joined by "_"
+		key = address + "_" + column.Measurement + "_" + column.Field
+		column.Name = column.Device + "." + column.Measurement + "." + column.Field
+	} else {
+		column.Device = ""
+	}
+	i := slices.IndexFunc(e.metadata.Files, func(f ExportFile) bool { return f.Name == name })
+	if i < 0 {
+		file := ExportFile{Name: name, Columns: []ExportColumn{{Name: "time", Type: columnTime}}}
+		if layout == ExportByMeasurement {
+			file.Columns = append(file.Columns, ExportColumn{Name: "device", Type: rulegen.TypeString}, ExportColumn{Name: "deviceAddress", Type: rulegen.TypeString})
+		}
+		e.metadata.Files = append(e.metadata.Files, file)
+		e.files = append(e.files, exportFile{keys: make([]string, len(file.Columns))})
+		i = len(e.files) - 1
+	}
+	file, meta := &e.files[i], &e.metadata.Files[i]
+	if !slices.Contains(file.measurements, column.Measurement) {
+		file.measurements = append(file.measurements, column.Measurement)
+	}
+	if !slices.Contains(file.addresses, address) {
+		file.addresses = append(file.addresses, address)
+	}
+	if !slices.Contains(file.fields, column.Field) {
+		file.fields = append(file.fields, column.Field)
+	}
+	if slices.Contains(file.keys, key) {
+		return
+	}
+	// a field cannot take the name of another column
+	if slices.ContainsFunc(meta.Columns, func(c ExportColumn) bool { return c.Name == column.Name }) {
+		column.Name = column.Measurement + "." + column.Name
+	}
+	file.keys = append(file.keys, key)
+	meta.Columns = append(meta.Columns, column)
+}
+
+// FileName is the name of the zip archive written by WriteTo.
+func (e *Export) FileName() string {
+	return fmt.Sprintf("experiment-%s-%s.zip", e.experimentId, e.metadata.Format)
+}
+
+// WriteTo writes the export as a zip archive: the data files, then
+// metadata.json. Rows are written as they are read from Influx, a file after
+// the other; an error leaves the archive incomplete.
+func (e *Export) WriteTo(ctx context.Context, w io.Writer) error {
+	archive := zip.NewWriter(w)
+	e.metadata.ExportedAt = time.Now().UTC()
+	for i := range e.files {
+		rows, err := e.writeFile(ctx, archive, i)
+		if err != nil {
+			return fmt.Errorf("export of %s: %w", e.metadata.Files[i].Name, err)
+		}
+		e.metadata.Files[i].Rows = rows
+	}
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: "metadata.json", Method: zip.Deflate, Modified: e.metadata.ExportedAt})
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(e.metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := entry.Write(bs); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// writeFile queries the rows of a file, pivoted to a column per field, and
+// writes them to a new entry of the archive.
+func (e *Export) writeFile(ctx context.Context, archive *zip.Writer, i int) (int64, error) {
+	file, meta := e.files[i], e.metadata.Files[i]
+	header := &zip.FileHeader{Name: meta.Name, Method: zip.Deflate, Modified: e.metadata.ExportedAt}
+	if e.metadata.Format == ExportParquet {
+		// Parquet pages are already compressed
+		header.Method = zip.Store
+	}
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	var table tableWriter
+	if e.metadata.Format == ExportParquet {
+		table = newParquetTable(entry, meta.Columns)
+	} else {
+		table, err = newCSVTable(entry, meta.Columns)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	query := config.NewFluxQuery(e.bucket).
+		Range(e.metadata.Start, e.metadata.Stop).
+		Filter("experimentId", e.experimentId).
+		Filter("_measurement", file.measurements...).
+		Filter("deviceAddress", file.addresses...).
+		Filter("_field", file.fields...)
+	if e.metadata.Layout == ExportWide {
+		query.Keep("_time", "_measurement", "deviceAddress", "_field", "_value").
+			Group().
+			Pivot([]string{"_time"}, []string{"deviceAddress", "_measurement", "_field"}, "_value").
+			Sort("_time")
+	} else {
+		query.Keep("_time", "deviceAddress", "_field", "_value").
+			Group().
+			Pivot([]string{"_time", "deviceAddress"}, []string{"_field"}, "_value").
+			Sort("_time", "deviceAddress")
+	}
+	var rows int64
+	row := make([]interface{}, len(meta.Columns))
+	fixed := 1
+	if e.metadata.Layout == ExportByMeasurement {
+		fixed = 3
+	}
+	err = e.es.AppConfig.Influx.StreamQuery(ctx, e.org, query, func(values map[string]interface{}) error {
+		row[0] = values["_time"]
+		if fixed == 3 {
+			address, _ := values["deviceAddress"].(string)
+			row[1], row[2] = e.devices[address], address
+		}
+		for j := fixed; j < len(row); j++ {
+			row[j] = exportValue(values[file.keys[j]], meta.Columns[j].Type)
+		}
+		rows++
+		return table.Write(row)
+	})
+	if err != nil {
+		return rows, err
+	}
+	return rows, table.Close()
+}
+
+// exportValue converts a value read from Influx to the type of its column;
+// nil (an empty cell) when missing or not convertible.
+func exportValue(v interface{}, columnType string) interface{} {
+	switch columnType {
+	case rulegen.TypeFloat:
+		switch n := v.(type) {
+		case float64:
+			return n
+		case int64:
+			return float64(n)
+		case uint64:
+			return float64(n)
+		}
+	case rulegen.TypeInteger:
+		switch n := v.(type) {
+		case int64:
+			return n
+		case uint64:
+			if n <= math.MaxInt64 {
+				return int64(n)
+			}
+		case float64:
+			if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+				return int64(n)
+			}
+		}
+	case rulegen.TypeUnsigned:
+		switch n := v.(type) {
+		case uint64:
+			return n
+		case int64:
+			if n >= 0 {
+				return uint64(n)
+			}
+		case float64:
+			if n >= 0 && n == math.Trunc(n) && n < 1<<64 {
+				return uint64(n)
+			}
+		}
+	case rulegen.TypeBoolean:
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	case rulegen.TypeString:
+		if v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// tableWriter writes the rows of a data file; values are of the column type,
+// nil for an empty cell.
+type tableWriter interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+type csvTable struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCSVTable(w io.Writer, columns []ExportColumn) (*csvTable, error) {
+	t := &csvTable{writer: csv.NewWriter(w), record: make([]string, len(columns))}
+	for i, c := range columns {
+		t.record[i] = c.Name
+	}
+	return t, t.writer.Write(t.record)
+}
+
+func (t *csvTable) Write(row []interface{}) error {
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+			t.record[i] = ""
+		case time.Time:
+			t.record[i] = v.UTC().Format(time.RFC3339Nano)
+		case float64:
+			t.record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			t.record[i] = fmt.Sprint(v)
+		}
+	}
+	return t.writer.Write(t.record)
+}
+
+func (t *csvTable) Close() error {
+	t.writer.Flush()
+	return t.writer.Error()
+}
+
+// parquetTable writes the time as a required nanosecond timestamp and every
+// other column as optional.
+type parquetTable struct {
+	writer *parquet.Writer
+	// indexes are the Parquet column indexes of the columns, which are sorted by name
+	indexes []int
+	types   []string
+	row     parquet.Row
+}
+
+func newParquetTable(w io.Writer, columns []ExportColumn) *parquetTable {
+	group := parquet.Group{}
+	for _, c := range columns {
+		group[c.Name] = parquet.Optional(parquetNode(c.Type))
+		if c.Type == columnTime {
+			group[c.Name] = parquetNode(c.Type)
+		}
+	}
+	schema := parquet.NewSchema("experiment", group)
+	t := &parquetTable{
+		writer: parquet.NewWriter(w, schema, parquet.MaxRowsPerRowGroup(exportRowGroupRows), parquet.Compression(&parquet.Zstd)),
+		row:    make(parquet.Row, len(columns)),
+	}
+	for _, c := range columns {
+		leaf, _ := schema.Lookup(c.Name)
+		t.indexes = append(t.indexes, leaf.ColumnIndex)
+		t.types = append(t.types, c.Type)
+	}
+	return t
+}
+
+func parquetNode(columnType string) parquet.Node {
+	switch columnType {
+	case columnTime:
+		return parquet.Timestamp(parquet.Nanosecond)
+	case rulegen.TypeInteger:
+		return parquet.Int(64)
+	case rulegen.TypeUnsigned:
+		return parquet.Uint(64)
+	case rulegen.TypeBoolean:
+		return parquet.Leaf(parquet.BooleanType)
+	case rulegen.TypeString:
+		return parquet.String()
+	}
+	return parquet.Leaf(parquet.DoubleType)
+}
+
+func (t *parquetTable) Write(row []interface{}) error {
+	for i, v := range row {
+		value := parquet.NullValue()
+		switch v := v.(type) {
+		case time.Time:
+			value = parquet.Int64Value(v.UnixNano())
+		case int64:
+			value = parquet.Int64Value(v)
+		case uint64:
+			value = parquet.Int64Value(int64(v))
+		case float64:
+			value = parquet.DoubleValue(v)
+		case bool:
+			value = parquet.BooleanValue(v)
+		case string:
+			value = parquet.ByteArrayValue([]byte(v))
+		}
+		definition := 0
+		if !value.IsNull() && t.types[i] != columnTime {
+			definition = 1
+		}
+		t.row[t.indexes[i]] = value.Level(0, definition, t.indexes[i])
+	}
+	_, err := t.writer.WriteRows([]parquet.Row{t.row})
+	return err
+}
+
+func (t *parquetTable) Close() error {
+	return t.writer.Close()
+}
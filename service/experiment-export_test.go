@@ -0,0 +1,197 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/topic"
+	"slices"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSeriesColumns(t *testing.T) {
+	definition := sourceDefinitions(testExperiment(testExperimentId, StatusRunning))["sensor_0/thermo_temperature"]
+	tests := []struct {
+		name           string
+		field          string
+		includeGateway bool
+		want           []string
+	}{
+		{name: "field", field: "temperature", want: []string{"temperature float"}},
+		{name: "every field", want: []string{"temperature float"}},
+		{name: "every field with the gateway", includeGateway: true, want: []string{"temperature float", "gatewayBattery integer gateway", "rssi integer gateway"}},
+		{name: "gateway field", field: "rssi", want: []string{"rssi integer gateway"}},
+		{name: "unknown field", field: "humidity", want: []string{"humidity float"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			element := ElementToQuery{Device: "sensor_0", Measurement: "thermo_temperature", Field: tt.field, Service: "180a", Source: "Temperature"}
+			got := []string{}
+			for _, c := range seriesColumns(element, definition, tt.includeGateway) {
+				if c.Device != "sensor_0" || c.Service != "180a" || c.Source != "Temperature" || c.Measurement != "thermo_temperature" || c.Field != c.Name {
+					t.Errorf("column %+v does not describe its series", c)
+				}
+				column := c.Name + " " + c.Type
+				if c.Gateway {
+					column += " gateway"
+				}
+				got = append(got, column)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("columns = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// readZip returns the entries of an archive, in order.
+func readZip(t testing.TB, data []byte) ([]*zip.File, map[string][]byte) {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading the archive: %v", err)
+	}
+	contents := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		contents[f.Name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", f.Name, err)
+		}
+	}
+	return archive.File, contents
+}
+
+func TestExport(t *testing.T) {
+	byMeasurement := `#datatype,string,long,dateTime:RFC3339,string,long
+#group,false,false,false,false,false
+#default,_result,,,,
+,result,table,_time,deviceAddress,temperature
+,,0,2024-05-01T10:00:00Z,AA:BB:CC:DD:EE:01,2150
+,,0,2024-05-01T10:00:01Z,AA:BB:CC:DD:EE:01,
+`
+	wide := `#datatype,string,long,dateTime:RFC3339,long
+#group,false,false,false,false
+#default,_result,,,
+,result,table,_time,AA:BB:CC:DD:EE:01_thermo_temperature_temperature
+,,0,2024-05-01T10:00:00Z,2150
+,,0,2024-05-01T10:00:01Z,
+`
+	tests := []struct {
+		name    string
+		request ExportRequest
+		influx  string
+		file    string
+		columns []string
+		csv     string
+	}{
+		{
+			name:    "by measurement",
+			request: ExportRequest{Format: ExportCSV},
+			influx:  byMeasurement,
+			file:    "thermo_temperature.csv",
+			columns: []string{"time", "device", "deviceAddress", "temperature"},
+			csv:     "time,device,deviceAddress,temperature\n2024-05-01T10:00:00Z,sensor_0,AA:BB:CC:DD:EE:01,2150\n2024-05-01T10:00:01Z,sensor_0,AA:BB:CC:DD:EE:01,\n",
+		},
+		{
+			name:    "wide",
+			request: ExportRequest{Format: ExportCSV, Layout: ExportWide},
+			influx:  wide,
+			file:    "data.csv",
+			columns: []string{"time", "sensor_0.thermo_temperature.temperature"},
+			csv:     "time,sensor_0.thermo_temperature.temperature\n2024-05-01T10:00:00Z,2150\n2024-05-01T10:00:01Z,\n",
+		},
+		{
+			name:    "parquet",
+			request: ExportRequest{Format: ExportParquet},
+			influx:  byMeasurement,
+			file:    "thermo_temperature.parquet",
+			columns: []string{"time", "device", "deviceAddress", "temperature"},
+		},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			oid := primitive.NewObjectID()
+			mt.AddMockResponses(storedExperiment(oid)...)
+			es := NewExportService(&config.AppConfiguration{Settings: &config.Settings{}, Mongo: &config.MongoClient{Database: mt.DB}, Influx: influxCSV(mt.T, tt.influx), Topics: topic.Legacy()})
+			tt.request.Params = config.QueryParams{Start: "2024-05-01T10:00:00Z", Stop: "2024-05-01T11:00:00Z"}
+
+			export, err := es.PrepareExport(oid.Hex(), tt.request)
+			if err != nil {
+				mt.Fatalf("PrepareExport: %v", err)
+			}
+			if want := "experiment-" + oid.Hex() + "-" + tt.request.Format + ".zip"; export.FileName() != want {
+				mt.Errorf("file name %s, want %s", export.FileName(), want)
+			}
+			var archive bytes.Buffer
+			if err := export.WriteTo(context.Background(), &archive); err != nil {
+				mt.Fatalf("WriteTo: %v", err)
+			}
+
+			entries, contents := readZip(mt, archive.Bytes())
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			if !slices.Equal(names, []string{tt.file, "metadata.json"}) {
+				mt.Fatalf("entries = %v, want %s and metadata.json", names, tt.file)
+			}
+			// Parquet pages are already compressed
+			if method := entries[0].Method; (method == zip.Store) != (tt.request.Format == ExportParquet) {
+				mt.Errorf("%s stored with method %d", tt.file, method)
+			}
+
+			var metadata ExportMetadata
+			if err := json.Unmarshal(contents["metadata.json"], &metadata); err != nil {
+				mt.Fatalf("metadata.json: %v", err)
+			}
+			if metadata.ExperimentID != oid.Hex() || len(metadata.Devices) != 1 || metadata.Devices[0].Address != "AA:BB:CC:DD:EE:01" || len(metadata.Files) != 1 {
+				mt.Fatalf("metadata = %+v", metadata)
+			}
+			file := metadata.Files[0]
+			columns := []string{}
+			for _, c := range file.Columns {
+				columns = append(columns, c.Name)
+			}
+			if file.Name != tt.file || file.Rows != 2 || !slices.Equal(columns, tt.columns) {
+				mt.Errorf("file = %s with %d rows and columns %v, want %s with 2 rows and columns %v", file.Name, file.Rows, columns, tt.file, tt.columns)
+			}
+			if last := file.Columns[len(file.Columns)-1]; last.Type != rulegen.TypeInteger || last.Source != "Temperature" {
+				mt.Errorf("column %+v, want the integer temperature", last)
+			}
+
+			data := contents[tt.file]
+			if tt.request.Format == ExportParquet {
+				f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+				if err != nil {
+					mt.Fatalf("%s: %v", tt.file, err)
+				}
+				fields := []string{}
+				for _, field := range f.Schema().Fields() {
+					fields = append(fields, field.Name())
+				}
+				// the Parquet columns are sorted by name
+				if want := slices.Sorted(slices.Values(tt.columns)); f.NumRows() != 2 || !slices.Equal(fields, want) {
+					mt.Errorf("%s has %d rows and columns %v, want 2 rows and columns %v", tt.file, f.NumRows(), fields, want)
+				}
+				return
+			}
+			if got := string(data); got != tt.csv {
+				mt.Errorf("%s =\n%s\nwant\n%s", tt.file, got, tt.csv)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"fmt"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Ingestion statuses: green when data reached InfluxDB in the last minutes.
+const (
+	IngestionGreen = "green"
+	IngestionRed   = "red"
+)
+
+// SourceIngestion holds the EMQX counters of the rule and action of one
+// characteristic or measure. Matched, Passed and Failed are counted by the
+// rule; Written, WriteFailed and Dropped by the action; rates are messages
+// per second matched by the rule.
+type SourceIngestion struct {
+	Source      string  `json:"source"`
+	Topic       string  `json:"topic"`
+	RuleID      string  `json:"ruleId"`
+	ActionName  string  `json:"actionName"`
+	Matched     int64   `json:"matched"`
+	Passed      int64   `json:"passed"`
+	Failed      int64   `json:"failed"`
+	Written     int64   `json:"written"`
+	WriteFailed int64   `json:"writeFailed"`
+	Dropped     int64   `json:"dropped"`
+	Rate        float64 `json:"rate"`
+	RateLast5m  float64 `json:"rateLast5m"`
+	Status      string  `json:"status"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// DeviceIngestion sums the counters of the sources of a device; it is green
+// only when every source is.
+type DeviceIngestion struct {
+	Device      string            `json:"device"`
+	Matched     int64             `json:"matched"`
+	Passed      int64             `json:"passed"`
+	Failed      int64             `json:"failed"`
+	Written     int64             `json:"written"`
+	WriteFailed int64             `json:"writeFailed"`
+	Dropped     int64             `json:"dropped"`
+	Rate        float64           `json:"rate"`
+	Status      string            `json:"status"`
+	Sources     []SourceIngestion `json:"sources"`
+}
+
+// ExperimentIngestion is the ingestion status of an experiment, by device.
+type ExperimentIngestion struct {
+	ExperimentID string            `json:"experimentId"`
+	Status       string            `json:"status"`
+	CheckedAt    time.Time         `json:"checkedAt"`
+	Devices      []DeviceIngestion `json:"devices"`
+}
+
+// GetIngestion reads the EMQX metrics of the rules and actions of the experiment.
+func (es *ExperimentService) GetIngestion(id string) (*ExperimentIngestion, error) {
+	completeExperiment, err := es.GetCompleteExperimentById(id)
+	if err != nil {
+		return nil, err
+	}
+	return GetIngestion(es.EMQX, completeExperiment)
+}
+
+// GetIngestion reads the EMQX metrics of every rule and action generated for
+// the complete experiment. A source is green when its rule is enabled, matched
+// messages in the last 5 minutes and its action wrote points; otherwise Reason
+// says why.
+func GetIngestion(client EMQXClient, completeExperiment bson.M) (*ExperimentIngestion, error) {
+	rules, err := client.GetEMQXListRules()
+	if err != nil {
+		return nil, fmt.Errorf("%w: listing EMQX rules: %v", config.ErrUpstream, err)
+	}
+	actions, err := client.GetEMQXListActions()
+	if err != nil {
+		return nil, fmt.Errorf("%w: listing EMQX actions: %v", config.ErrUpstream, err)
+	}
+	enabled := map[string]bool{}
+	for _, rule := range rules {
+		enable, _ := rule["enable"].(bool)
+		enabled[rulegen.GetString(rule, "id")] = enable
+	}
+	actionTypes := map[string]string{}
+	for _, action := range actions {
+		actionTypes[rulegen.GetString(action, "name")] = rulegen.GetString(action, "type")
+	}
+
+	result := &ExperimentIngestion{ExperimentID: rulegen.GetString(completeExperiment, "experimentId"), Status: IngestionGreen, CheckedAt: time.Now().UTC(), Devices: []DeviceIngestion{}}
+	for _, d := range rulegen.Generate(completeExperiment) {
+		source := sourceIngestion(client, d, enabled, actionTypes)
+		if len(result.Devices) == 0 || result.Devices[len(result.Devices)-1].Device != d.Device {
+			result.Devices = append(result.Devices, DeviceIngestion{Device: d.Device, Status: IngestionGreen, Sources: []SourceIngestion{}})
+		}
+		device := &result.Devices[len(result.Devices)-1]
+		device.Matched += source.Matched
+		device.Passed += source.Passed
+		device.Failed += source.Failed
+		device.Written += source.Written
+		device.WriteFailed += source.WriteFailed
+		device.Dropped += source.Dropped
+		device.Rate += source.Rate
+		if source.Status != IngestionGreen {
+			device.Status = IngestionRed
+			result.Status = IngestionRed
+		}
+		device.Sources = append(device.Sources, source)
+	}
+	if len(result.Devices) == 0 {
+		result.Status = IngestionRed
+	}
+	return result, nil
+}
+
+func sourceIngestion(client EMQXClient, d rulegen.Definition, enabled map[string]bool, actionTypes map[string]string) SourceIngestion {
+	source := SourceIngestion{Source: d.Source, Topic: d.Topic, RuleID: d.RuleID, ActionName: d.ActionName, Status: IngestionRed}
+	enable, ruleExists := enabled[d.RuleID]
+	actionType, actionExists := actionTypes[d.ActionName]
+	switch {
+	case !ruleExists:
+		source.Reason = "rule not found in EMQX"
+		return source
+	case !actionExists:
+		source.Reason = "action not found in EMQX"
+		return source
+	}
+
+	ruleMetrics, err := client.GetEMQXRuleMetrics(d.RuleID)
+	if err != nil {
+		source.Reason = "rule metrics unavailable: " + err.Error()
+		return source
+	}
+	counters, _ := ruleMetrics["metrics"].(map[string]interface{})
+	source.Matched = int64(metricValue(counters, "matched"))
+	source.Passed = int64(metricValue(counters, "passed"))
+	source.Failed = int64(metricValue(counters, "failed"))
+	source.Rate = metricValue(counters, "matched.rate")
+	source.RateLast5m = metricValue(counters, "matched.rate.last5m")
+
+	if actionType == "" {
+		actionType = "influxdb"
+	}
+	actionMetrics, err := client.GetEMQXActionMetrics(actionType, d.ActionName)
+	if err != nil {
+		source.Reason = "action metrics unavailable: " + err.Error()
+		return source
+	}
+	counters, _ = actionMetrics["metrics"].(map[string]interface{})
+	source.Written = int64(metricValue(counters, "success"))
+	source.WriteFailed = int64(metricValue(counters, "failed"))
+	source.Dropped = int64(metricValue(counters, "dropped"))
+
+	switch {
+	case !enable:
+		source.Reason = "rule disabled"
+	case source.Matched == 0:
+		source.Reason = "no message received"
+	case source.RateLast5m == 0:
+		source.Reason = "no message in the last 5 minutes"
+	case source.Written == 0:
+		source.Reason = "no point written to InfluxDB"
+	default:
+		source.Status = IngestionGreen
+	}
+	return source
+}
+
+// metricValue reads a numeric EMQX metric; missing or malformed values count as 0.
+func metricValue(metrics map[string]interface{}, key string) float64 {
+	switch v := metrics[key].(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	return 0
+}
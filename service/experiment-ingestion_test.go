@@ -0,0 +1,78 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestGetIngestion(t *testing.T) {
+	client, fake := newTestClient(t)
+	experiment := testExperiment(testExperimentId, StatusRunning)
+
+	// nothing provisioned yet
+	ingestion, err := GetIngestion(client, experiment)
+	if err != nil {
+		t.Fatalf("GetIngestion: %v", err)
+	}
+	if ingestion.Status != IngestionRed || len(ingestion.Devices) != 2 || ingestion.Devices[0].Sources[0].Reason != "rule not found in EMQX" {
+		t.Errorf("ingestion = %+v, want red sources without rules", ingestion)
+	}
+
+	plan, err := PlanEMQX(client, experiment, "Influx1")
+	if err != nil {
+		t.Fatalf("PlanEMQX: %v", err)
+	}
+	if report, err := ApplyEMQX(client, plan); err != nil || !report.Success {
+		t.Fatalf("ApplyEMQX = %+v, %v", report, err)
+	}
+	thermo, movesense := "thermo_temperature_"+testExperimentId, "ms_meashr_"+testExperimentId
+	fake.SetMetrics("rule_id_"+thermo, map[string]interface{}{"matched": 10, "passed": 9, "failed": 1, "matched.rate": 0.5, "matched.rate.last5m": 0.25})
+	fake.SetMetrics("influxdb:action_"+thermo, map[string]interface{}{"success": 9, "failed": 0, "dropped": 0})
+	// counters may be strings; no message in the last 5 minutes
+	fake.SetMetrics("rule_id_"+movesense, map[string]interface{}{"matched": "4", "passed": "4", "matched.rate": "0", "matched.rate.last5m": "0"})
+	fake.SetMetrics("influxdb:action_"+movesense, map[string]interface{}{"success": 3, "failed": 1, "dropped": 2})
+
+	ingestion, err = GetIngestion(client, experiment)
+	if err != nil {
+		t.Fatalf("GetIngestion: %v", err)
+	}
+	if ingestion.ExperimentID != testExperimentId || ingestion.Status != IngestionRed || len(ingestion.Devices) != 2 {
+		t.Fatalf("ingestion = %+v, want the two devices of %s, red", ingestion, testExperimentId)
+	}
+	tests := []struct {
+		got  DeviceIngestion
+		want DeviceIngestion
+	}{
+		{got: ingestion.Devices[0], want: DeviceIngestion{Device: "sensor_0", Matched: 10, Passed: 9, Failed: 1, Written: 9, Rate: 0.5, Status: IngestionGreen}},
+		{got: ingestion.Devices[1], want: DeviceIngestion{Device: "sensor_1", Matched: 4, Passed: 4, Written: 3, WriteFailed: 1, Dropped: 2, Status: IngestionRed}},
+	}
+	for _, tt := range tests {
+		got := tt.got
+		got.Sources = nil
+		if got.Device != tt.want.Device || got.Matched != tt.want.Matched || got.Passed != tt.want.Passed || got.Failed != tt.want.Failed ||
+			got.Written != tt.want.Written || got.WriteFailed != tt.want.WriteFailed || got.Dropped != tt.want.Dropped ||
+			got.Rate != tt.want.Rate || got.Status != tt.want.Status {
+			t.Errorf("device = %+v, want %+v", got, tt.want)
+		}
+		if len(tt.got.Sources) != 1 {
+			t.Errorf("device %s has %d sources, want 1", got.Device, len(tt.got.Sources))
+		}
+	}
+	if source := ingestion.Devices[0].Sources[0]; source.RuleID != "rule_id_"+thermo || source.RateLast5m != 0.25 || source.Reason != "" {
+		t.Errorf("thermo source = %+v", source)
+	}
+	if source := ingestion.Devices[1].Sources[0]; source.Reason != "no message in the last 5 minutes" {
+		t.Errorf("movesense source = %+v, want no recent message", source)
+	}
+
+	// a paused experiment has its rules disabled
+	if err := SetExperimentRulesEnabled(client, testExperimentId, false); err != nil {
+		t.Fatalf("SetExperimentRulesEnabled: %v", err)
+	}
+	ingestion, err = GetIngestion(client, experiment)
+	if err != nil {
+		t.Fatalf("GetIngestion: %v", err)
+	}
+	if source := ingestion.Devices[0].Sources[0]; source.Status != IngestionRed || source.Reason != "rule disabled" {
+		t.Errorf("thermo source = %+v, want the rule disabled", source)
+	}
+}
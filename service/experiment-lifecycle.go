@@ -0,0 +1,152 @@
+package service
+
+import (
+	"fmt"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Experiment lifecycle states. Documents written before the lifecycle existed
+// have no status and already had their EMQX rules enabled, so they are treated
+// as running.
+const (
+	StatusDraft     = "draft"
+	StatusRunning   = "running"
+	StatusPaused    = "paused"
+	StatusCompleted = "completed"
+	StatusArchived  = "archived"
+)
+
+// managedFields are written by the service itself (lifecycle transitions, EMQX
+// sync report) and survive a PUT of the experiment.
+var managedFields = []string{"status", "startedAt", "pausedAt", "stoppedAt", "archivedAt", "statusHistory", "emqxSync"}
+
+type experimentTransition struct {
+	from      []string
+	to        string
+	timestamp string
+}
+
+var experimentTransitions = map[string]experimentTransition{
+	"start":   {from: []string{StatusDraft, StatusPaused}, to: StatusRunning, timestamp: "startedAt"},
+	"pause":   {from: []string{StatusRunning}, to: StatusPaused, timestamp: "pausedAt"},
+	"stop":    {from: []string{StatusRunning, StatusPaused}, to: StatusCompleted, timestamp: "stoppedAt"},
+	"archive": {from: []string{StatusCompleted}, to: StatusArchived, timestamp: "archivedAt"},
+}
+
+// ExperimentStatus returns the lifecycle status of an experiment document.
+func ExperimentStatus(experiment bson.M) string {
+	if status := rulegen.GetString(experiment, "status"); status != "" {
+		return status
+	}
+	return StatusRunning
+}
+
+// TransitionExperiment applies a lifecycle action (start, pause, stop, archive).
+// EMQX rules are enabled or disabled first, and stopping also revokes the MQTT
+// credentials of the gateways; the new status is only stored when that
+// succeeds. It returns the new status.
+func (es *ExperimentService) TransitionExperiment(id string, action string) (string, error) {
+	transition, ok := experimentTransitions[action]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown lifecycle action %q", config.ErrValidation, action)
+	}
+	oid, err := parseObjectId(id)
+	if err != nil {
+		return "", err
+	}
+	experiment, err := es.GetRawExperimentById(id)
+	if err != nil {
+		return "", err
+	}
+	current := ExperimentStatus(experiment)
+	if !slices.Contains(transition.from, current) {
+		return "", fmt.Errorf("%w: cannot %s an experiment in status %s", config.ErrConflict, action, current)
+	}
+
+	// the built-in ingestion follows the status by itself
+	emqx := !es.AppConfig.Settings.Ingestion.Builtin()
+	if emqx && transition.to != StatusArchived {
+		if err := SetExperimentRulesEnabled(es.EMQX, id, transition.to == StatusRunning); err != nil {
+			return "", err
+		}
+	}
+	if emqx && transition.to == StatusCompleted {
+		if err := es.revokeCredentials(id); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{
+		"$set":  bson.M{"status": transition.to},
+		"$push": bson.M{"statusHistory": bson.M{"action": action, "from": current, "to": transition.to, "at": now}},
+	}
+	if transition.timestamp == "startedAt" {
+		// $min keeps the first start when resuming a paused experiment
+		update["$min"] = bson.M{"startedAt": now}
+	} else {
+		update["$set"].(bson.M)[transition.timestamp] = now
+	}
+	// the status filter makes the transition atomic against concurrent calls
+	filter := bson.M{"_id": oid, "status": bson.M{"$in": statusFilter(transition.from)}}
+	modified, err := es.AppConfig.Mongo.PatchData(filter, update, "experiments")
+	if err != nil {
+		return "", err
+	}
+	if modified == 0 {
+		return "", fmt.Errorf("%w: experiment %s changed status concurrently", config.ErrConflict, id)
+	}
+	return transition.to, nil
+}
+
+// RunningWindow returns the time range covered by the experiment runs, if it was ever started.
+func RunningWindow(experiment bson.M) (time.Time, time.Time, bool) {
+	start, ok := toTime(experiment["startedAt"])
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	stop, ok := toTime(experiment["stoppedAt"])
+	if !ok {
+		stop = time.Now().UTC()
+	}
+	return start, stop, true
+}
+
+// keepManagedFields copies the managed fields of the stored experiment into the replacement document.
+func keepManagedFields(stored bson.M, replacement bson.M) {
+	for _, field := range managedFields {
+		if v, ok := stored[field]; ok {
+			replacement[field] = v
+		} else {
+			delete(replacement, field)
+		}
+	}
+}
+
+// statusFilter lists the accepted values of "status"; running also matches legacy documents without status.
+func statusFilter(statuses []string) bson.A {
+	values := bson.A{}
+	for _, status := range statuses {
+		values = append(values, status)
+		if status == StatusRunning {
+			values = append(values, nil)
+		}
+	}
+	return values
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return t.Time().UTC(), true
+	case time.Time:
+		return t.UTC(), true
+	}
+	return time.Time{}, false
+}
@@ -1,11 +1,14 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"maps"
 	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/topic"
 	"strconv"
-	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,11 +16,13 @@ import (
 
 type ExperimentService struct {
 	AppConfig *config.AppConfiguration
+	EMQX      EMQXClient
 }
 
 func NewExperimentService(appConfig *config.AppConfiguration) *ExperimentService {
 	return &ExperimentService{
 		AppConfig: appConfig,
+		EMQX:      NewClient(appConfig.Settings.EMQX),
 	}
 }
 
@@ -37,45 +42,69 @@ func (es *ExperimentService) GetAllExperiments() ([]bson.M, error) {
 	return result, nil
 }
 func (es *ExperimentService) GetRawExperimentById(id string) (bson.M, error) {
-	oid, err2 := primitive.ObjectIDFromHex(id)
+	oid, err2 := parseObjectId(id)
 	if err2 != nil {
 		return nil, err2
 	}
 	experimentList, err := es.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid}, "experiments")
-	if err != nil || len(experimentList) == 0 {
+	if err != nil {
 		return nil, err
 	}
+	if len(experimentList) == 0 {
+		return nil, fmt.Errorf("experiment %s: %w", id, config.ErrNotFound)
+	}
 	experiment := experimentList[0]
 	return experiment, nil
 }
 func (es *ExperimentService) GetCompleteExperimentById(id string) (bson.M, error) {
+	return es.completeExperiment(id, es.AppConfig.Topics)
+}
+
+// completeExperiment resolves the sensors of the experiment, naming the MQTT topics with topics.
+func (es *ExperimentService) completeExperiment(id string, topics *topic.Namer) (bson.M, error) {
 	result := bson.M{}
-	oid, error := primitive.ObjectIDFromHex(id)
+	oid, error := parseObjectId(id)
 	if error != nil {
-		log.Println("ID non valido:", error)
 		return nil, error
 	}
 	experimentList, err := es.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid}, "experiments")
-	if err != nil || len(experimentList) == 0 {
+	if err != nil {
 		return nil, err
 	}
+	if len(experimentList) == 0 {
+		return nil, fmt.Errorf("experiment %s: %w", id, config.ErrNotFound)
+	}
 	experiment := experimentList[0]
 	result["experimentId"] = experiment["_id"].(primitive.ObjectID).Hex()
+	if influx, ok := experiment["influx"]; ok {
+		result["influx"] = influx
+	}
+	result["status"] = ExperimentStatus(experiment)
+	for _, field := range []string{"startedAt", "stoppedAt"} {
+		if v, ok := experiment[field]; ok {
+			result[field] = v
+		}
+	}
 	result["devices"] = bson.M{}
 	if experiment["devices"] != nil {
 		i := 0
 		for _, device := range experiment["devices"].(primitive.A) {
-			sid, errorSensorId := primitive.ObjectIDFromHex(device.(bson.M)["sensorId"].(string))
+			sid, errorSensorId := parseObjectId(device.(bson.M)["sensorId"].(string))
 			if errorSensorId != nil {
-				log.Println("ID non valido:", error)
 				return nil, errorSensorId
 			}
 			sensorList, errSensor := es.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": sid})
-			if errSensor != nil || len(sensorList) == 0 {
+			if errSensor != nil {
 				return nil, errSensor
 			}
+			if len(sensorList) == 0 {
+				return nil, fmt.Errorf("sensor %s referenced by experiment %s: %w", sid.Hex(), id, config.ErrNotFound)
+			}
 			// sensore preso dal db
 			sensor := sensorList[0]
+			if err := NewGatewayProfileService(es.AppConfig).ResolveGateway(sensor); err != nil {
+				return nil, err
+			}
 			sensorServices := []bson.M{}
 			delete(sensor, "_id")
 			if device.(primitive.M)["enabledServices"] != nil {
@@ -86,16 +115,27 @@ func (es *ExperimentService) GetCompleteExperimentById(id string) (bson.M, error
 							characteristics := serviceFromSensor.(bson.M)["characteristics"].(primitive.A)
 							for _, characteristic := range characteristics {
 								characteristicMap := characteristic.(bson.M)
-								newCharacteristics = append(newCharacteristics, bson.M{
+								mqttTopic, errTopic := topics.Characteristic(
+									experiment["_id"].(primitive.ObjectID).Hex(),
+									sensor["name"].(string),
+									device.(primitive.M)["macAddress"].(string),
+									rulegen.GetString(serviceFromSensor.(bson.M), "uuid"),
+									characteristicMap["name"].(string),
+									"",
+								)
+								newCharacteristic := bson.M{
 									"name":         characteristicMap["name"],
 									"uuid":         characteristicMap["uuid"],
 									"structParser": characteristicMap["structParser"],
-									"mqttTopic": "qiot/" +
-										experiment["_id"].(primitive.ObjectID).Hex() + "/" +
-										strings.ToLower(strings.Replace(sensor["name"].(string), " ", "", -1)) + "/" +
-										strings.ToLower(strings.Replace(device.(primitive.M)["macAddress"].(string), ":", "", -1)) + "/" +
-										strings.ToLower(strings.Replace(characteristicMap["name"].(string), " ", "", -1)),
-								})
+									"mqttTopic":    mqttTopic,
+								}
+								if errTopic != nil {
+									// only this characteristic is left without a topic, and without rule
+									log.Printf("experiment %s: no topic for characteristic %v: %v", id, characteristicMap["name"], errTopic)
+									delete(newCharacteristic, "mqttTopic")
+									newCharacteristic["mqttTopicError"] = errTopic.Error()
+								}
+								newCharacteristics = append(newCharacteristics, newCharacteristic)
 								log.Println("New characteristics:", newCharacteristics)
 							}
 							serviceFromSensorMap := serviceFromSensor.(bson.M)
@@ -122,11 +162,19 @@ func (es *ExperimentService) GetCompleteExperimentById(id string) (bson.M, error
 					newMeasures := []bson.M{}
 					for _, m := range measures {
 						mMap := m.(bson.M)
-						mMap["mqttTopic"] = "qiot/" +
-							experiment["_id"].(primitive.ObjectID).Hex() + "/" +
-							strings.ToLower(strings.Replace(device.(primitive.M)["macAddress"].(string), ":", "", -1)) +
-							"/ble/movesense/" +
-							strings.ToLower(strings.Replace(mMap["name"].(string), ":", "", -1))
+						mqttTopic, errTopic := topics.Measure(
+							experiment["_id"].(primitive.ObjectID).Hex(),
+							rulegen.GetString(sensor, "name"),
+							device.(primitive.M)["macAddress"].(string),
+							mMap["name"].(string),
+							"",
+						)
+						if errTopic != nil {
+							log.Printf("experiment %s: no topic for measure %v: %v", id, mMap["name"], errTopic)
+							mMap["mqttTopicError"] = errTopic.Error()
+						} else {
+							mMap["mqttTopic"] = mqttTopic
+						}
 						newMeasures = append(newMeasures, mMap)
 					}
 					mw["measures"] = newMeasures
@@ -139,43 +187,168 @@ func (es *ExperimentService) GetCompleteExperimentById(id string) (bson.M, error
 	}
 	return result, nil
 }
-func (es *ExperimentService) InsertExperiment(data bson.M) (InsertedID interface{}, err error) {
+
+// InsertExperiment stores a new experiment, issues the MQTT credentials of its
+// gateways and queues its EMQX provisioning. It returns the inserted id, the id
+// of the provisioning job and the new credentials, which are not shown again.
+func (es *ExperimentService) InsertExperiment(data bson.M) (InsertedID interface{}, jobId string, credentials []MQTTCredential, err error) {
+	gateways, errGateways := experimentGateways(data)
+	if errGateways != nil {
+		return nil, "", nil, errGateways
+	}
+	// managed fields are only changed by the service itself
+	keepManagedFields(bson.M{"status": StatusDraft}, data)
 	inserted, errConfiguration := es.AppConfig.Mongo.InsertData(data, "experiments")
 	if errConfiguration != nil {
-		return nil, errConfiguration
+		return nil, "", nil, errConfiguration
+	}
+	if es.AppConfig.Settings.Ingestion.Builtin() {
+		// no EMQX to provision: the built-in ingestion picks the experiment up
+		return inserted, "", nil, nil
 	}
-	completeExperiment, errCompleteExperiment := es.GetCompleteExperimentById(inserted.(primitive.ObjectID).Hex())
-	if errCompleteExperiment != nil {
-		log.Println("error while retrieving complete experiment:", errCompleteExperiment)
-		return nil, errCompleteExperiment
+	id := inserted.(primitive.ObjectID).Hex()
+	credentials, errCredentials := es.issueCredentials(id, ExperimentStatus(data), gateways)
+	if errCredentials != nil {
+		log.Println("error while issuing MQTT credentials:", errCredentials)
 	}
-	emqx := NewClientFromEnv()
-	errorEmqx := emqx.ProcessYAMLAndSync(completeExperiment)
-	if errorEmqx != nil {
-		return nil, errorEmqx
+	// the experiment is stored: provision it even without new credentials
+	jobId, errJob := NewJobService(es.AppConfig).Enqueue(JobEMQXSync, id)
+	if errJob != nil {
+		log.Println("error while queueing EMQX provisioning:", errJob)
 	}
-	return inserted, nil
+	return inserted, jobId, credentials, errors.Join(errCredentials, errJob)
 }
-func (es *ExperimentService) UpdateExperiment(id string, data bson.M) (int64, error) {
-	eid, errorExperimentId := primitive.ObjectIDFromHex(id)
+
+// UpdateExperiment replaces the experiment, keeping its managed fields, updates
+// the MQTT credentials of its gateways and queues its EMQX provisioning. It
+// returns the id of the provisioning job and the credentials of added gateways.
+func (es *ExperimentService) UpdateExperiment(id string, data bson.M) (int64, string, []MQTTCredential, error) {
+	eid, errorExperimentId := parseObjectId(id)
 	if errorExperimentId != nil {
-		log.Println("ID non valido:", errorExperimentId)
-		return 0, errorExperimentId
+		return 0, "", nil, errorExperimentId
+	}
+	gateways, errGateways := experimentGateways(data)
+	if errGateways != nil {
+		return 0, "", nil, errGateways
 	}
+	stored, errStored := es.GetRawExperimentById(id)
+	if errStored != nil {
+		return 0, "", nil, errStored
+	}
+	keepManagedFields(stored, data)
 	inserted, errConfiguration := es.AppConfig.Mongo.UpdateData(bson.M{"_id": eid}, data, "experiments")
 	if errConfiguration != nil {
 		log.Println("error while inserting:", errConfiguration)
-		return 0, errConfiguration
+		return 0, "", nil, errConfiguration
+	}
+	if es.AppConfig.Settings.Ingestion.Builtin() {
+		return inserted, "", nil, nil
+	}
+	credentials, errCredentials := es.issueCredentials(id, ExperimentStatus(data), gateways)
+	if errCredentials != nil {
+		log.Println("error while issuing MQTT credentials:", errCredentials)
+	}
+	// the experiment is stored: provision it even without new credentials
+	jobId, errJob := NewJobService(es.AppConfig).Enqueue(JobEMQXSync, id)
+	if errJob != nil {
+		log.Println("error while queueing EMQX provisioning:", errJob)
+	}
+	return inserted, jobId, credentials, errors.Join(errCredentials, errJob)
+}
+
+// GetEMQXStatus returns the report of the last EMQX sync of the experiment.
+func (es *ExperimentService) GetEMQXStatus(id string) (interface{}, error) {
+	experiment, err := es.GetRawExperimentById(id)
+	if err != nil {
+		return nil, err
+	}
+	report, ok := experiment["emqxSync"]
+	if !ok {
+		return nil, fmt.Errorf("EMQX sync report of experiment %s: %w", id, config.ErrNotFound)
+	}
+	return report, nil
+}
+
+// syncEMQX pushes the complete experiment and the MQTT credentials of its
+// gateways to EMQX and stores the report on the experiment. Stopped experiments
+// keep their credentials revoked.
+func (es *ExperimentService) syncEMQX(id string, completeExperiment bson.M) (*SyncReport, error) {
+	connector := es.AppConfig.TargetFor(completeExperiment).Connector
+	report, err := ProcessYAMLAndSync(es.EMQX, completeExperiment, connector)
+	if status := ExperimentStatus(completeExperiment); status != StatusCompleted && status != StatusArchived {
+		es.provisionCredentials(id, report)
+		report.finish()
+		if err == nil && !report.Success {
+			err = fmt.Errorf("%w: provisioning MQTT credentials of experiment %s failed", config.ErrUpstream, id)
+		}
+	}
+	es.saveSyncReport(id, report)
+	return report, err
+}
+
+func (es *ExperimentService) saveSyncReport(id string, report *SyncReport) {
+	oid, err := parseObjectId(id)
+	if err != nil {
+		return
 	}
-	completeExperiment, errCompleteExperiment := es.GetCompleteExperimentById(id)
-	if errCompleteExperiment != nil {
-		log.Println("error while retrieving complete experiment:", errCompleteExperiment)
-		return 0, errCompleteExperiment
+	if _, err := es.AppConfig.Mongo.PatchData(bson.M{"_id": oid}, bson.M{"$set": bson.M{"emqxSync": report}}, "experiments"); err != nil {
+		log.Println("error while saving EMQX sync report:", err)
 	}
-	emqx := NewClientFromEnv()
-	errorEmqx := emqx.ProcessYAMLAndSync(completeExperiment)
-	if errorEmqx != nil {
-		return 0, errorEmqx
+}
+
+// DeleteExperiment removes the EMQX rules, actions and users of the experiment, then the
+// experiment itself. The document is kept when the EMQX cleanup fails, so the
+// call can be retried.
+func (es *ExperimentService) DeleteExperiment(id string) error {
+	oid, err := parseObjectId(id)
+	if err != nil {
+		return err
+	}
+	if _, err := es.GetRawExperimentById(id); err != nil {
+		return err
+	}
+	if !es.AppConfig.Settings.Ingestion.Builtin() {
+		if err := DeleteExperimentResources(es.EMQX, id); err != nil {
+			return err
+		}
+		if err := es.deleteCredentials(id); err != nil {
+			return err
+		}
+	}
+	_, err = es.AppConfig.Mongo.DeleteData(bson.M{"_id": oid}, "experiments")
+	return err
+}
+
+// GetEMQXDefinitions returns the rules and actions generated for the experiment, without contacting EMQX.
+func (es *ExperimentService) GetEMQXDefinitions(id string) ([]rulegen.Definition, error) {
+	completeExperiment, err := es.GetCompleteExperimentById(id)
+	if err != nil {
+		return nil, err
+	}
+	return rulegen.Generate(completeExperiment), nil
+}
+
+// PlanEMQX computes, without applying it, the EMQX changes needed by the experiment.
+func (es *ExperimentService) PlanEMQX(id string) (*EMQXPlan, error) {
+	completeExperiment, err := es.GetCompleteExperimentById(id)
+	if err != nil {
+		return nil, err
+	}
+	return PlanEMQX(es.EMQX, completeExperiment, es.AppConfig.TargetFor(completeExperiment).Connector)
+}
+
+// ApplyEMQX reconciles EMQX with the experiment, removing orphaned rules and actions.
+// It returns the plan that was applied and the report of the calls made.
+func (es *ExperimentService) ApplyEMQX(id string) (*EMQXPlan, *SyncReport, error) {
+	completeExperiment, err := es.GetCompleteExperimentById(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := PlanEMQX(es.EMQX, completeExperiment, es.AppConfig.TargetFor(completeExperiment).Connector)
+	if err != nil {
+		return nil, nil, err
 	}
-	return inserted, nil
+	report, err := ApplyEMQX(es.EMQX, plan)
+	es.saveSyncReport(id, report)
+	return plan, report, err
 }
@@ -0,0 +1,349 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Methods computing the statistics of a series.
+const (
+	StatsFlux = "flux"
+	StatsGo   = "go"
+	// StatsAuto computes in Flux, and in Go when the Flux query fails.
+	StatsAuto = "auto"
+)
+
+// statsFallbackPoints bounds the values of a series read to compute its statistics in Go.
+const statsFallbackPoints = 1000000
+
+// maxPercentiles bounds the percentiles of a request.
+const maxPercentiles = 10
+
+// DefaultPercentiles are computed when a request gives none.
+var DefaultPercentiles = []float64{25, 75, 95}
+
+// StatsRequest selects the statistics computed. Start and stop default to the
+// running window of the experiment; with every the statistics are computed
+// per window. Devices lists device keys, names or addresses (every device
+// when empty).
+type StatsRequest struct {
+	Params         config.QueryParams
+	Percentiles    []float64
+	Method         string
+	Devices        []string
+	IncludeGateway bool
+}
+
+// ExperimentStats holds the statistics of the numeric series of an experiment.
+// Partial is set when some series failed; they carry the error.
+type ExperimentStats struct {
+	ExperimentID string        `json:"experimentId"`
+	Start        time.Time     `json:"start"`
+	Stop         time.Time     `json:"stop"`
+	Every        string        `json:"every,omitempty"`
+	Percentiles  []float64     `json:"percentiles"`
+	Series       []SeriesStats `json:"series"`
+	Failed       int           `json:"failed"`
+	Partial      bool          `json:"partial"`
+}
+
+// SeriesStats are the statistics of a field, per window; without every a
+// single window covers the whole range. Method tells how they were computed.
+type SeriesStats struct {
+	ID          string         `json:"id"`
+	Device      string         `json:"device"`
+	Service     string         `json:"service,omitempty"`
+	Source      string         `json:"source"`
+	Measurement string         `json:"measurement"`
+	Field       string         `json:"field"`
+	Type        string         `json:"type"`
+	Unit        string         `json:"unit,omitempty"`
+	Method      string         `json:"method,omitempty"`
+	Windows     []config.Stats `json:"windows"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type StatsService struct {
+	AppConfig        *config.AppConfiguration
+	DashboardService *DashboardService
+}
+
+func NewStatsService(appConfig *config.AppConfiguration) *StatsService {
+	return &StatsService{
+		AppConfig:        appConfig,
+		DashboardService: NewDashboardService(appConfig),
+	}
+}
+
+// statsTarget is a numeric field of a series of the experiment.
+type statsTarget struct {
+	element ElementToQuery
+	column  ExportColumn
+}
+
+// GetExperimentStats computes the statistics of the numeric fields of the
+// series of the experiment (see GetExperimentDashboard), over the raw values.
+// The series run on the dashboard query workers under the dashboard deadline;
+// failed ones are reported per series and only fail the request when every
+// series failed.
+func (ss *StatsService) GetExperimentStats(ctx context.Context, experimentId string, request StatsRequest) (*ExperimentStats, error) {
+	method := strings.ToLower(cmp.Or(request.Method, StatsAuto))
+	if method != StatsAuto && method != StatsFlux && method != StatsGo {
+		return nil, fmt.Errorf("%w: unknown method %q (use auto, flux or go)", config.ErrValidation, request.Method)
+	}
+	percentiles, err := statsPercentiles(request.Percentiles)
+	if err != nil {
+		return nil, err
+	}
+	ds := ss.DashboardService
+	experiment, err := ds.ExperimentService.GetCompleteExperimentById(experimentId)
+	if err != nil {
+		return nil, err
+	}
+	params := config.QueryParams{Start: request.Params.Start, Stop: request.Params.Stop, Every: request.Params.Every}
+	window, err := defaultQueryWindow(experiment, params)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(params.Every) == "" {
+		// statistics are computed over the raw values, never on automatic windows
+		window.Every = 0
+	}
+	selected, err := selectDevices(experimentDevices(experiment), request.Devices, experimentId)
+	if err != nil {
+		return nil, err
+	}
+	definitions := sourceDefinitions(experiment)
+	targets := []statsTarget{}
+	for _, element := range ds.dashboardSeries(experiment, "", request.IncludeGateway) {
+		if len(selected) > 0 && !selected[element.Device] {
+			continue
+		}
+		for _, column := range seriesColumns(element, definitions[element.Device+"/"+element.Measurement], request.IncludeGateway) {
+			if column.Type == rulegen.TypeFloat || column.Type == rulegen.TypeInteger || column.Type == rulegen.TypeUnsigned {
+				targets = append(targets, statsTarget{element: element, column: column})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no numeric series in experiment %s: %w", experimentId, config.ErrNotFound)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ss.AppConfig.Settings.Dashboard.Timeout())
+	defer cancel()
+	result := &ExperimentStats{
+		ExperimentID: experimentId,
+		Start:        window.Start,
+		Stop:         window.Stop,
+		Percentiles:  percentiles,
+		Series:       make([]SeriesStats, len(targets)),
+	}
+	if window.Every > 0 {
+		result.Every = window.Every.String()
+	}
+	errs := make([]error, len(targets))
+	ds.runQueries(len(targets), func(i int) {
+		target := targets[i]
+		series := SeriesStats{
+			ID:          target.element.SensorName + target.element.Measurement + target.column.Field,
+			Device:      target.element.Device,
+			Service:     target.element.Service,
+			Source:      target.element.Source,
+			Measurement: target.element.Measurement,
+			Field:       target.column.Field,
+			Type:        target.column.Type,
+			Unit:        target.column.Unit,
+			Windows:     []config.Stats{},
+		}
+		used, windows, err := ss.seriesStats(ctx, experimentId, target, window, percentiles, method)
+		switch {
+		case err != nil:
+			series.Error = err.Error()
+			errs[i] = err
+		case len(windows) == 0 && window.Every == 0:
+			series.Method, series.Windows = used, []config.Stats{{Start: window.Start, Stop: window.Stop}}
+		default:
+			series.Method, series.Windows = used, windows
+		}
+		result.Series[i] = series
+	})
+
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			result.Failed++
+			firstErr = cmp.Or(firstErr, err)
+		}
+	}
+	if result.Failed == len(targets) {
+		if errors.Is(firstErr, config.ErrTimeout) {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("%w: every stats query failed: %w", config.ErrUpstream, firstErr)
+	}
+	result.Partial = result.Failed > 0
+	return result, nil
+}
+
+// statsPercentiles checks the requested percentiles, returning them sorted
+// without duplicates (DefaultPercentiles when none).
+func statsPercentiles(requested []float64) ([]float64, error) {
+	if len(requested) == 0 {
+		return slices.Clone(DefaultPercentiles), nil
+	}
+	if len(requested) > maxPercentiles {
+		return nil, fmt.Errorf("%w: at most %d percentiles", config.ErrValidation, maxPercentiles)
+	}
+	for _, p := range requested {
+		if !(p >= 0 && p <= 100) {
+			return nil, fmt.Errorf("%w: percentile %v out of [0, 100]", config.ErrValidation, p)
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(requested))), nil
+}
+
+// seriesStats computes the statistics of a series with the given method,
+// returning the method used.
+func (ss *StatsService) seriesStats(ctx context.Context, experimentId string, target statsTarget, window config.QueryWindow, percentiles []float64, method string) (string, []config.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, queryError(err)
+	}
+	e := target.element
+	if method != StatsGo {
+		query := config.NewFluxQuery(e.Bucket).
+			Range(window.Start, window.Stop).
+			Filter("experimentId", experimentId).
+			Filter("deviceAddress", e.DeviceAddress).
+			Filter("_measurement", e.Measurement).
+			Filter("_field", target.column.Field).
+			Group("_start", "_stop")
+		stats, err := ss.AppConfig.Influx.QueryStats(ctx, e.Org, query, window.Every, percentiles)
+		switch {
+		case ctx.Err() != nil:
+			return "", nil, queryError(ctx.Err())
+		case err == nil:
+			return StatsFlux, stats, nil
+		case method == StatsFlux:
+			return "", nil, err
+		}
+	}
+	stats, err := ss.goStats(ctx, experimentId, target, window, percentiles)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = queryError(ctx.Err())
+		}
+		return "", nil, err
+	}
+	return StatsGo, stats, nil
+}
+
+// goStats reads the raw values of a series and computes their statistics,
+// exactly, in Go. At most statsFallbackPoints values are read.
+func (ss *StatsService) goStats(ctx context.Context, experimentId string, target statsTarget, window config.QueryWindow, percentiles []float64) ([]config.Stats, error) {
+	e := target.element
+	query := config.NewFluxQuery(e.Bucket).
+		Range(window.Start, window.Stop).
+		Filter("experimentId", experimentId).
+		Filter("deviceAddress", e.DeviceAddress).
+		Filter("_measurement", e.Measurement).
+		Filter("_field", target.column.Field).
+		Keep("_time", "_value")
+	windows := map[time.Time][]float64{}
+	read := 0
+	err := ss.AppConfig.Influx.StreamQuery(ctx, e.Org, query, func(values map[string]interface{}) error {
+		var v float64
+		switch n := values["_value"].(type) {
+		case float64:
+			v = n
+		case int64:
+			v = float64(n)
+		case uint64:
+			v = float64(n)
+		default:
+			return nil
+		}
+		if read++; read > statsFallbackPoints {
+			return fmt.Errorf("%w: more than %d values, narrow the range or use windows", config.ErrInvalidQuery, statsFallbackPoints)
+		}
+		start := window.Start
+		if window.Every > 0 {
+			t, _ := values["_time"].(time.Time)
+			// windows are aligned to the epoch, as in Flux
+			ns, every := t.UnixNano(), window.Every.Nanoseconds()
+			start = time.Unix(0, ns-((ns%every)+every)%every).UTC()
+		}
+		windows[start] = append(windows[start], v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := []config.Stats{}
+	for _, start := range slices.SortedFunc(maps.Keys(windows), time.Time.Compare) {
+		// the first and last windows are cut by the range
+		from, to := start, window.Stop
+		if window.Every > 0 {
+			if from.Before(window.Start) {
+				from = window.Start
+			}
+			if end := start.Add(window.Every); end.Before(to) {
+				to = end
+			}
+		}
+		stats = append(stats, computeStats(windows[start], from, to, percentiles))
+	}
+	return stats, nil
+}
+
+// computeStats returns the statistics of values, which are sorted in place.
+// Quantiles interpolate linearly between the closest values, as Flux does
+// with method exact_mean.
+func computeStats(values []float64, start time.Time, stop time.Time, percentiles []float64) config.Stats {
+	stats := config.Stats{Start: start, Stop: stop, Count: int64(len(values))}
+	if len(values) == 0 {
+		return stats
+	}
+	slices.Sort(values)
+	n := float64(len(values))
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / n
+	minimum, maximum := values[0], values[len(values)-1]
+	stats.Min, stats.Max, stats.Mean = &minimum, &maximum, &mean
+	if len(values) > 1 {
+		squares := 0.0
+		for _, v := range values {
+			squares += (v - mean) * (v - mean)
+		}
+		stddev := math.Sqrt(squares / (n - 1))
+		stats.StdDev = &stddev
+	}
+	median := quantile(values, 0.5)
+	stats.Median = &median
+	stats.Percentiles = map[string]float64{}
+	for _, p := range percentiles {
+		stats.Percentiles[config.PercentileKey(p)] = quantile(values, p/100)
+	}
+	return stats
+}
+
+// quantile returns the quantile q (0 to 1) of sorted values.
+func quantile(sorted []float64, q float64) float64 {
+	x := q * float64(len(sorted)-1)
+	lower, upper := math.Floor(x), math.Ceil(x)
+	if lower == upper {
+		return sorted[int(lower)]
+	}
+	return sorted[int(lower)]*(upper-x) + sorted[int(upper)]*(x-lower)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"qiot-configuration-service/config"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+func TestStatsPercentiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []float64
+		want      []float64
+		wantErr   bool
+	}{
+		{name: "default", want: DefaultPercentiles},
+		{name: "sorted and deduplicated", requested: []float64{99, 5, 99, 0, 100}, want: []float64{0, 5, 99, 100}},
+		{name: "above 100", requested: []float64{50, 100.1}, wantErr: true},
+		{name: "negative", requested: []float64{-1}, wantErr: true},
+		{name: "not a number", requested: []float64{math.NaN()}, wantErr: true},
+		{name: "too many", requested: make([]float64, maxPercentiles+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := statsPercentiles(tt.requested)
+			if tt.wantErr {
+				if !errors.Is(err, config.ErrValidation) {
+					t.Errorf("statsPercentiles(%v) = %v, %v, want a validation error", tt.requested, got, err)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("statsPercentiles(%v) = %v, %v, want %v", tt.requested, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// statsString renders the statistics that are set, for comparison.
+func statsString(s config.Stats) string {
+	parts := []string{fmt.Sprintf("count=%d", s.Count)}
+	for _, v := range []struct {
+		name  string
+		value *float64
+	}{{"min", s.Min}, {"max", s.Max}, {"mean", s.Mean}, {"stddev", s.StdDev}, {"median", s.Median}} {
+		if v.value != nil {
+			parts = append(parts, fmt.Sprintf("%s=%.4g", v.name, *v.value))
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.Percentiles)) {
+		parts = append(parts, fmt.Sprintf("%s=%.4g", key, s.Percentiles[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestComputeStats(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      []float64
+		percentiles []float64
+		want        string
+	}{
+		{name: "empty window", values: []float64{}, percentiles: []float64{50}, want: "count=0"},
+		{name: "single value", values: []float64{7}, percentiles: []float64{0, 100}, want: "count=1 min=7 max=7 mean=7 median=7 p0=7 p100=7"},
+		{name: "odd median", values: []float64{3, 1, 2}, want: "count=3 min=1 max=3 mean=2 stddev=1 median=2"},
+		{name: "even median", values: []float64{4, 1, 3, 2}, want: "count=4 min=1 max=4 mean=2.5 stddev=1.291 median=2.5"},
+		{name: "interpolated percentiles", values: []float64{10, 40, 20, 30, 50}, percentiles: []float64{0, 10, 75, 99.9, 100},
+			want: "count=5 min=10 max=50 mean=30 stddev=15.81 median=30 p0=10 p10=14 p100=50 p75=40 p99.9=49.96"},
+	}
+	start, stop := time.Unix(0, 0).UTC(), time.Unix(60, 0).UTC()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := computeStats(tt.values, start, stop, tt.percentiles)
+			if got := statsString(stats); got != tt.want {
+				t.Errorf("computeStats(%v) = %s, want %s", tt.values, got, tt.want)
+			}
+			if !stats.Start.Equal(start) || !stats.Stop.Equal(stop) {
+				t.Errorf("window = %s - %s, want %s - %s", stats.Start, stats.Stop, start, stop)
+			}
+		})
+	}
+}
+
+// influxCSV serves body, the annotated CSV of a Flux query result, to every query.
+func influxCSV(t *testing.T, body string) *config.InfluxClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	client := influxdb2.NewClient(server.URL, "token")
+	t.Cleanup(client.Close)
+	return &config.InfluxClient{Client: client}
+}
+
+func TestGoStats(t *testing.T) {
+	influx := influxCSV(t, `#datatype,string,long,dateTime:RFC3339,double
+#group,false,false,false,false
+#default,_result,,,
+,result,table,_time,_value
+,,0,2024-05-01T10:00:50Z,1
+,,0,2024-05-01T10:01:00Z,2
+,,0,2024-05-01T10:01:30Z,4
+,,0,2024-05-01T10:02:59Z,8
+,,0,2024-05-01T10:03:05Z,16
+`)
+	ss := &StatsService{AppConfig: &config.AppConfiguration{Influx: influx}}
+	target := statsTarget{element: ElementToQuery{Org: "org", Bucket: "bucket", Measurement: "thermo_temperature", DeviceAddress: "AA:01"}, column: ExportColumn{Field: "temperature"}}
+	start, stop := time.Date(2024, 5, 1, 10, 0, 45, 0, time.UTC), time.Date(2024, 5, 1, 10, 3, 10, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		every time.Duration
+		want  []string
+	}{
+		{name: "whole range", want: []string{"10:00:45-10:03:10 count=5"}},
+		{name: "epoch-aligned windows", every: time.Minute, want: []string{
+			// the first and last windows are cut by the range
+			"10:00:45-10:01:00 count=1",
+			"10:01:00-10:02:00 count=2",
+			"10:02:00-10:03:00 count=1",
+			"10:03:00-10:03:10 count=1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window := config.QueryWindow{Start: start, Stop: stop, Every: tt.every}
+			stats, err := ss.goStats(context.Background(), "e1", target, window, nil)
+			if err != nil {
+				t.Fatalf("goStats: %v", err)
+			}
+			got := []string{}
+			for _, s := range stats {
+				got = append(got, fmt.Sprintf("%s-%s count=%d", s.Start.Format(time.TimeOnly), s.Stop.Format(time.TimeOnly), s.Count))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("windows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"fmt"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const gatewayProfilesCollection = "gatewayProfiles"
+
+// GatewayProfileService manages named gateway envelopes, shared by the sensors
+// referencing them with "gatewayProfile".
+type GatewayProfileService struct {
+	AppConfig *config.AppConfiguration
+}
+
+func NewGatewayProfileService(appConfig *config.AppConfiguration) *GatewayProfileService {
+	return &GatewayProfileService{
+		AppConfig: appConfig,
+	}
+}
+
+func (gs *GatewayProfileService) GetAllGatewayProfiles() ([]bson.M, error) {
+	profiles, err := gs.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{}, gatewayProfilesCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		delete(profile, "_id")
+	}
+	return profiles, nil
+}
+
+func (gs *GatewayProfileService) GetGatewayProfile(name string) (bson.M, error) {
+	profiles, err := gs.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"name": name}, gatewayProfilesCollection)
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("gateway profile %s: %w", name, config.ErrNotFound)
+	}
+	profile := profiles[0]
+	delete(profile, "_id")
+	return profile, nil
+}
+
+// InsertGatewayProfile stores a new profile; names are unique.
+func (gs *GatewayProfileService) InsertGatewayProfile(data bson.M) error {
+	profile, err := newGatewayProfile(rulegen.GetString(data, "name"), data)
+	if err != nil {
+		return err
+	}
+	if _, err := gs.GetGatewayProfile(rulegen.GetString(profile, "name")); err == nil {
+		return fmt.Errorf("%w: gateway profile %s already exists", config.ErrConflict, rulegen.GetString(profile, "name"))
+	}
+	_, err = gs.AppConfig.Mongo.InsertData(profile, gatewayProfilesCollection)
+	return err
+}
+
+// UpdateGatewayProfile replaces the envelope of a profile. The experiments of the
+// sensors using it must be synced again for EMQX to pick the change up.
+func (gs *GatewayProfileService) UpdateGatewayProfile(name string, data bson.M) error {
+	profile, err := newGatewayProfile(name, data)
+	if err != nil {
+		return err
+	}
+	_, err = gs.AppConfig.Mongo.UpdateData(bson.M{"name": name}, profile, gatewayProfilesCollection)
+	return err
+}
+
+// DeleteGatewayProfile removes a profile that no sensor references.
+func (gs *GatewayProfileService) DeleteGatewayProfile(name string) error {
+	usedBy, err := gs.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"gatewayProfile": name})
+	if err != nil {
+		return err
+	}
+	if len(usedBy) > 0 {
+		return fmt.Errorf("%w: gateway profile %s is used by %d sensor(s)", config.ErrConflict, name, len(usedBy))
+	}
+	_, err = gs.AppConfig.Mongo.DeleteData(bson.M{"name": name}, gatewayProfilesCollection)
+	return err
+}
+
+// ResolveGateway sets the "gateway" envelope of a sensor referencing a profile.
+func (gs *GatewayProfileService) ResolveGateway(sensor bson.M) error {
+	name, ok := sensor["gatewayProfile"].(string)
+	if !ok {
+		return nil
+	}
+	profile, err := gs.GetGatewayProfile(name)
+	if err != nil {
+		return err
+	}
+	sensor["gateway"] = bson.M{"tags": profile["tags"], "fields": profile["fields"]}
+	return nil
+}
+
+// newGatewayProfile validates the envelope of a profile document and returns it normalized.
+func newGatewayProfile(name string, data bson.M) (bson.M, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: gateway profile name is required", config.ErrValidation)
+	}
+	envelope, err := rulegen.ParseEnvelope(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+	}
+	profile := bson.M{"name": name, "tags": envelope.Tags, "fields": envelope.Fields}
+	if description, ok := data["description"].(string); ok {
+		profile["description"] = description
+	}
+	return profile, nil
+}
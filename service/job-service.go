@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Job states. A job is queued, claimed by a worker (running), and either
+// succeeds or goes back to retrying with a backoff; after the configured number
+// of attempts it is dead and left for inspection.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobRetrying  = "retrying"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+// Job types. JobEMQXSync provisions the EMQX rules and actions of an
+// experiment; JobEMQXReconcile also deletes those no longer in the experiment.
+const (
+	JobEMQXSync      = "emqx_sync"
+	JobEMQXReconcile = "emqx_reconcile"
+)
+
+const jobsCollection = "jobs"
+
+// JobService persists background jobs in Mongo and runs them with a pool of workers.
+type JobService struct {
+	AppConfig *config.AppConfiguration
+}
+
+func NewJobService(appConfig *config.AppConfiguration) *JobService {
+	return &JobService{
+		AppConfig: appConfig,
+	}
+}
+
+// Enqueue stores a job for the experiment and returns its id. A job of the same
+// type still waiting to run (queued or retrying) is reused: it reads the
+// experiment when it runs, so it already covers the latest change. The lookup and
+// the insert are a single upsert, and the unique index on the queued jobs (see
+// Start) keeps concurrent requests from queueing the same job twice.
+func (js *JobService) Enqueue(jobType string, experimentId string) (string, error) {
+	now := time.Now().UTC()
+	filter := bson.M{"type": jobType, "experimentId": experimentId, "status": bson.M{"$in": bson.A{JobQueued, JobRetrying}}}
+	update := bson.M{"$setOnInsert": bson.M{
+		"status":      JobQueued,
+		"attempts":    0,
+		"maxAttempts": js.AppConfig.Settings.Jobs.MaxAttempts,
+		"nextRunAt":   now,
+		"createdAt":   now,
+		"updatedAt":   now,
+	}}
+	job, err := js.AppConfig.Mongo.UpsertData(filter, update, jobsCollection)
+	if errors.Is(err, config.ErrDuplicateKey) {
+		// a concurrent request queued the job first: the upsert now finds it
+		job, err = js.AppConfig.Mongo.UpsertData(filter, update, jobsCollection)
+	}
+	if err != nil {
+		return "", err
+	}
+	return job["_id"].(primitive.ObjectID).Hex(), nil
+}
+
+// GetJob returns a job with its "_id" renamed to "id".
+func (js *JobService) GetJob(id string) (bson.M, error) {
+	oid, err := parseObjectId(id)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := js.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid}, jobsCollection)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job %s: %w", id, config.ErrNotFound)
+	}
+	job := jobs[0]
+	job["id"] = job["_id"]
+	delete(job, "_id")
+	return job, nil
+}
+
+// Start launches the workers; they stop when ctx is cancelled. It first makes
+// sure at most one job per type and experiment is queued.
+func (js *JobService) Start(ctx context.Context) {
+	err := js.AppConfig.Mongo.EnsureUniqueIndex("queued_job", bson.D{{Key: "type", Value: 1}, {Key: "experimentId", Value: 1}}, bson.M{"status": JobQueued}, jobsCollection)
+	if err != nil {
+		log.Printf("Jobs: cannot create the index of the queued jobs, concurrent updates may queue duplicate jobs: %v", err)
+	}
+	for i := 0; i < js.AppConfig.Settings.Jobs.Workers; i++ {
+		go js.work(ctx, i)
+	}
+}
+
+func (js *JobService) work(ctx context.Context, worker int) {
+	_, _, pollInterval, _ := js.AppConfig.Settings.Jobs.Durations()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		// drain the queue before waiting for the next tick
+		for ctx.Err() == nil {
+			job, err := js.claim()
+			if errors.Is(err, config.ErrNotFound) {
+				break
+			}
+			if err != nil {
+				log.Println("job worker", worker, "error while claiming job:", err)
+				break
+			}
+			js.run(job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim takes the next due job. Running jobs whose lock is older than the lock
+// timeout belonged to a worker that died and are taken over, unless they have
+// no attempt left: those are dead.
+func (js *JobService) claim() (bson.M, error) {
+	_, _, _, lockTimeout := js.AppConfig.Settings.Jobs.Durations()
+	now := time.Now().UTC()
+	stale := bson.M{"status": JobRunning, "lockedAt": bson.M{"$lt": now.Add(-lockTimeout)}}
+	exhausted := bson.M{"$expr": bson.M{"$gte": bson.A{"$attempts", "$maxAttempts"}}}
+	_, err := js.AppConfig.Mongo.PatchData(
+		bson.M{"$and": bson.A{stale, exhausted}},
+		bson.M{
+			"$set":   bson.M{"status": JobDead, "finishedAt": now, "updatedAt": now, "lastError": "the worker running the last attempt stopped"},
+			"$unset": bson.M{"lockedAt": ""},
+		},
+		jobsCollection,
+	)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": bson.M{"$in": bson.A{JobQueued, JobRetrying}}, "nextRunAt": bson.M{"$lte": now}},
+		bson.M{"$and": bson.A{stale, bson.M{"$expr": bson.M{"$lt": bson.A{"$attempts", "$maxAttempts"}}}}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": JobRunning, "lockedAt": now, "updatedAt": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	return js.AppConfig.Mongo.ClaimData(filter, update, bson.D{{Key: "nextRunAt", Value: 1}}, jobsCollection)
+}
+
+func (js *JobService) run(job bson.M) {
+	oid := job["_id"].(primitive.ObjectID)
+	experimentId := rulegen.GetString(job, "experimentId")
+	var report *SyncReport
+	var err error
+	switch jobType := rulegen.GetString(job, "type"); jobType {
+	case JobEMQXSync:
+		report, err = js.syncExperiment(experimentId)
+	case JobEMQXReconcile:
+		_, report, err = NewExperimentService(js.AppConfig).ApplyEMQX(experimentId)
+	default:
+		err = fmt.Errorf("%w: unknown job type %q", config.ErrValidation, jobType)
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{"updatedAt": now, "report": report}
+	switch {
+	case err == nil:
+		set["status"] = JobSucceeded
+		set["finishedAt"] = now
+		set["lastError"] = nil
+	case errors.Is(err, config.ErrNotFound), errors.Is(err, config.ErrValidation), attempts(job) >= maxAttempts(job):
+		// retrying cannot fix a deleted experiment or an invalid job
+		set["status"] = JobDead
+		set["finishedAt"] = now
+		set["lastError"] = err.Error()
+		log.Println("job", oid.Hex(), "is dead:", err)
+	default:
+		set["status"] = JobRetrying
+		set["nextRunAt"] = now.Add(js.backoff(attempts(job)))
+		set["lastError"] = err.Error()
+	}
+	// the status filter ignores the result if the job was taken over meanwhile
+	filter := bson.M{"_id": oid, "status": JobRunning, "lockedAt": job["lockedAt"]}
+	if _, errUpdate := js.AppConfig.Mongo.PatchData(filter, bson.M{"$set": set, "$unset": bson.M{"lockedAt": ""}}, jobsCollection); errUpdate != nil {
+		log.Println("error while saving job", oid.Hex(), ":", errUpdate)
+	}
+}
+
+// syncExperiment provisions EMQX from the experiment as currently stored.
+func (js *JobService) syncExperiment(experimentId string) (*SyncReport, error) {
+	es := NewExperimentService(js.AppConfig)
+	completeExperiment, err := es.GetCompleteExperimentById(experimentId)
+	if err != nil {
+		return nil, err
+	}
+	return es.syncEMQX(experimentId, completeExperiment)
+}
+
+// backoff doubles the delay at each attempt up to the configured maximum, with
+// up to 20% jitter so failed jobs do not retry in lockstep.
+func (js *JobService) backoff(attempt int) time.Duration {
+	base, limit, _, _ := js.AppConfig.Settings.Jobs.Durations()
+	delay := base
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+func attempts(job bson.M) int {
+	return toInt(job["attempts"])
+}
+
+func maxAttempts(job bson.M) int {
+	return toInt(job["maxAttempts"])
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"qiot-configuration-service/config"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestEnqueue(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	oid := primitive.NewObjectID()
+	job := mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: oid}, {Key: "status", Value: JobRetrying}}})
+	duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+
+	tests := []struct {
+		name      string
+		responses []bson.D
+		commands  int
+	}{
+		{name: "pending job reused", responses: []bson.D{job}, commands: 1},
+		{name: "concurrent enqueue", responses: []bson.D{duplicate, job}, commands: 2},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+			settings := &config.Settings{Jobs: config.JobSettings{MaxAttempts: 5}}
+			js := &JobService{AppConfig: &config.AppConfiguration{Settings: settings, Mongo: &config.MongoClient{Database: mt.DB}}}
+
+			id, err := js.Enqueue(JobEMQXSync, "e1")
+			if err != nil || id != oid.Hex() {
+				mt.Fatalf("Enqueue = %q, %v, want %s", id, err, oid.Hex())
+			}
+			events := mt.GetAllStartedEvents()
+			if len(events) != tt.commands {
+				mt.Fatalf("%d commands, want %d", len(events), tt.commands)
+			}
+			for _, e := range events {
+				command := e.Command
+				if e.CommandName != "findAndModify" || !command.Lookup("upsert").Boolean() {
+					mt.Errorf("command %s, want an upsert", command)
+				}
+				status := []string{}
+				values, _ := command.Lookup("query", "status", "$in").Array().Values()
+				for _, v := range values {
+					status = append(status, v.StringValue())
+				}
+				if !slices.Equal(status, []string{JobQueued, JobRetrying}) {
+					mt.Errorf("status filter %v, want the queued and retrying jobs", status)
+				}
+				if command.Lookup("update", "$setOnInsert", "status").StringValue() != JobQueued {
+					mt.Errorf("update %s, want a queued job inserted", command.Lookup("update"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"regexp"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const mqttCredentialsCollection = "mqttCredentials"
+
+// defaultGateway names the single gateway of experiments not listing "gateways".
+const defaultGateway = "gateway"
+
+var gatewayName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// MQTTCredential is the EMQX login of one gateway of an experiment. Passwords
+// are kept in their own collection and only returned when issued and in the
+// gateway configuration download.
+type MQTTCredential struct {
+	Gateway   string    `json:"gateway" bson:"gateway"`
+	Username  string    `json:"username" bson:"username"`
+	Password  string    `json:"password" bson:"password"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// experimentGateways returns the gateway names declared by an experiment document.
+func experimentGateways(experiment bson.M) ([]string, error) {
+	value, ok := experiment["gateways"]
+	if !ok || value == nil {
+		return []string{defaultGateway}, nil
+	}
+	var items []interface{}
+	switch list := value.(type) {
+	case primitive.A:
+		items = list
+	case []interface{}:
+		items = list
+	default:
+		return nil, fmt.Errorf("%w: gateways must be a list of names", config.ErrValidation)
+	}
+	gateways := []string{}
+	for _, item := range items {
+		name, _ := item.(string)
+		if !gatewayName.MatchString(name) {
+			return nil, fmt.Errorf("%w: invalid gateway name %v (letters, digits, _ and -)", config.ErrValidation, item)
+		}
+		if !slices.Contains(gateways, name) {
+			gateways = append(gateways, name)
+		}
+	}
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("%w: gateways must not be empty", config.ErrValidation)
+	}
+	return gateways, nil
+}
+
+// issueCredentials creates the credentials of the gateways that have none and
+// revokes those of the gateways no longer listed. It returns the new
+// credentials; EMQX is updated by the provisioning job. Completed and archived
+// experiments are not provisioned and keep their credentials revoked.
+func (es *ExperimentService) issueCredentials(experimentId string, status string, gateways []string) ([]MQTTCredential, error) {
+	if status == StatusCompleted || status == StatusArchived {
+		return []MQTTCredential{}, nil
+	}
+	active, err := es.credentials(experimentId, false)
+	if err != nil {
+		return nil, err
+	}
+	issued := []MQTTCredential{}
+	now := time.Now().UTC()
+	for _, gateway := range gateways {
+		if slices.ContainsFunc(active, func(c bson.M) bool { return rulegen.GetString(c, "gateway") == gateway }) {
+			continue
+		}
+		password, err := newPassword()
+		if err != nil {
+			return nil, err
+		}
+		credential := MQTTCredential{Gateway: gateway, Username: experimentId + "_" + gateway, Password: password, CreatedAt: now}
+		_, err = es.AppConfig.Mongo.InsertData(bson.M{
+			"experimentId": experimentId,
+			"gateway":      credential.Gateway,
+			"username":     credential.Username,
+			"password":     credential.Password,
+			"createdAt":    credential.CreatedAt,
+		}, mqttCredentialsCollection)
+		if err != nil {
+			return nil, err
+		}
+		issued = append(issued, credential)
+	}
+	for _, c := range active {
+		if !slices.Contains(gateways, rulegen.GetString(c, "gateway")) {
+			if _, err := es.AppConfig.Mongo.PatchData(bson.M{"_id": c["_id"]}, bson.M{"$set": bson.M{"revokedAt": now}}, mqttCredentialsCollection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return issued, nil
+}
+
+// GatewayCredentials returns the active credentials of the experiment gateways.
+func (es *ExperimentService) GatewayCredentials(experimentId string) ([]MQTTCredential, error) {
+	active, err := es.credentials(experimentId, false)
+	if err != nil {
+		return nil, err
+	}
+	result := []MQTTCredential{}
+	for _, c := range active {
+		createdAt, _ := toTime(c["createdAt"])
+		result = append(result, MQTTCredential{
+			Gateway:   rulegen.GetString(c, "gateway"),
+			Username:  rulegen.GetString(c, "username"),
+			Password:  rulegen.GetString(c, "password"),
+			CreatedAt: createdAt,
+		})
+	}
+	return result, nil
+}
+
+// provisionCredentials creates the EMQX users of the active credentials, with an
+// ACL allowing them to publish only on the experiment topics, and removes the
+// users of the revoked ones. Every call is recorded in the report.
+func (es *ExperimentService) provisionCredentials(experimentId string, report *SyncReport) {
+	active, err := es.credentials(experimentId, false)
+	if err != nil {
+		report.fail(fmt.Errorf("listing MQTT credentials: %w", err))
+		return
+	}
+	for _, c := range active {
+		gateway, username := rulegen.GetString(c, "gateway"), rulegen.GetString(c, "username")
+		filters, err := es.AppConfig.Topics.ACLFilters(experimentId, gateway)
+		if err != nil {
+			report.fail(err)
+			return
+		}
+		rules := []ACLRule{}
+		for _, filter := range filters {
+			rules = append(rules, ACLRule{Topic: filter, Permission: "allow", Action: "publish"})
+		}
+		rules = append(rules, ACLRule{Topic: "#", Permission: "deny", Action: "all"})
+		item, err := es.EMQX.CreateEMQXUser(username, rulegen.GetString(c, "password"))
+		report.add(item, err)
+		if err != nil {
+			continue
+		}
+		report.add(es.EMQX.SetEMQXUserACL(username, rules))
+	}
+	revoked, err := es.credentials(experimentId, true)
+	if err != nil {
+		report.fail(fmt.Errorf("listing MQTT credentials: %w", err))
+		return
+	}
+	for _, c := range revoked {
+		report.add(es.EMQX.DeleteEMQXUserACL(rulegen.GetString(c, "username")))
+		report.add(es.EMQX.DeleteEMQXUser(rulegen.GetString(c, "username")))
+	}
+}
+
+// revokeCredentials revokes every credential of the experiment and deletes the
+// EMQX users, so its gateways can no longer publish.
+func (es *ExperimentService) revokeCredentials(experimentId string) error {
+	now := time.Now().UTC()
+	_, err := es.AppConfig.Mongo.PatchData(bson.M{"experimentId": experimentId, "revokedAt": nil}, bson.M{"$set": bson.M{"revokedAt": now}}, mqttCredentialsCollection)
+	if err != nil {
+		return err
+	}
+	revoked, err := es.credentials(experimentId, true)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, c := range revoked {
+		username := rulegen.GetString(c, "username")
+		if _, err := es.EMQX.DeleteEMQXUserACL(username); err != nil {
+			errs = append(errs, fmt.Errorf("ACL of %s: %w", username, err))
+		}
+		if _, err := es.EMQX.DeleteEMQXUser(username); err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", username, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", config.ErrUpstream, errors.Join(errs...))
+	}
+	return nil
+}
+
+// deleteCredentials revokes the credentials of a deleted experiment and drops them.
+func (es *ExperimentService) deleteCredentials(experimentId string) error {
+	if err := es.revokeCredentials(experimentId); err != nil {
+		return err
+	}
+	_, err := es.AppConfig.Mongo.DeleteData(bson.M{"experimentId": experimentId}, mqttCredentialsCollection)
+	if errors.Is(err, config.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (es *ExperimentService) credentials(experimentId string, revoked bool) ([]bson.M, error) {
+	filter := bson.M{"experimentId": experimentId, "revokedAt": nil}
+	if revoked {
+		filter["revokedAt"] = bson.M{"$ne": nil}
+	}
+	return es.AppConfig.Mongo.ExecuteSelectionQuery(filter, mqttCredentialsCollection)
+}
+
+func newPassword() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
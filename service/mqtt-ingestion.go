@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"log"
+	"maps"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/ingest"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// influxWriteTimeout bounds the write of the points of one message.
+const influxWriteTimeout = 10 * time.Second
+
+// MQTTSubscriber is the part of an MQTT client used by the built-in ingestion.
+// Handlers may be called concurrently.
+type MQTTSubscriber interface {
+	Subscribe(filter string, handler func(topic string, payload []byte)) error
+	Unsubscribe(filters ...string) error
+}
+
+// PointWriter writes points to an Influx bucket; the blocking write API of the
+// Influx client implements it.
+type PointWriter interface {
+	WritePoint(ctx context.Context, point ...*write.Point) error
+}
+
+// IngestionWorker is the built-in ingestion: it subscribes to the topics of the
+// running experiments and writes their messages to Influx, applying the rules
+// EMQX would run (see package ingest).
+type IngestionWorker struct {
+	AppConfig  *config.AppConfiguration
+	Subscriber MQTTSubscriber
+	// Writer returns the writer of an Influx org and bucket.
+	Writer func(org string, bucket string) PointWriter
+
+	mu     sync.Mutex
+	routes map[string][]ingestionRoute
+}
+
+// ingestionRoute is a definition subscribed on a topic and the bucket its points go to.
+type ingestionRoute struct {
+	definition rulegen.Definition
+	org        string
+	bucket     string
+}
+
+// NewIngestionWorker connects to the broker configured in the ingestion settings
+// and writes through the Influx client of the configuration.
+func NewIngestionWorker(appConfig *config.AppConfiguration) *IngestionWorker {
+	return &IngestionWorker{
+		AppConfig:  appConfig,
+		Subscriber: NewMQTTSubscriber(appConfig.Settings.Ingestion),
+		Writer: func(org string, bucket string) PointWriter {
+			return appConfig.Influx.Client.WriteAPIBlocking(org, bucket)
+		},
+		routes: map[string][]ingestionRoute{},
+	}
+}
+
+// Start refreshes the subscriptions now and then at every refresh interval,
+// until ctx is done.
+func (w *IngestionWorker) Start(ctx context.Context) {
+	interval, _ := time.ParseDuration(w.AppConfig.Settings.Ingestion.RefreshInterval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := w.Refresh(); err != nil {
+				log.Println("error while refreshing MQTT ingestion:", err)
+			}
+			select {
+			case <-ctx.Done():
+				w.unsubscribeAll()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Refresh subscribes to the topics of the running experiments and unsubscribes
+// from the others. Experiments that cannot be loaded are skipped.
+func (w *IngestionWorker) Refresh() error {
+	experiments, err := w.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"status": bson.M{"$in": statusFilter([]string{StatusRunning})}}, "experiments")
+	if err != nil {
+		return err
+	}
+	es := NewExperimentService(w.AppConfig)
+	routes := map[string][]ingestionRoute{}
+	for _, experiment := range experiments {
+		oid, ok := experiment["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		completeExperiment, err := es.GetCompleteExperimentById(oid.Hex())
+		if err != nil {
+			log.Printf("MQTT ingestion: skipping experiment %s: %v", oid.Hex(), err)
+			continue
+		}
+		target := w.AppConfig.TargetFor(completeExperiment)
+		for _, d := range rulegen.Generate(completeExperiment) {
+			routes[d.Topic] = append(routes[d.Topic], ingestionRoute{definition: d, org: target.Org, bucket: target.Bucket})
+		}
+	}
+	w.setRoutes(routes)
+	return nil
+}
+
+// setRoutes subscribes to the topics of routes and unsubscribes from the
+// topics no longer routed.
+func (w *IngestionWorker) setRoutes(routes map[string][]ingestionRoute) {
+	w.mu.Lock()
+	previous := w.routes
+	w.routes = routes
+	w.mu.Unlock()
+
+	removed := []string{}
+	for filter := range previous {
+		if _, ok := routes[filter]; !ok {
+			removed = append(removed, filter)
+		}
+	}
+	if len(removed) > 0 {
+		if err := w.Subscriber.Unsubscribe(removed...); err != nil {
+			log.Println("MQTT ingestion: unsubscribe:", err)
+		}
+	}
+	for _, filter := range slices.Sorted(maps.Keys(routes)) {
+		if _, ok := previous[filter]; ok {
+			continue
+		}
+		if err := w.Subscriber.Subscribe(filter, func(_ string, payload []byte) { w.handle(filter, payload) }); err != nil {
+			log.Printf("MQTT ingestion: subscribe %s: %v", filter, err)
+			// retried at the next refresh
+			w.mu.Lock()
+			delete(w.routes, filter)
+			w.mu.Unlock()
+		}
+	}
+}
+
+// handle writes the points of a message received on a subscribed filter.
+func (w *IngestionWorker) handle(filter string, payload []byte) {
+	w.mu.Lock()
+	routes := w.routes[filter]
+	w.mu.Unlock()
+	now := time.Now().UTC()
+	for _, route := range routes {
+		points, err := ingest.Points(route.definition, payload, now)
+		if err != nil {
+			log.Println("MQTT ingestion:", err)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), influxWriteTimeout)
+		if err := w.Writer(route.org, route.bucket).WritePoint(ctx, points...); err != nil {
+			log.Printf("MQTT ingestion: writing %s: %v", route.definition.Measurement, err)
+		}
+		cancel()
+	}
+}
+
+func (w *IngestionWorker) unsubscribeAll() {
+	w.mu.Lock()
+	filters := slices.Collect(maps.Keys(w.routes))
+	w.routes = map[string][]ingestionRoute{}
+	w.mu.Unlock()
+	if len(filters) > 0 {
+		if err := w.Subscriber.Unsubscribe(filters...); err != nil {
+			log.Println("MQTT ingestion: unsubscribe:", err)
+		}
+	}
+}
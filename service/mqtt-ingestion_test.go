@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"maps"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/ingest/mqtttest"
+	"qiot-configuration-service/rulegen"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// written is a batch of points written by the built-in ingestion.
+type written struct {
+	org    string
+	bucket string
+	lines  []string
+}
+
+type fakePointWriter struct {
+	org     string
+	bucket  string
+	written chan<- written
+}
+
+func (f fakePointWriter) WritePoint(_ context.Context, points ...*write.Point) error {
+	lines := []string{}
+	for _, p := range points {
+		// without the timestamp, the time of reception
+		line := write.PointToLineProtocol(p, time.Second)
+		lines = append(lines, line[:strings.LastIndexByte(line, ' ')])
+	}
+	f.written <- written{org: f.org, bucket: f.bucket, lines: lines}
+	return nil
+}
+
+// waitFor polls condition until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIngestionWorker(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	writes := make(chan written, 10)
+	w := &IngestionWorker{
+		Subscriber: NewMQTTSubscriber(config.IngestionSettings{BrokerURL: broker.URL(), ClientID: "ingestion-test"}),
+		Writer: func(org string, bucket string) PointWriter {
+			return fakePointWriter{org: org, bucket: bucket, written: writes}
+		},
+		routes: map[string][]ingestionRoute{},
+	}
+
+	experiment := testExperiment("665f1c2e8b3e4a0012345678", StatusRunning)
+	routes := map[string][]ingestionRoute{}
+	for _, d := range rulegen.Generate(experiment) {
+		routes[d.Topic] = append(routes[d.Topic], ingestionRoute{definition: d, org: "org", bucket: "bucket"})
+	}
+	topics := slices.Sorted(maps.Keys(routes))
+	if len(topics) == 0 {
+		t.Fatal("the test experiment has no topics")
+	}
+	w.setRoutes(routes)
+	waitFor(t, "the subscriptions", func() bool { return slices.Equal(broker.Subscriptions(), topics) })
+
+	topic := "qiot/665f1c2e8b3e4a0012345678/thermo/aabbccddee01/temperature"
+	broker.Publish("qiot/unrelated", []byte(`{}`))
+	broker.Publish(topic, []byte(`{"APP_TAG_NAME": "app", "deviceAddress": "AA:01", "deviceName": "thermo", "gatewayName": "gw1", "gatewayBattery": 87, "rssi": -60, "temperature": 21.5}`))
+	select {
+	case got := <-writes:
+		if got.org != "org" || got.bucket != "bucket" {
+			t.Errorf("written to %s/%s, want org/bucket", got.org, got.bucket)
+		}
+		want := []string{"thermo_temperature,appTagName=app,deviceAddress=AA:01,deviceName=thermo,experimentId=665f1c2e8b3e4a0012345678,gatewayName=gw1 gatewayBattery=87i,rssi=-60i,temperature=21.5"}
+		if !slices.Equal(got.lines, want) {
+			t.Errorf("written %v, want %v", got.lines, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the points")
+	}
+
+	// a message without a value is not written
+	broker.Publish(topic, []byte(`not json`))
+	w.setRoutes(map[string][]ingestionRoute{})
+	waitFor(t, "the unsubscriptions", func() bool { return len(broker.Subscriptions()) == 0 })
+	select {
+	case got := <-writes:
+		t.Errorf("unexpected write %v", got.lines)
+	default:
+	}
+}
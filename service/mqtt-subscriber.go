@@ -0,0 +1,91 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"qiot-configuration-service/config"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttTimeout bounds the wait for a subscribe or unsubscribe acknowledgement.
+const mqttTimeout = 10 * time.Second
+
+// pahoSubscriber implements MQTTSubscriber with the Paho client. It reconnects
+// by itself and subscribes again to every filter once connected.
+type pahoSubscriber struct {
+	client mqtt.Client
+
+	mu       sync.Mutex
+	handlers map[string]mqtt.MessageHandler
+}
+
+// NewMQTTSubscriber returns a subscriber connecting, in the background, to the
+// broker of the ingestion settings.
+func NewMQTTSubscriber(settings config.IngestionSettings) MQTTSubscriber {
+	s := &pahoSubscriber{handlers: map[string]mqtt.MessageHandler{}}
+	options := mqtt.NewClientOptions().
+		AddBroker(settings.BrokerURL).
+		SetClientID(settings.ClientID).
+		SetUsername(settings.Username).
+		SetPassword(settings.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(s.resubscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Println("MQTT ingestion: connection lost:", err)
+		})
+	s.client = mqtt.NewClient(options)
+	s.client.Connect()
+	return s
+}
+
+// Subscribe registers the handler of a filter; while disconnected the
+// subscription is made when the connection is established.
+func (s *pahoSubscriber) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	messageHandler := func(_ mqtt.Client, message mqtt.Message) {
+		handler(message.Topic(), message.Payload())
+	}
+	s.mu.Lock()
+	s.handlers[filter] = messageHandler
+	s.mu.Unlock()
+	if !s.client.IsConnectionOpen() {
+		return nil
+	}
+	return wait(s.client.Subscribe(filter, 1, messageHandler))
+}
+
+func (s *pahoSubscriber) Unsubscribe(filters ...string) error {
+	s.mu.Lock()
+	for _, filter := range filters {
+		delete(s.handlers, filter)
+	}
+	s.mu.Unlock()
+	if !s.client.IsConnectionOpen() {
+		return nil
+	}
+	return wait(s.client.Unsubscribe(filters...))
+}
+
+func (s *pahoSubscriber) resubscribe(client mqtt.Client) {
+	log.Println("MQTT ingestion: connected")
+	s.mu.Lock()
+	handlers := maps.Clone(s.handlers)
+	s.mu.Unlock()
+	for filter, handler := range handlers {
+		if err := wait(client.Subscribe(filter, 1, handler)); err != nil {
+			log.Printf("MQTT ingestion: subscribe %s: %v", filter, err)
+		}
+	}
+}
+
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("%w: no answer from the MQTT broker", config.ErrTimeout)
+	}
+	return token.Error()
+}
@@ -0,0 +1,19 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"qiot-configuration-service/config"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// parseObjectId converts an id received from the API, reporting malformed ids as validation errors.
+func parseObjectId(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("ID non valido:", err)
+		return primitive.NilObjectID, fmt.Errorf("%w: invalid id %q", config.ErrValidation, id)
+	}
+	return oid, nil
+}
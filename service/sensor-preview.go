@@ -0,0 +1,266 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/ingest"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/structparser"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Payload encodings accepted by the parser preview.
+const (
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+	EncodingJSON   = "json"
+)
+
+// PreviewRequest is a sample MQTT message of a characteristic (raw bytes as hex
+// or base64, decoded with its structParser by package structparser) or of a
+// Movesense measure (JSON). Envelope holds the values the gateway adds around the
+// sensor values (gatewayName, rssi...); ExperimentID and MACAddress fill the topic and tags.
+type PreviewRequest struct {
+	Characteristic string                 `json:"characteristic"`
+	Measure        string                 `json:"measure"`
+	Payload        interface{}            `json:"payload"`
+	Encoding       string                 `json:"encoding"`
+	Envelope       map[string]interface{} `json:"envelope"`
+	ExperimentID   string                 `json:"experimentId"`
+	MACAddress     string                 `json:"macAddress"`
+}
+
+// PreviewPoint is a point the pipeline would write.
+type PreviewPoint struct {
+	Tags   map[string]string      `json:"tags"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// PreviewResult shows what the pipeline would do with a sample message: the
+// JSON message the rule receives and the points written, as line protocol.
+// Errors lists the values that would not be written.
+type PreviewResult struct {
+	Source       string                 `json:"source"`
+	Parser       string                 `json:"parser"`
+	Topic        string                 `json:"topic"`
+	Measurement  string                 `json:"measurement"`
+	Decoded      map[string]interface{} `json:"decoded,omitempty"`
+	Message      interface{}            `json:"message"`
+	LineProtocol []string               `json:"lineProtocol"`
+	Points       []PreviewPoint         `json:"points"`
+	Errors       []string               `json:"errors"`
+	Warnings     []string               `json:"warnings"`
+}
+
+// PreviewParser runs a sample message of a characteristic or measure of the
+// sensor through its parser, as the EMQX rule (or the built-in ingestion) would.
+func (ss *SensorService) PreviewParser(sensorId string, request PreviewRequest) (*PreviewResult, error) {
+	if (request.Characteristic == "") == (request.Measure == "") {
+		return nil, fmt.Errorf("%w: give either characteristic or measure", config.ErrValidation)
+	}
+	sensor, err := ss.GetSensorById(sensorId)
+	if err != nil {
+		return nil, err
+	}
+	if err := NewGatewayProfileService(ss.AppConfig).ResolveGateway(sensor); err != nil {
+		return nil, err
+	}
+	experimentId := request.ExperimentID
+	if experimentId == "" {
+		experimentId = "preview"
+	}
+	mac := request.MACAddress
+	if mac == "" {
+		mac = "00:00:00:00:00:00"
+	}
+	definition, characteristic, err := ss.previewDefinition(sensor, experimentId, mac, request)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PreviewResult{
+		Source:       definition.Source,
+		Parser:       definition.Parser,
+		Topic:        definition.Topic,
+		Measurement:  definition.Measurement,
+		LineProtocol: []string{},
+		Points:       []PreviewPoint{},
+		Errors:       []string{},
+		Warnings:     []string{},
+	}
+	var message interface{}
+	if characteristic != nil {
+		raw, err := decodeRaw(request.Payload, request.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		layout, err := structparser.Parse(characteristic["structParser"])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+		}
+		decoded, read, err := layout.Decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+		}
+		if read < len(raw) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%d trailing bytes not read by the structParser", len(raw)-read))
+		}
+		for _, f := range layout.Fields {
+			if f.Type == structparser.TypeBlock {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("block %s is decoded but not written to Influx", f.Name))
+			}
+		}
+		result.Decoded = decoded
+		message = maps.Clone(decoded)
+	} else {
+		message, err = decodeJSONPayload(request.Payload, request.Encoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the gateway publishes the envelope values next to the sensor values
+	if object, ok := message.(map[string]interface{}); ok {
+		for name, value := range request.Envelope {
+			if _, exists := object[name]; !exists {
+				object[name] = value
+			}
+		}
+	} else if len(request.Envelope) > 0 {
+		result.Warnings = append(result.Warnings, "the payload is not an object: envelope values ignored")
+	}
+	// round trip through JSON, so values are read exactly as from a published message
+	bs, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+	}
+	if message, err = ingest.DecodeMessage(bs); err != nil {
+		return nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+	}
+	result.Message = message
+
+	points, errs := ingest.Evaluate(definition, message, time.Now().UTC())
+	for _, err := range errs {
+		result.Errors = append(result.Errors, err.Error())
+	}
+	for _, name := range ingest.MissingTags(definition, message) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("tag %s has no value in the message and is not written", name))
+	}
+	for _, p := range points {
+		result.LineProtocol = append(result.LineProtocol, strings.TrimSpace(write.PointToLineProtocol(p, time.Nanosecond)))
+		point := PreviewPoint{Tags: map[string]string{}, Fields: map[string]interface{}{}}
+		for _, t := range p.TagList() {
+			point.Tags[t.Key] = t.Value
+		}
+		for _, f := range p.FieldList() {
+			point.Fields[f.Key] = f.Value
+		}
+		result.Points = append(result.Points, point)
+	}
+	return result, nil
+}
+
+// previewDefinition generates the rule of the requested source for a one-device
+// experiment; for a characteristic it also returns the characteristic document.
+func (ss *SensorService) previewDefinition(sensor bson.M, experimentId string, mac string, request PreviewRequest) (rulegen.Definition, bson.M, error) {
+	sensorName := rulegen.GetString(sensor, "name")
+	if rulegen.GetString(sensor, "shortName") == "" {
+		return rulegen.Definition{}, nil, fmt.Errorf("%w: sensor %s has no shortName, no measurement can be named", config.ErrValidation, sensorName)
+	}
+	var characteristic bson.M
+	services := []primitive.M{}
+	for _, service := range rulegen.Documents(sensor["services"]) {
+		characteristics := []primitive.M{}
+		for _, c := range rulegen.Documents(service["characteristics"]) {
+			if characteristic != nil || rulegen.GetString(c, "name") != request.Characteristic {
+				continue
+			}
+			mqttTopic, err := ss.AppConfig.Topics.Characteristic(experimentId, sensorName, mac, rulegen.GetString(service, "uuid"), rulegen.GetString(c, "name"), "")
+			if err != nil {
+				return rulegen.Definition{}, nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+			}
+			characteristic = bson.M{"name": c["name"], "uuid": c["uuid"], "structParser": c["structParser"], "mqttTopic": mqttTopic}
+			characteristics = append(characteristics, characteristic)
+		}
+		services = append(services, primitive.M{"uuid": service["uuid"], "characteristics": characteristics})
+	}
+	measures := []bson.M{}
+	if mw, ok := sensor["movesense_whiteboard"].(bson.M); ok {
+		for _, m := range rulegen.Documents(mw["measures"]) {
+			if len(measures) > 0 || rulegen.GetString(m, "name") != request.Measure {
+				continue
+			}
+			mqttTopic, err := ss.AppConfig.Topics.Measure(experimentId, sensorName, mac, rulegen.GetString(m, "name"), "")
+			if err != nil {
+				return rulegen.Definition{}, nil, fmt.Errorf("%w: %w", config.ErrValidation, err)
+			}
+			m["mqttTopic"] = mqttTopic
+			measures = append(measures, m)
+		}
+	}
+	device := maps.Clone(sensor)
+	device["services"] = services
+	device["movesense_whiteboard"] = bson.M{"measures": measures}
+	experiment := bson.M{"experimentId": experimentId, "devices": bson.M{sensorName: device}}
+
+	for _, d := range rulegen.Generate(experiment) {
+		if (request.Characteristic != "") == (d.Parser == rulegen.StructParser) {
+			return d, characteristic, nil
+		}
+	}
+	if request.Characteristic != "" {
+		return rulegen.Definition{}, nil, fmt.Errorf("characteristic %q with a structParser on sensor %s: %w", request.Characteristic, sensorName, config.ErrNotFound)
+	}
+	return rulegen.Definition{}, nil, fmt.Errorf("measure %q with a parser on sensor %s: %w", request.Measure, sensorName, config.ErrNotFound)
+}
+
+// decodeRaw returns the bytes of a BLE payload given as hex (the default;
+// spaces, colons and a 0x prefix are ignored) or base64.
+func decodeRaw(payload interface{}, encoding string) ([]byte, error) {
+	text, ok := payload.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: the payload of a characteristic must be a hex or base64 string", config.ErrValidation)
+	}
+	switch encoding {
+	case "", EncodingHex:
+		text = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(text)), "0x")
+		text = strings.NewReplacer(" ", "", ":", "", "-", "").Replace(text)
+		raw, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid hex payload: %v", config.ErrValidation, err)
+		}
+		return raw, nil
+	case EncodingBase64:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid base64 payload: %v", config.ErrValidation, err)
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("%w: unknown encoding %q for a characteristic (use hex or base64)", config.ErrValidation, encoding)
+}
+
+// decodeJSONPayload returns the message of a measure: the JSON value itself,
+// or a string holding JSON text.
+func decodeJSONPayload(payload interface{}, encoding string) (interface{}, error) {
+	if encoding != "" && encoding != EncodingJSON {
+		return nil, fmt.Errorf("%w: unknown encoding %q for a measure (use json)", config.ErrValidation, encoding)
+	}
+	text, ok := payload.(string)
+	if !ok {
+		return payload, nil
+	}
+	message, err := ingest.DecodeMessage([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON payload: %v", config.ErrValidation, err)
+	}
+	return message, nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/topic"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestPreviewParser(t *testing.T) {
+	oid := primitive.NewObjectID()
+	sensor := bson.D{
+		{Key: "_id", Value: oid},
+		{Key: "name", Value: "thermometer"},
+		{Key: "shortName", Value: "thermo"},
+		{Key: "services", Value: bson.A{bson.D{
+			{Key: "uuid", Value: "180a"},
+			{Key: "characteristics", Value: bson.A{bson.D{
+				{Key: "name", Value: "Temperature"},
+				{Key: "structParser", Value: bson.D{{Key: "fields", Value: bson.A{
+					bson.D{{Key: "name", Value: "temperature"}, {Key: "type", Value: "int16"}, {Key: "scale", Value: 0.01}},
+					bson.D{{Key: "name", Value: "humidity"}, {Key: "type", Value: "uint8"}},
+				}}}},
+			}}},
+		}}},
+		{Key: "movesense_whiteboard", Value: bson.D{{Key: "measures", Value: bson.A{bson.D{
+			{Key: "name", Value: "Meas/HR"},
+			{Key: rulegen.JSONPayloadParser, Value: bson.D{{Key: "fields", Value: bson.A{
+				bson.D{{Key: "name", Value: "average"}, {Key: "path", Value: "Body.average"}, {Key: "type", Value: "float"}},
+			}}}},
+		}}}}},
+	}
+
+	tests := []struct {
+		name    string
+		request PreviewRequest
+		want    []string
+		errors  []string
+	}{
+		{
+			name: "hex characteristic",
+			request: PreviewRequest{
+				Characteristic: "Temperature",
+				Payload:        "0x3408 2d",
+				Envelope:       map[string]interface{}{"gatewayName": "gw1", "gatewayBattery": 87, "rssi": -60},
+				ExperimentID:   "e1",
+				MACAddress:     "AA:BB:CC:DD:EE:01",
+			},
+			want: []string{"thermo_temperature,experimentId=e1,gatewayName=gw1 gatewayBattery=87i,humidity=45u,rssi=-60i,temperature=21"},
+		},
+		{
+			name: "json measure",
+			request: PreviewRequest{
+				Measure:  "Meas/HR",
+				Payload:  `{"Body": {"average": 72.5}}`,
+				Envelope: map[string]interface{}{"deviceName": "thermometer"},
+			},
+			want: []string{"thermo_meashr,deviceName=thermometer,experimentId=preview average=72.5"},
+			// the default envelope selects the whole payload, as the rules created before envelopes
+			errors: []string{"field gatewayBattery: "},
+		},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.sensors", mtest.FirstBatch, sensor))
+			ss := &SensorService{AppConfig: &config.AppConfiguration{Mongo: &config.MongoClient{Database: mt.DB}, Topics: topic.Legacy()}}
+
+			result, err := ss.PreviewParser(oid.Hex(), tt.request)
+			if err != nil {
+				mt.Fatalf("PreviewParser: %v", err)
+			}
+			got := []string{}
+			for _, line := range result.LineProtocol {
+				// without the timestamp, the time of the preview
+				got = append(got, line[:strings.LastIndexByte(line, ' ')])
+			}
+			if !slices.Equal(got, tt.want) {
+				mt.Errorf("line protocol = %v, want %v", got, tt.want)
+			}
+			if len(result.Errors) != len(tt.errors) {
+				mt.Fatalf("errors = %v, want %v", result.Errors, tt.errors)
+			}
+			for i, want := range tt.errors {
+				if !strings.HasPrefix(result.Errors[i], want) {
+					mt.Errorf("error %q, want %q", result.Errors[i], want)
+				}
+			}
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"maps"
 	"qiot-configuration-service/config"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/structparser"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -28,15 +32,17 @@ func (ss *SensorService) GetAllSensors() ([]bson.M, error) {
 }
 
 func (ss *SensorService) GetSensorById(id string) (bson.M, error) {
-	oid, err2 := primitive.ObjectIDFromHex(id)
+	oid, err2 := parseObjectId(id)
 	if err2 != nil {
-		log.Println("ID non valido:", err2)
 		return nil, err2
 	}
 	sensorList, err := ss.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid})
-	if err != nil || len(sensorList) == 0 {
+	if err != nil {
 		return nil, err
 	}
+	if len(sensorList) == 0 {
+		return nil, fmt.Errorf("sensor %s: %w", oid.Hex(), config.ErrNotFound)
+	}
 	sensor := sensorList[0]
 	if _, ok := sensor["dynamicSchema"]; ok {
 		//delete(sensor, "dynamicSchema")
@@ -49,7 +55,34 @@ func (ss *SensorService) GetSensorById(id string) (bson.M, error) {
 	}
 	return sensor, nil
 }
+
+// GetNormalizedSensor returns a sensor with the structParser of its
+// characteristics in the canonical form of package structparser: explicit
+// types, endianness, sizes and byte offsets. A structParser that does not
+// parse is returned as stored.
+func (ss *SensorService) GetNormalizedSensor(id string) (bson.M, error) {
+	sensor, err := ss.GetSensorById(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range rulegen.Documents(sensor["services"]) {
+		for _, characteristic := range rulegen.Documents(service["characteristics"]) {
+			sp, ok := characteristic["structParser"]
+			if !ok {
+				continue
+			}
+			if layout, err := structparser.Parse(sp); err == nil {
+				characteristic["structParser"] = layout
+			}
+		}
+	}
+	return sensor, nil
+}
+
 func (ss *SensorService) InsertSensor(data bson.M) (InsertedId interface{}, err error) {
+	if err := ss.validateSensor(data); err != nil {
+		return nil, err
+	}
 	inserted, errConfiguration := ss.AppConfig.Mongo.InsertData(data)
 	if errConfiguration != nil {
 		return nil, errConfiguration
@@ -57,47 +90,126 @@ func (ss *SensorService) InsertSensor(data bson.M) (InsertedId interface{}, err
 	return inserted, nil
 }
 func (ss *SensorService) EditSensorConfiguration(sensorId string, data bson.M) (int64, error) {
-	oid, err2 := primitive.ObjectIDFromHex(sensorId)
+	oid, err2 := parseObjectId(sensorId)
 	if err2 != nil {
-		log.Println("ID non valido:", err2)
 		return -1, err2
 	}
+	if err := ss.validateSensor(data); err != nil {
+		return -1, err
+	}
 	modifiedCount, errUpdate := ss.AppConfig.Mongo.UpdateData(
 		bson.M{"_id": oid},
 		data,
 	)
-	if errUpdate != nil || modifiedCount == 0 {
+	if errUpdate != nil {
 		return -1, errUpdate
 	}
 	return modifiedCount, nil
 }
 
+// validateSensor rejects sensors with an invalid structParser or gateway
+// envelope, or referencing a missing gateway profile.
+func (ss *SensorService) validateSensor(data bson.M) error {
+	if err := rulegen.ValidateSensor(data); err != nil {
+		return fmt.Errorf("%w: %w", config.ErrValidation, err)
+	}
+	if name, ok := data["gatewayProfile"].(string); ok {
+		if _, err := NewGatewayProfileService(ss.AppConfig).GetGatewayProfile(name); err != nil {
+			return fmt.Errorf("%w: %w", config.ErrValidation, err)
+		}
+	}
+	return nil
+}
+
+// DeleteSensor removes a sensor. A sensor used by an experiment is only removed
+// when force is set, in which case its devices are also pulled from those
+// experiments and their EMQX rules and actions are reconciled in the background.
+func (ss *SensorService) DeleteSensor(sensorId string, force bool) error {
+	oid, err := parseObjectId(sensorId)
+	if err != nil {
+		return err
+	}
+	sensorList, err := ss.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if len(sensorList) == 0 {
+		return fmt.Errorf("sensor %s: %w", sensorId, config.ErrNotFound)
+	}
+	usedBy, err := ss.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"devices.sensorId": sensorId}, "experiments")
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	if len(usedBy) > 0 {
+		if !force {
+			return fmt.Errorf("%w: sensor %s is used by %d experiment(s)", config.ErrConflict, sensorId, len(usedBy))
+		}
+		_, err = ss.AppConfig.Mongo.PatchData(
+			bson.M{"devices.sensorId": sensorId},
+			bson.M{"$pull": bson.M{"devices": bson.M{"sensorId": sensorId}}},
+			"experiments",
+		)
+		if err != nil {
+			return err
+		}
+		if !ss.AppConfig.Settings.Ingestion.Builtin() {
+			// the rules of the pulled devices would keep writing otherwise
+			js := NewJobService(ss.AppConfig)
+			for _, experiment := range usedBy {
+				experimentId := experiment["_id"].(primitive.ObjectID).Hex()
+				if _, err := js.Enqueue(JobEMQXReconcile, experimentId); err != nil {
+					log.Println("error while queueing EMQX reconciliation:", err)
+					errs = append(errs, fmt.Errorf("experiment %s: %w", experimentId, err))
+				}
+			}
+		}
+	}
+	if _, err := ss.AppConfig.Mongo.DeleteData(bson.M{"_id": oid}); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
 func (ss *SensorService) GetCharacteristic(sensorId string, serviceUuid string) ([]bson.M, error) {
-	oid, err2 := primitive.ObjectIDFromHex(sensorId)
+	oid, err2 := parseObjectId(sensorId)
 	if err2 != nil {
-		log.Println("ID non valido:", err2)
 		return nil, err2
 	}
 	sensorList, err := ss.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{"_id": oid})
-	if err != nil || len(sensorList) == 0 {
+	if err != nil {
 		return nil, err
 	}
+	if len(sensorList) == 0 {
+		return nil, fmt.Errorf("sensor %s: %w", oid.Hex(), config.ErrNotFound)
+	}
 	sensor := sensorList[0]
 	result := []bson.M{}
-	for _, service := range sensor["services"].(bson.A) {
-		serviceMap := service.(bson.M)
-		if serviceMap["uuid"] == serviceUuid {
-			for _, characteristic := range serviceMap["characteristics"].(bson.A) {
-				characteristicMap := characteristic.(bson.M)
-				result = append(
-					result,
-					bson.M{
-						"id":   characteristicMap["uuid"],
-						"name": characteristicMap["name"],
-					},
-				)
+	found := false
+	services, _ := sensor["services"].(bson.A)
+	for _, service := range services {
+		serviceMap, ok := service.(bson.M)
+		if !ok || serviceMap["uuid"] != serviceUuid {
+			continue
+		}
+		found = true
+		characteristics, _ := serviceMap["characteristics"].(bson.A)
+		for _, characteristic := range characteristics {
+			characteristicMap, ok := characteristic.(bson.M)
+			if !ok {
+				continue
 			}
+			result = append(
+				result,
+				bson.M{
+					"id":   characteristicMap["uuid"],
+					"name": characteristicMap["name"],
+				},
+			)
 		}
 	}
+	if !found {
+		return nil, fmt.Errorf("service %s on sensor %s: %w", serviceUuid, sensorId, config.ErrNotFound)
+	}
 	return result, nil
 }
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"cmp"
+	"maps"
+	"qiot-configuration-service/rulegen"
+	"qiot-configuration-service/topic"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TopicChange is a characteristic or measure whose topic differs between the
+// legacy naming and the configured templates. Error is set when the templates
+// give it no topic, so that it is not ingested.
+type TopicChange struct {
+	Device string `json:"device"`
+	Source string `json:"source"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TopicMigration lists the topic changes of one experiment. Error is set when
+// the topics could not be computed (e.g. a template placeholder without value).
+type TopicMigration struct {
+	ExperimentID string        `json:"experimentId"`
+	Name         string        `json:"name,omitempty"`
+	Status       string        `json:"status"`
+	Changes      []TopicChange `json:"changes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// TopicMigrationReport compares, for every experiment, the legacy topics with
+// the ones produced by the configured templates. Only experiments with changes
+// or errors are listed; their gateways must be reconfigured and their EMQX
+// rules re-applied.
+func (es *ExperimentService) TopicMigrationReport() ([]TopicMigration, error) {
+	experiments, err := es.AppConfig.Mongo.ExecuteSelectionQuery(bson.M{}, "experiments")
+	if err != nil {
+		return nil, err
+	}
+	report := []TopicMigration{}
+	for _, experiment := range experiments {
+		oid, ok := experiment["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		migration := TopicMigration{
+			ExperimentID: oid.Hex(),
+			Name:         rulegen.GetString(experiment, "name"),
+			Status:       ExperimentStatus(experiment),
+			Changes:      []TopicChange{},
+		}
+		legacy, err := es.completeExperiment(oid.Hex(), topic.Legacy())
+		if err == nil {
+			var current bson.M
+			current, err = es.completeExperiment(oid.Hex(), es.AppConfig.Topics)
+			if err == nil {
+				migration.Changes = topicChanges(experimentTopics(legacy), experimentTopics(current))
+			}
+		}
+		if err != nil {
+			migration.Error = err.Error()
+		}
+		if len(migration.Changes) > 0 || migration.Error != "" {
+			report = append(report, migration)
+		}
+	}
+	return report, nil
+}
+
+type topicSource struct {
+	device string
+	source string
+}
+
+// sourceTopic is the topic of a source, or the error that left it without one.
+type sourceTopic struct {
+	topic string
+	err   string
+}
+
+func topicOf(source bson.M) sourceTopic {
+	return sourceTopic{topic: rulegen.GetString(source, "mqttTopic"), err: rulegen.GetString(source, "mqttTopicError")}
+}
+
+// experimentTopics collects the topics of a complete experiment by device and source.
+func experimentTopics(complete bson.M) map[topicSource]sourceTopic {
+	topics := map[topicSource]sourceTopic{}
+	devices, _ := complete["devices"].(bson.M)
+	for deviceName, device := range devices {
+		deviceMap, ok := device.(bson.M)
+		if !ok {
+			continue
+		}
+		services, _ := deviceMap["services"].([]bson.M)
+		for _, service := range services {
+			characteristics, _ := service["characteristics"].([]bson.M)
+			for _, characteristic := range characteristics {
+				source := rulegen.GetString(service, "uuid") + "/" + rulegen.GetString(characteristic, "name")
+				topics[topicSource{deviceName, source}] = topicOf(characteristic)
+			}
+		}
+		mw, _ := deviceMap["movesense_whiteboard"].(bson.M)
+		measures, _ := mw["measures"].([]bson.M)
+		for _, measure := range measures {
+			topics[topicSource{deviceName, "movesense/" + rulegen.GetString(measure, "name")}] = topicOf(measure)
+		}
+	}
+	return topics
+}
+
+func topicChanges(from map[topicSource]sourceTopic, to map[topicSource]sourceTopic) []TopicChange {
+	keys := slices.SortedFunc(maps.Keys(from), func(a, b topicSource) int {
+		return cmp.Or(cmp.Compare(a.device, b.device), cmp.Compare(a.source, b.source))
+	})
+	changes := []TopicChange{}
+	for _, key := range keys {
+		if from[key].topic != to[key].topic || to[key].err != "" {
+			changes = append(changes, TopicChange{Device: key.device, Source: key.source, From: from[key].topic, To: to[key].topic, Error: to[key].err})
+		}
+	}
+	return changes
+}
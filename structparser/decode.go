@@ -0,0 +1,185 @@
+package structparser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decode reads the values of a payload: int64 for signed integers, uint64 for
+// unsigned ones, float64 for floats and scaled fields, bool, string (without
+// the zero padding) and, for a block, a []interface{} of
+// map[string]interface{}. It returns the number of bytes read, which is less
+// than len(payload) when the payload has trailing bytes.
+func (l *Layout) Decode(payload []byte) (map[string]interface{}, int, error) {
+	d := &decoder{data: payload}
+	values, err := d.fields(l.Fields, "")
+	if err != nil {
+		return nil, d.position, err
+	}
+	return values, d.position, nil
+}
+
+type decoder struct {
+	data     []byte
+	position int
+}
+
+func (d *decoder) fields(fields []Field, path string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, f := range fields {
+		fieldPath := join(path, f.Name)
+		if f.Type != TypeBlock {
+			value, err := d.value(f, fieldPath)
+			if err != nil {
+				return nil, err
+			}
+			values[f.Name] = value
+			continue
+		}
+		repeat := f.Repeat
+		switch {
+		case f.RepeatField != "":
+			n, err := repetitions(values[f.RepeatField])
+			if err != nil {
+				return nil, fmt.Errorf("field %s: repeat %s: %w", fieldPath, f.RepeatField, err)
+			}
+			repeat = n
+		case repeat == 0:
+			// until the end of the payload, in whole repetitions
+			remaining := len(d.data) - d.position
+			repeat = remaining / f.Size
+			if remaining%f.Size != 0 {
+				return nil, fmt.Errorf("%w: field %s: %d bytes left, not a multiple of the %d bytes of a repetition", ErrShortPayload, fieldPath, remaining, f.Size)
+			}
+		}
+		// check before allocating: the count may come from the payload. A block
+		// of variable size (holding a counted block) takes at least a byte.
+		size := max(f.Size, 1)
+		if repeat > (len(d.data)-d.position)/size {
+			return nil, fmt.Errorf("%w: field %s needs %d repetitions of at least %d bytes at offset %d, the payload has %d bytes", ErrShortPayload, fieldPath, repeat, size, d.position, len(d.data))
+		}
+		block := make([]interface{}, 0, repeat)
+		for i := 0; i < repeat; i++ {
+			element, err := d.fields(f.Fields, fmt.Sprintf("%s[%d]", fieldPath, i))
+			if err != nil {
+				return nil, err
+			}
+			block = append(block, element)
+		}
+		values[f.Name] = block
+	}
+	return values, nil
+}
+
+func (d *decoder) value(f Field, path string) (interface{}, error) {
+	size := f.Size
+	if size == 0 {
+		// a string without length
+		size = len(d.data) - d.position
+	}
+	if d.position+size > len(d.data) {
+		return nil, fmt.Errorf("%w: field %s (%s) needs %d bytes at offset %d, the payload has %d bytes", ErrShortPayload, path, f.Type, size, d.position, len(d.data))
+	}
+	b := d.data[d.position : d.position+size]
+	d.position += size
+
+	switch f.Type {
+	case TypeBool:
+		return b[0] != 0, nil
+	case TypeString:
+		return strings.TrimRight(string(b), "\x00"), nil
+	}
+	bits := unsignedBits(b, f.Endianness)
+	var value interface{}
+	switch f.Type {
+	case TypeFloat32:
+		value = float64(math.Float32frombits(uint32(bits)))
+	case TypeFloat64:
+		value = math.Float64frombits(bits)
+	default:
+		if strings.HasPrefix(f.Type, "uint") {
+			value = bits
+		} else {
+			// sign extension from the top bit of the value
+			shift := 64 - 8*size
+			value = int64(bits<<shift) >> shift
+		}
+	}
+	if !f.Scaled() {
+		return value, nil
+	}
+	n, _ := number(value)
+	if f.Scale != nil {
+		n *= *f.Scale
+	}
+	if f.Offset != nil {
+		n += *f.Offset
+	}
+	return n, nil
+}
+
+// unsignedBits reads up to 8 bytes as an unsigned integer.
+func unsignedBits(b []byte, endianness string) uint64 {
+	padded := make([]byte, 8)
+	if endianness == Big {
+		copy(padded[8-len(b):], b)
+		return binary.BigEndian.Uint64(padded)
+	}
+	copy(padded, b)
+	return binary.LittleEndian.Uint64(padded)
+}
+
+// repetitions returns the count read from a counter field.
+func repetitions(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int64:
+		if n >= 0 && n <= math.MaxInt32 {
+			return int(n), nil
+		}
+	case uint64:
+		if n <= math.MaxInt32 {
+			return int(n), nil
+		}
+	default:
+		return 0, fmt.Errorf("%w: not an integer", ErrInvalidValue)
+	}
+	return 0, fmt.Errorf("%w: invalid count %v", ErrInvalidValue, v)
+}
+
+// number returns the value of any number type as a float64.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,140 @@
+package structparser
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		payload string
+		want    map[string]interface{}
+	}{
+		{"int8", `{"fields": [{"name": "v", "type": "int8"}]}`, "ff", map[string]interface{}{"v": int64(-1)}},
+		{"uint8", `{"fields": [{"name": "v", "type": "uint8"}]}`, "ff", map[string]interface{}{"v": uint64(255)}},
+		{"int16 little", `{"fields": [{"name": "v", "type": "int16"}]}`, "fe ff", map[string]interface{}{"v": int64(-2)}},
+		{"int16 big", `{"fields": [{"name": "v", "type": "int16", "endianness": "big"}]}`, "ff fe", map[string]interface{}{"v": int64(-2)}},
+		{"uint16 little", `{"fields": [{"name": "v", "type": "uint16"}]}`, "01 02", map[string]interface{}{"v": uint64(0x0201)}},
+		{"uint16 big", `{"fields": [{"name": "v", "type": "uint16", "endianness": "big"}]}`, "01 02", map[string]interface{}{"v": uint64(0x0102)}},
+		{"int24 little minus one", `{"fields": [{"name": "v", "type": "int24"}]}`, "ff ff ff", map[string]interface{}{"v": int64(-1)}},
+		{"int24 little minimum", `{"fields": [{"name": "v", "type": "int24"}]}`, "00 00 80", map[string]interface{}{"v": int64(-8388608)}},
+		{"int24 big maximum", `{"fields": [{"name": "v", "type": "int24", "endianness": "big"}]}`, "7f ff ff", map[string]interface{}{"v": int64(8388607)}},
+		{"int24 big negative", `{"fields": [{"name": "v", "type": "int24", "endianness": "big"}]}`, "80 00 01", map[string]interface{}{"v": int64(-8388607)}},
+		{"uint24 little", `{"fields": [{"name": "v", "type": "uint24"}]}`, "ff ff ff", map[string]interface{}{"v": uint64(16777215)}},
+		{"uint24 big", `{"fields": [{"name": "v", "type": "uint24", "endianness": "big"}]}`, "01 02 03", map[string]interface{}{"v": uint64(0x010203)}},
+		{"int32 little", `{"fields": [{"name": "v", "type": "int32"}]}`, "01 00 00 80", map[string]interface{}{"v": int64(math.MinInt32 + 1)}},
+		{"int32 big", `{"fields": [{"name": "v", "type": "int32", "endianness": "big"}]}`, "ff ff ff fe", map[string]interface{}{"v": int64(-2)}},
+		{"uint32 little", `{"fields": [{"name": "v", "type": "uint32"}]}`, "ef be ad de", map[string]interface{}{"v": uint64(0xdeadbeef)}},
+		{"uint32 big", `{"fields": [{"name": "v", "type": "uint32", "endianness": "big"}]}`, "de ad be ef", map[string]interface{}{"v": uint64(0xdeadbeef)}},
+		{"int64 little", `{"fields": [{"name": "v", "type": "int64"}]}`, "00 00 00 00 00 00 00 80", map[string]interface{}{"v": int64(math.MinInt64)}},
+		{"int64 big", `{"fields": [{"name": "v", "type": "int64", "endianness": "big"}]}`, "ff ff ff ff ff ff ff fe", map[string]interface{}{"v": int64(-2)}},
+		{"uint64 little", `{"fields": [{"name": "v", "type": "uint64"}]}`, "ff ff ff ff ff ff ff ff", map[string]interface{}{"v": uint64(math.MaxUint64)}},
+		{"uint64 big", `{"fields": [{"name": "v", "type": "uint64", "endianness": "big"}]}`, "01 00 00 00 00 00 00 02", map[string]interface{}{"v": uint64(1<<56 + 2)}},
+		{"float32 little", `{"fields": [{"name": "v", "type": "float32"}]}`, "00 00 c0 3f", map[string]interface{}{"v": 1.5}},
+		{"float32 big", `{"fields": [{"name": "v", "type": "float32", "endianness": "big"}]}`, "c1 20 00 00", map[string]interface{}{"v": -10.0}},
+		{"float64 little", `{"fields": [{"name": "v", "type": "float64"}]}`, "00 00 00 00 00 00 f8 3f", map[string]interface{}{"v": 1.5}},
+		{"float64 big", `{"fields": [{"name": "v", "type": "float64", "endianness": "big"}]}`, "c0 24 00 00 00 00 00 00", map[string]interface{}{"v": -10.0}},
+		{"layout endianness inherited", `{"endianness": "big", "fields": [{"name": "a", "type": "uint16"}, {"name": "b", "type": "uint16", "endianness": "little"}]}`,
+			"01 02 01 02", map[string]interface{}{"a": uint64(0x0102), "b": uint64(0x0201)}},
+		{"missing type is int32", `{"fields": [{"name": "v"}]}`, "ff ff ff ff", map[string]interface{}{"v": int64(-1)}},
+		{"bool", `{"fields": [{"name": "a", "type": "bool"}, {"name": "b", "type": "bool"}, {"name": "c", "type": "bool"}]}`,
+			"00 01 02", map[string]interface{}{"a": false, "b": true, "c": true}},
+		{"fixed-length string", `{"fields": [{"name": "s", "type": "string", "length": 4}, {"name": "v", "type": "uint8"}]}`,
+			"61 62 00 00 07", map[string]interface{}{"s": "ab", "v": uint64(7)}},
+		{"full fixed-length string", `{"fields": [{"name": "s", "type": "string", "length": 2}]}`, "61 62", map[string]interface{}{"s": "ab"}},
+		{"char", `{"fields": [{"name": "c", "type": "char"}, {"name": "v", "type": "uint8"}]}`, "78 01", map[string]interface{}{"c": "x", "v": uint64(1)}},
+		{"rest-of-payload string", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "s", "type": "string"}]}`,
+			"01 68 65 6c 6c 6f", map[string]interface{}{"id": uint64(1), "s": "hello"}},
+		{"empty rest-of-payload string", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "s", "type": "string"}]}`,
+			"01", map[string]interface{}{"id": uint64(1), "s": ""}},
+		{"scale and offset", `{"fields": [{"name": "t", "type": "int16", "scale": 0.5, "offset": -10}]}`, "64 00", map[string]interface{}{"t": 40.0}},
+		{"negative scaled", `{"fields": [{"name": "t", "type": "int8", "scale": 0.25}]}`, "fc", map[string]interface{}{"t": -1.0}},
+		{"offset only", `{"fields": [{"name": "t", "type": "uint8", "offset": 100}]}`, "05", map[string]interface{}{"t": 105.0}},
+		{"scaled float", `{"fields": [{"name": "t", "type": "float32", "scale": 2, "offset": 1}]}`, "00 00 c0 3f", map[string]interface{}{"t": 4.0}},
+		{"fixed repeat", `{"fields": [{"name": "b", "repeat": 2, "fields": [{"name": "x", "type": "uint8"}, {"name": "y", "type": "int16", "endianness": "big"}]}]}`,
+			"01 ff fe 02 00 03", map[string]interface{}{"b": []interface{}{
+				map[string]interface{}{"x": uint64(1), "y": int64(-2)},
+				map[string]interface{}{"x": uint64(2), "y": int64(3)},
+			}}},
+		{"field-counted repeat", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}, {"name": "end", "type": "uint8"}]}`,
+			"02 0a 0b ff", map[string]interface{}{"n": uint64(2), "b": []interface{}{
+				map[string]interface{}{"x": uint64(10)},
+				map[string]interface{}{"x": uint64(11)},
+			}, "end": uint64(255)}},
+		{"field-counted repeat of zero", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			"00", map[string]interface{}{"n": uint64(0), "b": []interface{}{}}},
+		{"nested counted repeat", `{"fields": [{"name": "n", "type": "int32"}, {"name": "b", "repeat": "n", "fields": [{"name": "m", "type": "uint8"}, {"name": "c", "repeat": "m", "fields": [{"name": "x", "type": "uint8"}]}]}]}`,
+			"02 00 00 00 01 09 00", map[string]interface{}{"n": int64(2), "b": []interface{}{
+				map[string]interface{}{"m": uint64(1), "c": []interface{}{map[string]interface{}{"x": uint64(9)}}},
+				map[string]interface{}{"m": uint64(0), "c": []interface{}{}},
+			}}},
+		{"until-end repeat", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "samples", "fields": [{"name": "v", "type": "int16"}]}]}`,
+			"01 ff ff 02 00", map[string]interface{}{"id": uint64(1), "samples": []interface{}{
+				map[string]interface{}{"v": int64(-1)},
+				map[string]interface{}{"v": int64(2)},
+			}}},
+		{"empty until-end repeat", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "samples", "fields": [{"name": "v", "type": "int16"}]}]}`,
+			"01", map[string]interface{}{"id": uint64(1), "samples": []interface{}{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytesOf(t, tt.payload)
+			values, read, err := mustParse(t, tt.layout).Decode(payload)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if read != len(payload) {
+				t.Errorf("read %d bytes, want %d", read, len(payload))
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("Decode = %#v, want %#v", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTrailingBytes(t *testing.T) {
+	values, read, err := mustParse(t, `{"fields": [{"name": "v", "type": "uint16"}]}`).Decode(bytesOf(t, "01 00 ff ff"))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if read != 2 || values["v"] != uint64(1) {
+		t.Errorf("Decode = %v, %d, want v=1 after 2 bytes", values, read)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		payload string
+		want    error
+	}{
+		{"empty payload", `{"fields": [{"name": "v", "type": "uint8"}]}`, "", ErrShortPayload},
+		{"short number", `{"fields": [{"name": "v", "type": "int32"}]}`, "01 02 03", ErrShortPayload},
+		{"short int24", `{"fields": [{"name": "a", "type": "uint8"}, {"name": "v", "type": "int24"}]}`, "01 02 03", ErrShortPayload},
+		{"short string", `{"fields": [{"name": "s", "type": "string", "length": 4}]}`, "61 62", ErrShortPayload},
+		{"short fixed repeat", `{"fields": [{"name": "b", "repeat": 2, "fields": [{"name": "x", "type": "uint16"}]}]}`, "01 00 02", ErrShortPayload},
+		{"short counted repeat", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint16"}]}]}`, "02 01 00", ErrShortPayload},
+		{"until-end repeat cut", `{"fields": [{"name": "b", "fields": [{"name": "x", "type": "uint16"}]}]}`, "01 00 02", ErrShortPayload},
+		{"negative count", `{"fields": [{"name": "n", "type": "int8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`, "ff", ErrInvalidValue},
+		{"huge count", `{"fields": [{"name": "n", "type": "uint64"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`, "ff ff ff ff ff ff ff ff", ErrInvalidValue},
+		// the count is checked against the payload before allocating the block
+		{"count larger than the payload", `{"fields": [{"name": "n", "type": "int32"}, {"name": "b", "repeat": "n", "fields": [{"name": "m", "type": "uint8"}, {"name": "c", "repeat": "m", "fields": [{"name": "x", "type": "uint8"}]}]}]}`,
+			"ff ff ff 7f", ErrShortPayload},
+		{"nested count larger than the payload", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "m", "type": "uint32"}, {"name": "c", "repeat": "m", "fields": [{"name": "x", "type": "uint64"}]}]}]}`,
+			"01 ff ff ff 7f 00", ErrShortPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _, err := mustParse(t, tt.layout).Decode(bytesOf(t, tt.payload))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decode = %v, %v, want %v", values, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package structparser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// Encode writes values in the layout, the inverse of Decode: numbers may be
+// of any Go number type or json.Number, blocks []interface{} or
+// []map[string]interface{} of values. A scaled field takes its decoded value
+// and writes round((value-offset)/scale). A counter named by a block's repeat
+// may be left out: it is set to the number of repetitions given.
+func (l *Layout) Encode(values map[string]interface{}) ([]byte, error) {
+	return encodeFields(nil, l.Fields, values, "")
+}
+
+func encodeFields(buf []byte, fields []Field, values map[string]interface{}, path string) ([]byte, error) {
+	values = maps.Clone(values)
+	for _, f := range fields {
+		if f.RepeatField == "" {
+			continue
+		}
+		if _, ok := values[f.RepeatField]; !ok {
+			if elements, ok := blockElements(values[f.Name]); ok {
+				values[f.RepeatField] = len(elements)
+			}
+		}
+	}
+	var err error
+	for _, f := range fields {
+		fieldPath := join(path, f.Name)
+		value, ok := values[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: missing value", ErrInvalidValue, fieldPath)
+		}
+		if f.Type != TypeBlock {
+			if buf, err = encodeValue(buf, f, value, fieldPath); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		elements, ok := blockElements(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: a block takes a list of objects", ErrInvalidValue, fieldPath)
+		}
+		want := -1
+		switch {
+		case f.Repeat > 0:
+			want = f.Repeat
+		case f.RepeatField != "":
+			n, ok := bigInteger(values[f.RepeatField])
+			if !ok || !n.IsInt64() || n.Int64() < 0 {
+				return nil, fmt.Errorf("%w: field %s: repeat %s is not a count", ErrInvalidValue, fieldPath, f.RepeatField)
+			}
+			want = int(n.Int64())
+		}
+		if want >= 0 && len(elements) != want {
+			return nil, fmt.Errorf("%w: field %s: %d repetitions given, %d expected", ErrInvalidValue, fieldPath, len(elements), want)
+		}
+		for i, element := range elements {
+			if buf, err = encodeFields(buf, f.Fields, element, fmt.Sprintf("%s[%d]", fieldPath, i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+func encodeValue(buf []byte, f Field, value interface{}, path string) ([]byte, error) {
+	switch f.Type {
+	case TypeBool:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: %v is not a bool", ErrInvalidValue, path, value)
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case TypeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: %v is not a string", ErrInvalidValue, path, value)
+		}
+		if f.Length == 0 {
+			return append(buf, s...), nil
+		}
+		if len(s) > f.Length {
+			return nil, fmt.Errorf("%w: field %s: %q is longer than %d bytes", ErrInvalidValue, path, s, f.Length)
+		}
+		return append(append(buf, s...), make([]byte, f.Length-len(s))...), nil
+	}
+
+	given := value
+	if f.Scaled() {
+		n, ok := number(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: %v is not a number", ErrInvalidValue, path, value)
+		}
+		if f.Offset != nil {
+			n -= *f.Offset
+		}
+		if f.Scale != nil {
+			n /= *f.Scale
+		}
+		value = n
+		if f.Integer() {
+			value = math.Round(n)
+		}
+	}
+
+	var bits uint64
+	switch f.Type {
+	case TypeFloat32, TypeFloat64:
+		n, ok := number(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: %v is not a number", ErrInvalidValue, path, value)
+		}
+		bits = math.Float64bits(n)
+		if f.Type == TypeFloat32 {
+			bits = uint64(math.Float32bits(float32(n)))
+		}
+	default:
+		n, ok := bigInteger(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s: %v is not an integer", ErrInvalidValue, path, value)
+		}
+		width := uint(8 * f.Size)
+		low, high := new(big.Int), new(big.Int).Lsh(big.NewInt(1), width)
+		if !strings.HasPrefix(f.Type, "uint") {
+			high.Rsh(high, 1)
+			low.Neg(high)
+		}
+		if n.Cmp(low) < 0 || n.Cmp(high) >= 0 {
+			return nil, fmt.Errorf("%w: field %s: %v is out of the range of %s", ErrInvalidValue, path, given, f.Type)
+		}
+		if n.Sign() < 0 {
+			bits = uint64(n.Int64())
+		} else {
+			bits = n.Uint64()
+		}
+	}
+	b := binary.LittleEndian.AppendUint64(nil, bits)[:f.Size]
+	if f.Endianness == Big {
+		slices.Reverse(b)
+	}
+	return append(buf, b...), nil
+}
+
+// blockElements returns the repetitions of a block value.
+func blockElements(v interface{}) ([]map[string]interface{}, bool) {
+	switch l := v.(type) {
+	case []map[string]interface{}:
+		return l, true
+	case nil:
+		return nil, false
+	}
+	list, ok := array(v)
+	if !ok {
+		return nil, false
+	}
+	elements := []map[string]interface{}{}
+	for _, item := range list {
+		m, ok := object(item)
+		if !ok {
+			return nil, false
+		}
+		elements = append(elements, m)
+	}
+	return elements, true
+}
+
+// bigInteger returns the exact value of an integer of any number type; floats
+// must have no fractional part.
+func bigInteger(v interface{}) (*big.Int, bool) {
+	switch n := v.(type) {
+	case int:
+		return big.NewInt(int64(n)), true
+	case int8:
+		return big.NewInt(int64(n)), true
+	case int16:
+		return big.NewInt(int64(n)), true
+	case int32:
+		return big.NewInt(int64(n)), true
+	case int64:
+		return big.NewInt(n), true
+	case uint:
+		return new(big.Int).SetUint64(uint64(n)), true
+	case uint8:
+		return new(big.Int).SetUint64(uint64(n)), true
+	case uint16:
+		return new(big.Int).SetUint64(uint64(n)), true
+	case uint32:
+		return new(big.Int).SetUint64(uint64(n)), true
+	case uint64:
+		return new(big.Int).SetUint64(n), true
+	case json.Number:
+		if i, ok := new(big.Int).SetString(string(n), 10); ok {
+			return i, true
+		}
+	}
+	f, ok := number(v)
+	if !ok || math.IsInf(f, 0) || math.IsNaN(f) || f != math.Trunc(f) {
+		return nil, false
+	}
+	i, _ := big.NewFloat(f).Int(nil)
+	return i, true
+}
@@ -0,0 +1,163 @@
+package structparser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		values map[string]interface{}
+		want   string
+	}{
+		{"int8", `{"fields": [{"name": "v", "type": "int8"}]}`, map[string]interface{}{"v": -1}, "ff"},
+		{"uint8", `{"fields": [{"name": "v", "type": "uint8"}]}`, map[string]interface{}{"v": uint8(255)}, "ff"},
+		{"int16 little", `{"fields": [{"name": "v", "type": "int16"}]}`, map[string]interface{}{"v": int16(-2)}, "fe ff"},
+		{"int16 big", `{"fields": [{"name": "v", "type": "int16", "endianness": "big"}]}`, map[string]interface{}{"v": -2}, "ff fe"},
+		{"uint16 little", `{"fields": [{"name": "v", "type": "uint16"}]}`, map[string]interface{}{"v": 0x0201}, "01 02"},
+		{"uint16 big", `{"fields": [{"name": "v", "type": "uint16", "endianness": "big"}]}`, map[string]interface{}{"v": uint16(0x0102)}, "01 02"},
+		{"int24 little minimum", `{"fields": [{"name": "v", "type": "int24"}]}`, map[string]interface{}{"v": -8388608}, "00 00 80"},
+		{"int24 big maximum", `{"fields": [{"name": "v", "type": "int24", "endianness": "big"}]}`, map[string]interface{}{"v": 8388607}, "7f ff ff"},
+		{"uint24 little", `{"fields": [{"name": "v", "type": "uint24"}]}`, map[string]interface{}{"v": 16777215}, "ff ff ff"},
+		{"uint24 big", `{"fields": [{"name": "v", "type": "uint24", "endianness": "big"}]}`, map[string]interface{}{"v": 0x010203}, "01 02 03"},
+		{"int32 little", `{"fields": [{"name": "v", "type": "int32"}]}`, map[string]interface{}{"v": int32(math.MinInt32 + 1)}, "01 00 00 80"},
+		{"uint32 big", `{"fields": [{"name": "v", "type": "uint32", "endianness": "big"}]}`, map[string]interface{}{"v": uint32(0xdeadbeef)}, "de ad be ef"},
+		{"int64 little", `{"fields": [{"name": "v", "type": "int64"}]}`, map[string]interface{}{"v": int64(math.MinInt64)}, "00 00 00 00 00 00 00 80"},
+		{"int64 big", `{"fields": [{"name": "v", "type": "int64", "endianness": "big"}]}`, map[string]interface{}{"v": json.Number("-2")}, "ff ff ff ff ff ff ff fe"},
+		{"uint64 little", `{"fields": [{"name": "v", "type": "uint64"}]}`, map[string]interface{}{"v": json.Number("18446744073709551615")}, "ff ff ff ff ff ff ff ff"},
+		{"uint64 big", `{"fields": [{"name": "v", "type": "uint64", "endianness": "big"}]}`, map[string]interface{}{"v": uint64(1<<56 + 2)}, "01 00 00 00 00 00 00 02"},
+		{"integer given as a float", `{"fields": [{"name": "v", "type": "uint16"}]}`, map[string]interface{}{"v": 258.0}, "02 01"},
+		{"float32 little", `{"fields": [{"name": "v", "type": "float32"}]}`, map[string]interface{}{"v": 1.5}, "00 00 c0 3f"},
+		{"float32 big", `{"fields": [{"name": "v", "type": "float32", "endianness": "big"}]}`, map[string]interface{}{"v": -10}, "c1 20 00 00"},
+		{"float64 little", `{"fields": [{"name": "v", "type": "float64"}]}`, map[string]interface{}{"v": float32(1.5)}, "00 00 00 00 00 00 f8 3f"},
+		{"float64 big", `{"fields": [{"name": "v", "type": "float64", "endianness": "big"}]}`, map[string]interface{}{"v": json.Number("-10")}, "c0 24 00 00 00 00 00 00"},
+		{"bool", `{"fields": [{"name": "a", "type": "bool"}, {"name": "b", "type": "bool"}]}`, map[string]interface{}{"a": false, "b": true}, "00 01"},
+		{"padded string", `{"fields": [{"name": "s", "type": "string", "length": 4}, {"name": "v", "type": "uint8"}]}`,
+			map[string]interface{}{"s": "ab", "v": 7}, "61 62 00 00 07"},
+		{"rest-of-payload string", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "s", "type": "string"}]}`,
+			map[string]interface{}{"id": 1, "s": "hello"}, "01 68 65 6c 6c 6f"},
+		{"scale and offset", `{"fields": [{"name": "t", "type": "int16", "scale": 0.5, "offset": -10}]}`, map[string]interface{}{"t": 40}, "64 00"},
+		{"scaled value rounded", `{"fields": [{"name": "t", "type": "int16", "scale": 0.5, "offset": -10}]}`, map[string]interface{}{"t": 40.2}, "64 00"},
+		{"negative scaled", `{"fields": [{"name": "t", "type": "int8", "scale": 0.25}]}`, map[string]interface{}{"t": -1.0}, "fc"},
+		{"scaled float", `{"fields": [{"name": "t", "type": "float32", "scale": 2, "offset": 1}]}`, map[string]interface{}{"t": 4}, "00 00 c0 3f"},
+		{"fixed repeat", `{"fields": [{"name": "b", "repeat": 2, "fields": [{"name": "x", "type": "uint8"}, {"name": "y", "type": "int16", "endianness": "big"}]}]}`,
+			map[string]interface{}{"b": []map[string]interface{}{{"x": 1, "y": -2}, {"x": 2, "y": 3}}}, "01 ff fe 02 00 03"},
+		{"counter set from the block", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"b": []interface{}{map[string]interface{}{"x": 10}, map[string]interface{}{"x": 11}}}, "02 0a 0b"},
+		{"counter given", `{"fields": [{"name": "n", "type": "uint16"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"n": 1, "b": []interface{}{map[string]interface{}{"x": 10}}}, "01 00 0a"},
+		{"nested counters", `{"fields": [{"name": "n", "type": "int32"}, {"name": "b", "repeat": "n", "fields": [{"name": "m", "type": "uint8"}, {"name": "c", "repeat": "m", "fields": [{"name": "x", "type": "uint8"}]}]}]}`,
+			map[string]interface{}{"b": []interface{}{
+				map[string]interface{}{"c": []interface{}{map[string]interface{}{"x": 9}}},
+				map[string]interface{}{"c": []interface{}{}},
+			}}, "02 00 00 00 01 09 00"},
+		{"until-end repeat", `{"fields": [{"name": "id", "type": "uint8"}, {"name": "samples", "fields": [{"name": "v", "type": "int16"}]}]}`,
+			map[string]interface{}{"id": 1, "samples": []interface{}{map[string]interface{}{"v": -1}, map[string]interface{}{"v": 2}}}, "01 ff ff 02 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := mustParse(t, tt.layout).Encode(tt.values)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if want := bytesOf(t, tt.want); !bytes.Equal(payload, want) {
+				t.Errorf("Encode = % x, want % x", payload, want)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+		values map[string]interface{}
+	}{
+		{"missing value", `{"fields": [{"name": "a", "type": "uint8"}, {"name": "b", "type": "uint8"}]}`, map[string]interface{}{"a": 1}},
+		{"int8 overflow", `{"fields": [{"name": "v", "type": "int8"}]}`, map[string]interface{}{"v": 128}},
+		{"int8 underflow", `{"fields": [{"name": "v", "type": "int8"}]}`, map[string]interface{}{"v": -129}},
+		{"negative unsigned", `{"fields": [{"name": "v", "type": "uint8"}]}`, map[string]interface{}{"v": -1}},
+		{"int24 overflow", `{"fields": [{"name": "v", "type": "int24"}]}`, map[string]interface{}{"v": 8388608}},
+		{"uint24 overflow", `{"fields": [{"name": "v", "type": "uint24"}]}`, map[string]interface{}{"v": 1 << 24}},
+		{"uint64 overflow", `{"fields": [{"name": "v", "type": "uint64"}]}`, map[string]interface{}{"v": json.Number("18446744073709551616")}},
+		{"scaled overflow", `{"fields": [{"name": "v", "type": "uint8", "scale": 0.1}]}`, map[string]interface{}{"v": 25.6}},
+		{"fractional integer", `{"fields": [{"name": "v", "type": "int16"}]}`, map[string]interface{}{"v": 1.5}},
+		{"not a number", `{"fields": [{"name": "v", "type": "float32"}]}`, map[string]interface{}{"v": "1.5"}},
+		{"not a bool", `{"fields": [{"name": "v", "type": "bool"}]}`, map[string]interface{}{"v": 1}},
+		{"not a string", `{"fields": [{"name": "s", "type": "string", "length": 2}]}`, map[string]interface{}{"s": 12}},
+		{"string too long", `{"fields": [{"name": "s", "type": "string", "length": 2}]}`, map[string]interface{}{"s": "abc"}},
+		{"block not a list", `{"fields": [{"name": "b", "repeat": 1, "fields": [{"name": "x", "type": "uint8"}]}]}`, map[string]interface{}{"b": map[string]interface{}{"x": 1}}},
+		{"wrong fixed repeat", `{"fields": [{"name": "b", "repeat": 2, "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"b": []interface{}{map[string]interface{}{"x": 1}}}},
+		{"counter mismatch", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"n": 3, "b": []interface{}{map[string]interface{}{"x": 1}}}},
+		{"counter too small for the block", `{"fields": [{"name": "n", "type": "uint8"}, {"name": "b", "repeat": "n", "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"b": make([]map[string]interface{}, 256)}},
+		{"missing value in a block", `{"fields": [{"name": "b", "repeat": 1, "fields": [{"name": "x", "type": "uint8"}]}]}`,
+			map[string]interface{}{"b": []interface{}{map[string]interface{}{}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := mustParse(t, tt.layout).Encode(tt.values)
+			if !errors.Is(err, ErrInvalidValue) {
+				t.Errorf("Encode = % x, %v, want ErrInvalidValue", payload, err)
+			}
+		})
+	}
+}
+
+// Encode is the inverse of Decode.
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	layout := mustParse(t, `{"endianness": "big", "fields": [
+		{"name": "id", "type": "uint24"},
+		{"name": "ok", "type": "bool"},
+		{"name": "name", "type": "string", "length": 8},
+		{"name": "temperature", "type": "int16", "scale": 0.5, "offset": -40},
+		{"name": "n", "type": "uint8"},
+		{"name": "readings", "repeat": "n", "endianness": "little", "fields": [
+			{"name": "at", "type": "uint32"},
+			{"name": "value", "type": "float64"},
+			{"name": "delta", "type": "int24"}
+		]},
+		{"name": "samples", "fields": [{"name": "v", "type": "int64"}]}
+	]}`)
+	values := map[string]interface{}{
+		"id":          uint64(0xabcdef),
+		"ok":          true,
+		"name":        "sensor",
+		"temperature": 21.5,
+		"n":           uint64(2),
+		"readings": []interface{}{
+			map[string]interface{}{"at": uint64(1700000000), "value": 3.25, "delta": int64(-5)},
+			map[string]interface{}{"at": uint64(1700000060), "value": -0.125, "delta": int64(8388607)},
+		},
+		"samples": []interface{}{
+			map[string]interface{}{"v": int64(math.MinInt64)},
+			map[string]interface{}{"v": int64(math.MaxInt64)},
+		},
+	}
+	payload, err := layout.Encode(values)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	decoded, read, err := layout.Decode(payload)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if read != len(payload) {
+		t.Errorf("read %d bytes of %d", read, len(payload))
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("Decode(Encode(values)) = %#v, want %#v", decoded, values)
+	}
+	again, err := layout.Encode(decoded)
+	if err != nil || !bytes.Equal(again, payload) {
+		t.Errorf("Encode(Decode(payload)) = % x, %v, want % x", again, err, payload)
+	}
+}
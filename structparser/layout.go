@@ -0,0 +1,383 @@
+// Package structparser interprets the structParser of a BLE characteristic: the
+// binary layout of the values the sensor notifies. Parse checks a structParser
+// document and returns its Layout in canonical form; Decode reads the values of
+// a payload and Encode writes them, e.g. to simulate a sensor.
+//
+// A structParser lists its fields in payload order:
+//
+//	{"endianness": "little", "fields": [
+//	    {"name": "temperature", "type": "int16", "scale": 0.01, "unit": "°C"},
+//	    {"name": "label", "type": "string", "length": 8},
+//	    {"name": "count", "type": "uint8"},
+//	    {"name": "samples", "repeat": "count", "fields": [
+//	        {"name": "x", "type": "int16", "endianness": "big"}]}]}
+//
+// Numbers are little-endian unless the structParser or the field says "big". A
+// scaled field (scale and/or offset) is decoded as raw*scale+offset, a float. A
+// string has a fixed length in bytes and is zero padded; without length it takes
+// the rest of the payload and must be the last field. A block repeats its fields
+// a fixed number of times (repeat: 3), as many times as the value of an integer
+// field read before it at the same level (repeat: "count") or, without repeat,
+// until the end of the payload, in which case it must be the last field. The
+// unit of a value is only documentation: it is not used to decode.
+package structparser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Byte orders.
+const (
+	Little = "little"
+	Big    = "big"
+)
+
+// Canonical field types.
+const (
+	TypeInt8    = "int8"
+	TypeInt16   = "int16"
+	TypeInt24   = "int24"
+	TypeInt32   = "int32"
+	TypeInt64   = "int64"
+	TypeUint8   = "uint8"
+	TypeUint16  = "uint16"
+	TypeUint24  = "uint24"
+	TypeUint32  = "uint32"
+	TypeUint64  = "uint64"
+	TypeFloat32 = "float32"
+	TypeFloat64 = "float64"
+	TypeBool    = "bool"
+	TypeString  = "string"
+	TypeBlock   = "block"
+)
+
+var (
+	// ErrInvalidLayout is returned by Parse for a malformed structParser.
+	ErrInvalidLayout = errors.New("invalid structParser")
+	// ErrShortPayload is returned by Decode when the payload ends before a field.
+	ErrShortPayload = errors.New("payload too short")
+	// ErrInvalidValue is returned by Encode for a missing or unrepresentable value.
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// sizes is the size in bytes of the fixed-size canonical types.
+var sizes = map[string]int{
+	TypeInt8: 1, TypeUint8: 1, TypeBool: 1,
+	TypeInt16: 2, TypeUint16: 2,
+	TypeInt24: 3, TypeUint24: 3,
+	TypeInt32: 4, TypeUint32: 4, TypeFloat32: 4,
+	TypeInt64: 8, TypeUint64: 8, TypeFloat64: 8,
+}
+
+// aliases maps the other accepted type names to their canonical type. A
+// missing type is an int32, as every struct field was before types were
+// honoured; char is a string of one byte unless it has a length.
+var aliases = map[string]string{
+	"": TypeInt32, "int": TypeInt32, "integer": TypeInt32,
+	"uint": TypeUint32, "float": TypeFloat32, "double": TypeFloat64,
+	"boolean": TypeBool, "char": TypeString,
+}
+
+// Layout is a parsed structParser. Size is the size in bytes of the payload, 0
+// when it is variable.
+type Layout struct {
+	Endianness string  `json:"endianness"`
+	Size       int     `json:"size,omitempty"`
+	Fields     []Field `json:"fields"`
+}
+
+// Field is a value of the layout, or a repeated block of fields when Type is
+// TypeBlock. Size is the size in bytes of the value (of one repetition for a
+// block), 0 when variable; ByteOffset is its position from the start of its
+// level, unset after a variable-size field. Endianness is set on multi-byte
+// numbers only.
+type Field struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Endianness  string   `json:"endianness,omitempty"`
+	Length      int      `json:"length,omitempty"`
+	Size        int      `json:"size,omitempty"`
+	ByteOffset  *int     `json:"byteOffset,omitempty"`
+	Scale       *float64 `json:"scale,omitempty"`
+	Offset      *float64 `json:"offset,omitempty"`
+	Repeat      int      `json:"repeat,omitempty"`
+	RepeatField string   `json:"repeatField,omitempty"`
+	Fields      []Field  `json:"fields,omitempty"`
+	Unit        string   `json:"unit,omitempty"`
+}
+
+// Scaled reports whether the field is decoded as raw*scale+offset.
+func (f Field) Scaled() bool {
+	return f.Scale != nil || f.Offset != nil
+}
+
+// Integer reports whether the field is a signed or unsigned integer.
+func (f Field) Integer() bool {
+	return strings.HasPrefix(f.Type, "int") || strings.HasPrefix(f.Type, "uint")
+}
+
+func (f Field) numeric() bool {
+	return f.Integer() || f.Type == TypeFloat32 || f.Type == TypeFloat64
+}
+
+// CanonicalType returns the canonical type of a declared field type.
+func CanonicalType(declared string) (string, error) {
+	declared = strings.ToLower(strings.TrimSpace(declared))
+	if _, ok := sizes[declared]; ok || declared == TypeString {
+		return declared, nil
+	}
+	if t, ok := aliases[declared]; ok {
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown type %q (use int8…int64, uint8…uint64, float32, float64, bool or string)", declared)
+}
+
+// Parse checks a structParser document (a bson or JSON object) and returns its
+// layout. Every problem found is reported, wrapped in ErrInvalidLayout. The
+// canonical form of a layout parses to the same layout.
+func Parse(structParser interface{}) (*Layout, error) {
+	document, ok := object(structParser)
+	if !ok {
+		return nil, fmt.Errorf("%w: a structParser must be an object", ErrInvalidLayout)
+	}
+	p := &parser{}
+	endianness := p.endianness(document["endianness"], Little, "")
+	fields, size := p.fields(document["fields"], "", endianness)
+	if len(p.errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidLayout, errors.Join(p.errs...))
+	}
+	return &Layout{Endianness: endianness, Size: size, Fields: fields}, nil
+}
+
+// parser collects the problems of a structParser.
+type parser struct {
+	errs []error
+}
+
+func (p *parser) fail(path string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if path != "" {
+		message = "field " + path + ": " + message
+	}
+	p.errs = append(p.errs, errors.New(message))
+}
+
+func (p *parser) endianness(v interface{}, inherited string, path string) string {
+	if v == nil {
+		return inherited
+	}
+	s, _ := v.(string)
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "little", "le":
+		return Little
+	case "big", "be":
+		return Big
+	}
+	p.fail(path, "unknown endianness %v (use little or big)", v)
+	return inherited
+}
+
+// fields parses the fields of a level; size is 0 when the level has a
+// variable size. Only the top level (path "") may end with a value taking the
+// rest of the payload.
+func (p *parser) fields(v interface{}, path string, endianness string) ([]Field, int) {
+	list, ok := array(v)
+	if !ok {
+		p.fail(path, "fields must be a list")
+		return []Field{}, 0
+	}
+	if path != "" && len(list) == 0 {
+		p.fail(path, "a block needs fields")
+	}
+	result := []Field{}
+	seen := map[string]Field{}
+	position := 0 // -1 once a variable-size field is met
+	for i, item := range list {
+		m, ok := object(item)
+		if !ok {
+			p.fail(join(path, fmt.Sprintf("#%d", i)), "not an object")
+			continue
+		}
+		name, _ := m["name"].(string)
+		fieldPath := join(path, name)
+		if name == "" {
+			fieldPath = join(path, fmt.Sprintf("#%d", i))
+			p.fail(fieldPath, "missing name")
+		} else if _, ok := seen[name]; ok {
+			p.fail(fieldPath, "duplicate name")
+		}
+		last := i == len(list)-1
+
+		var f Field
+		if _, ok := m["fields"]; ok {
+			f = p.block(m, fieldPath, endianness, seen, path == "" && last)
+		} else {
+			f = p.value(m, fieldPath, endianness, path == "" && last)
+		}
+		f.Name = name
+		if position >= 0 {
+			offset := position
+			f.ByteOffset = &offset
+		}
+		size := f.Size
+		if f.Type == TypeBlock {
+			size = 0
+			if f.Repeat > 0 {
+				size = f.Repeat * f.Size
+			}
+		}
+		if size == 0 {
+			position = -1
+		} else if position >= 0 {
+			position += size
+		}
+		seen[name] = f
+		result = append(result, f)
+	}
+	if position < 0 {
+		return result, 0
+	}
+	return result, position
+}
+
+// value parses a number, bool or string field.
+func (p *parser) value(m map[string]interface{}, path string, endianness string, last bool) Field {
+	declared, ok := m["type"].(string)
+	if !ok && m["type"] != nil {
+		p.fail(path, "type must be a string")
+	}
+	t, err := CanonicalType(declared)
+	if err != nil {
+		p.fail(path, "%v", err)
+		return Field{Type: TypeInt32, Size: sizes[TypeInt32]}
+	}
+	f := Field{Type: t, Size: sizes[t]}
+	if length, ok := m["length"]; ok {
+		n, ok := count(length)
+		switch {
+		case t != TypeString:
+			p.fail(path, "only strings have a length")
+		case !ok || n == 0:
+			p.fail(path, "length must be a positive integer")
+		default:
+			f.Length, f.Size = n, n
+		}
+	} else if t == TypeString && strings.EqualFold(strings.TrimSpace(declared), "char") {
+		f.Length, f.Size = 1, 1
+	} else if t == TypeString && !last {
+		p.fail(path, "a string without length takes the rest of the payload: it must be the last field of the structParser, or have a length")
+	}
+
+	f.Endianness = p.endianness(m["endianness"], endianness, path)
+	if !f.numeric() || f.Size == 1 {
+		f.Endianness = ""
+	}
+	if unit, ok := m["unit"]; ok && unit != nil {
+		if f.Unit, ok = unit.(string); !ok {
+			p.fail(path, "unit must be a string")
+		}
+	}
+	for _, key := range []string{"scale", "offset"} {
+		target := &f.Scale
+		if key == "offset" {
+			target = &f.Offset
+		}
+		v, ok := m[key]
+		if !ok || v == nil {
+			continue
+		}
+		n, ok := number(v)
+		switch {
+		case !f.numeric():
+			p.fail(path, "only numbers have a %s", key)
+		case !ok || math.IsNaN(n) || math.IsInf(n, 0):
+			p.fail(path, "%s must be a number", key)
+		case key == "scale" && n == 0:
+			p.fail(path, "scale cannot be 0")
+		default:
+			*target = &n
+		}
+	}
+	return f
+}
+
+// block parses a repeated block; seen holds the fields read before it at its level.
+func (p *parser) block(m map[string]interface{}, path string, endianness string, seen map[string]Field, last bool) Field {
+	if declared, _ := m["type"].(string); declared != "" && declared != TypeBlock {
+		p.fail(path, "a block with fields has no type")
+	}
+	endianness = p.endianness(m["endianness"], endianness, path)
+	fields, size := p.fields(m["fields"], path, endianness)
+	f := Field{Type: TypeBlock, Size: size, Fields: fields}
+
+	repeat := m["repeat"]
+	if repeat == nil {
+		repeat = m["repeatField"]
+	}
+	switch r := repeat.(type) {
+	case nil:
+		if !last {
+			p.fail(path, "a block without repeat is read until the end of the payload and must be the last field of the structParser")
+		}
+	case string:
+		counter, ok := seen[r]
+		if !ok || counter.Type == TypeBlock || !counter.Integer() || counter.Scaled() {
+			p.fail(path, "repeat %q must name an unscaled integer field before the block", r)
+		}
+		f.RepeatField = r
+	default:
+		n, ok := count(r)
+		if !ok || n == 0 {
+			p.fail(path, "repeat must be a positive integer or the name of a field")
+		}
+		f.Repeat = n
+	}
+	if size == 0 && f.Repeat == 0 && f.RepeatField == "" {
+		p.fail(path, "a block read until the end of the payload needs fields of fixed size")
+	}
+	return f
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// object accepts both bson documents and the plain maps decoded from JSON.
+func object(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case primitive.M:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	return nil, false
+}
+
+func array(v interface{}) ([]interface{}, bool) {
+	switch l := v.(type) {
+	case primitive.A:
+		return l, true
+	case []interface{}:
+		return l, true
+	case nil:
+		return []interface{}{}, true
+	}
+	return nil, false
+}
+
+// count returns a non-negative integer given as any number type.
+func count(v interface{}) (int, bool) {
+	n, ok := number(v)
+	if !ok || n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
@@ -0,0 +1,237 @@
+package structparser
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mustParse parses a structParser given as JSON.
+func mustParse(t *testing.T, document string) *Layout {
+	t.Helper()
+	var structParser map[string]interface{}
+	if err := json.Unmarshal([]byte(document), &structParser); err != nil {
+		t.Fatalf("bad test layout %s: %v", document, err)
+	}
+	layout, err := Parse(structParser)
+	if err != nil {
+		t.Fatalf("Parse(%s): %v", document, err)
+	}
+	return layout
+}
+
+// bytesOf decodes hex bytes, spaces allowed.
+func bytesOf(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad test payload %q: %v", s, err)
+	}
+	return b
+}
+
+func TestParseOffsetsAndSizes(t *testing.T) {
+	layout := mustParse(t, `{"fields": [
+		{"name": "a", "type": "int8"},
+		{"name": "b", "type": "uint16"},
+		{"name": "s", "type": "string", "length": 3},
+		{"name": "pairs", "repeat": 2, "fields": [{"name": "x", "type": "uint8"}, {"name": "y", "type": "int16"}]},
+		{"name": "f", "type": "float32"}
+	]}`)
+	if layout.Size != 16 {
+		t.Errorf("Size = %d, want 16", layout.Size)
+	}
+	wantOffsets := []int{0, 1, 3, 6, 12}
+	wantSizes := []int{1, 2, 3, 3, 4}
+	for i, f := range layout.Fields {
+		if f.ByteOffset == nil || *f.ByteOffset != wantOffsets[i] {
+			t.Errorf("field %s: ByteOffset = %v, want %d", f.Name, f.ByteOffset, wantOffsets[i])
+		}
+		if f.Size != wantSizes[i] {
+			t.Errorf("field %s: Size = %d, want %d", f.Name, f.Size, wantSizes[i])
+		}
+	}
+	if y := layout.Fields[3].Fields[1]; y.ByteOffset == nil || *y.ByteOffset != 1 {
+		t.Errorf("pairs.y: ByteOffset = %v, want 1", y.ByteOffset)
+	}
+
+	variable := mustParse(t, `{"fields": [
+		{"name": "n", "type": "uint8"},
+		{"name": "items", "repeat": "n", "fields": [{"name": "v", "type": "uint8"}]},
+		{"name": "after", "type": "uint8"}
+	]}`)
+	if variable.Size != 0 {
+		t.Errorf("Size = %d, want 0 after a counted block", variable.Size)
+	}
+	if items := variable.Fields[1]; items.ByteOffset == nil || *items.ByteOffset != 1 || items.RepeatField != "n" {
+		t.Errorf("items = %+v, want offset 1 repeated by n", items)
+	}
+	if after := variable.Fields[2]; after.ByteOffset != nil {
+		t.Errorf("after: ByteOffset = %d, want unset after a variable-size field", *after.ByteOffset)
+	}
+}
+
+func TestParseTypesAndEndianness(t *testing.T) {
+	layout := mustParse(t, `{"endianness": "BE", "fields": [
+		{"name": "missing"},
+		{"name": "int", "type": " INT "},
+		{"name": "uint", "type": "uint"},
+		{"name": "float", "type": "float"},
+		{"name": "double", "type": "double", "endianness": "le"},
+		{"name": "boolean", "type": "boolean"},
+		{"name": "char", "type": "char"},
+		{"name": "byte", "type": "uint8"},
+		{"name": "block", "repeat": 1, "endianness": "little", "fields": [{"name": "v", "type": "int16"}]},
+		{"name": "text", "type": "string"}
+	]}`)
+	want := []struct {
+		typ        string
+		endianness string
+		size       int
+	}{
+		{TypeInt32, Big, 4},
+		{TypeInt32, Big, 4},
+		{TypeUint32, Big, 4},
+		{TypeFloat32, Big, 4},
+		{TypeFloat64, Little, 8},
+		{TypeBool, "", 1},
+		{TypeString, "", 1},
+		{TypeUint8, "", 1},
+		{TypeBlock, "", 2},
+		{TypeString, "", 0},
+	}
+	if layout.Endianness != Big {
+		t.Errorf("Endianness = %q, want big", layout.Endianness)
+	}
+	for i, f := range layout.Fields {
+		if f.Type != want[i].typ || f.Endianness != want[i].endianness || f.Size != want[i].size {
+			t.Errorf("field %s = %s/%q/%d, want %s/%q/%d", f.Name, f.Type, f.Endianness, f.Size, want[i].typ, want[i].endianness, want[i].size)
+		}
+	}
+	if v := layout.Fields[8].Fields[0]; v.Endianness != Little {
+		t.Errorf("block.v: Endianness = %q, want the little endianness of its block", v.Endianness)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     []string
+	}{
+		{"not an object", `[]`, []string{"a structParser must be an object"}},
+		{"fields not a list", `{"fields": {}}`, []string{"fields must be a list"}},
+		{"field not an object", `{"fields": [1]}`, []string{"field #0: not an object"}},
+		{"missing name", `{"fields": [{"type": "int8"}]}`, []string{"field #0: missing name"}},
+		{"duplicate name", `{"fields": [{"name": "a", "type": "int8"}, {"name": "a", "type": "int8"}]}`, []string{"field a: duplicate name"}},
+		{"unknown type", `{"fields": [{"name": "a", "type": "int12"}]}`, []string{`field a: unknown type "int12"`}},
+		{"type not a string", `{"fields": [{"name": "a", "type": 8}]}`, []string{"field a: type must be a string"}},
+		{"unknown endianness", `{"endianness": "middle", "fields": []}`, []string{"unknown endianness middle"}},
+		{"field endianness", `{"fields": [{"name": "a", "type": "int16", "endianness": "pdp"}]}`, []string{"field a: unknown endianness pdp"}},
+		{"length on a number", `{"fields": [{"name": "a", "type": "int16", "length": 2}]}`, []string{"field a: only strings have a length"}},
+		{"zero length", `{"fields": [{"name": "a", "type": "string", "length": 0}]}`, []string{"field a: length must be a positive integer"}},
+		{"fractional length", `{"fields": [{"name": "a", "type": "string", "length": 1.5}]}`, []string{"field a: length must be a positive integer"}},
+		{"string without length not last", `{"fields": [{"name": "a", "type": "string"}, {"name": "b", "type": "int8"}]}`, []string{"field a: a string without length takes the rest of the payload"}},
+		{"string without length in a block", `{"fields": [{"name": "b", "repeat": 1, "fields": [{"name": "a", "type": "string"}]}]}`, []string{"field b.a: a string without length"}},
+		{"zero scale", `{"fields": [{"name": "a", "type": "int16", "scale": 0}]}`, []string{"field a: scale cannot be 0"}},
+		{"scale not a number", `{"fields": [{"name": "a", "type": "int16", "scale": "x"}]}`, []string{"field a: scale must be a number"}},
+		{"offset on a string", `{"fields": [{"name": "a", "type": "string", "length": 2, "offset": 1}]}`, []string{"field a: only numbers have a offset"}},
+		{"unit not a string", `{"fields": [{"name": "a", "type": "int16", "unit": 1}]}`, []string{"field a: unit must be a string"}},
+		{"block with a type", `{"fields": [{"name": "b", "type": "int8", "repeat": 1, "fields": [{"name": "a", "type": "int8"}]}]}`, []string{"field b: a block with fields has no type"}},
+		{"empty block", `{"fields": [{"name": "b", "repeat": 1, "fields": []}]}`, []string{"field b: a block needs fields"}},
+		{"zero repeat", `{"fields": [{"name": "b", "repeat": 0, "fields": [{"name": "a", "type": "int8"}]}]}`, []string{"field b: repeat must be a positive integer"}},
+		{"unknown counter", `{"fields": [{"name": "b", "repeat": "n", "fields": [{"name": "a", "type": "int8"}]}]}`, []string{`field b: repeat "n" must name an unscaled integer field`}},
+		{"counter after the block", `{"fields": [{"name": "b", "repeat": "n", "fields": [{"name": "a", "type": "int8"}]}, {"name": "n", "type": "uint8"}]}`, []string{`repeat "n" must name`}},
+		{"float counter", `{"fields": [{"name": "n", "type": "float32"}, {"name": "b", "repeat": "n", "fields": [{"name": "a", "type": "int8"}]}]}`, []string{`repeat "n" must name`}},
+		{"scaled counter", `{"fields": [{"name": "n", "type": "uint8", "scale": 2}, {"name": "b", "repeat": "n", "fields": [{"name": "a", "type": "int8"}]}]}`, []string{`repeat "n" must name`}},
+		{"until-end block not last", `{"fields": [{"name": "b", "fields": [{"name": "a", "type": "int8"}]}, {"name": "c", "type": "int8"}]}`, []string{"field b: a block without repeat is read until the end of the payload"}},
+		{"until-end block of variable size", `{"fields": [{"name": "b", "fields": [{"name": "n", "type": "uint8"}, {"name": "c", "repeat": "n", "fields": [{"name": "a", "type": "int8"}]}]}]}`, []string{"field b: a block read until the end of the payload needs fields of fixed size"}},
+		{"every problem reported", `{"endianness": "middle", "fields": [
+			{"name": "a", "type": "int12"},
+			{"name": "a", "type": "int8"},
+			{"type": "uint8"},
+			{"name": "s", "type": "int16", "scale": 0}
+		]}`, []string{"unknown endianness middle", `field a: unknown type "int12"`, "field a: duplicate name", "field #2: missing name", "field s: scale cannot be 0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var structParser interface{}
+			if err := json.Unmarshal([]byte(tt.document), &structParser); err != nil {
+				t.Fatalf("bad test layout: %v", err)
+			}
+			layout, err := Parse(structParser)
+			if !errors.Is(err, ErrInvalidLayout) {
+				t.Fatalf("Parse = %+v, %v, want ErrInvalidLayout", layout, err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBson(t *testing.T) {
+	layout, err := Parse(primitive.M{
+		"endianness": "big",
+		"fields": primitive.A{
+			primitive.M{"name": "n", "type": "uint8"},
+			primitive.M{"name": "b", "repeat": "n", "fields": primitive.A{
+				primitive.M{"name": "v", "type": "int16", "scale": int32(2), "offset": 0.5, "unit": "°C"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	v := layout.Fields[1].Fields[0]
+	if v.Endianness != Big || *v.Scale != 2 || *v.Offset != 0.5 || v.Unit != "°C" {
+		t.Errorf("b.v = %+v", v)
+	}
+}
+
+// The canonical form of a layout (its JSON) parses to the same layout.
+func TestParseCanonical(t *testing.T) {
+	documents := []string{
+		`{"fields": []}`,
+		`{"endianness": "big", "fields": [
+			{"name": "a"},
+			{"name": "b", "type": "uint24", "endianness": "little"},
+			{"name": "c", "type": "char"},
+			{"name": "d", "type": "double", "scale": 0.1, "offset": -40, "unit": "°C"},
+			{"name": "e", "type": "boolean"},
+			{"name": "s", "type": "string", "length": 6}
+		]}`,
+		`{"fields": [
+			{"name": "n", "type": "uint16"},
+			{"name": "fixed", "repeat": 2, "endianness": "big", "fields": [{"name": "x", "type": "int16"}]},
+			{"name": "counted", "repeat": "n", "fields": [
+				{"name": "m", "type": "uint8"},
+				{"name": "inner", "repeat": "m", "fields": [{"name": "y", "type": "float32"}]}
+			]},
+			{"name": "rest", "fields": [{"name": "z", "type": "int64"}]}
+		]}`,
+		`{"fields": [{"name": "id", "type": "uint8"}, {"name": "text", "type": "string"}]}`,
+	}
+	for _, document := range documents {
+		layout := mustParse(t, document)
+		canonical, err := json.Marshal(layout)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		again := mustParse(t, string(canonical))
+		if !reflect.DeepEqual(layout, again) {
+			t.Errorf("canonical %s parses to a different layout:\n got %+v\nwant %+v", canonical, again, layout)
+		}
+		twice, _ := json.Marshal(again)
+		if string(twice) != string(canonical) {
+			t.Errorf("canonical form changed:\n got %s\nwant %s", twice, canonical)
+		}
+	}
+}
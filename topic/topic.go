@@ -0,0 +1,242 @@
+// Package topic names the MQTT topics the gateways publish sensor data on. Topics
+// are rendered from templates with the placeholders {experiment}, {sensor},
+// {mac}, {service}, {characteristic} and {gateway}, e.g.
+//
+//	qiot/{experiment}/{sensor}/{mac}/{characteristic}
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Default templates, matching the topics used before they were configurable.
+const (
+	DefaultTemplate           = "qiot/{experiment}/{sensor}/{mac}/{characteristic}"
+	DefaultWhiteboardTemplate = "qiot/{experiment}/{mac}/ble/movesense/{characteristic}"
+)
+
+// ErrInvalidTopic is returned for templates or values producing an illegal MQTT topic.
+var ErrInvalidTopic = errors.New("invalid MQTT topic")
+
+// maxTopicLength is the MQTT limit on the UTF-8 length of a topic name.
+const maxTopicLength = 65535
+
+var (
+	// wildcards are removed from values, like spaces from names
+	wildcards    = strings.NewReplacer("+", "", "#", "", "\x00", "")
+	placeholder  = regexp.MustCompile(`\{([a-z]+)\}`)
+	placeholders = map[string]bool{"experiment": true, "sensor": true, "mac": true, "service": true, "characteristic": true, "gateway": true}
+)
+
+// Values fills the placeholders of a template. An empty Gateway renders as the
+// single-level wildcard "+", so the topic matches every gateway.
+type Values struct {
+	Experiment     string
+	Sensor         string
+	MAC            string
+	Service        string
+	Characteristic string
+	Gateway        string
+}
+
+// Template is a parsed, validated topic template.
+type Template struct {
+	raw string
+	// verbatim templates render values unchanged, as the legacy topics were built
+	verbatim bool
+}
+
+// Parse validates a template: known placeholders only, no empty levels, no
+// wildcards or NUL in the fixed text, {gateway} alone in its level.
+func Parse(template string) (Template, error) {
+	if template == "" {
+		return Template{}, fmt.Errorf("%w: empty template", ErrInvalidTopic)
+	}
+	if strings.HasPrefix(template, "$") {
+		return Template{}, fmt.Errorf("%w: %q: topics starting with $ are reserved", ErrInvalidTopic, template)
+	}
+	for _, level := range strings.Split(template, "/") {
+		if level == "" {
+			return Template{}, fmt.Errorf("%w: %q has an empty level", ErrInvalidTopic, template)
+		}
+		for _, match := range placeholder.FindAllStringSubmatch(level, -1) {
+			if !placeholders[match[1]] {
+				return Template{}, fmt.Errorf("%w: %q: unknown placeholder %s", ErrInvalidTopic, template, match[0])
+			}
+			if match[1] == "gateway" && level != match[0] {
+				return Template{}, fmt.Errorf("%w: %q: {gateway} must be a whole level", ErrInvalidTopic, template)
+			}
+		}
+		fixed := placeholder.ReplaceAllString(level, "")
+		if strings.ContainsAny(fixed, "+#{}\x00") {
+			return Template{}, fmt.Errorf("%w: %q: level %q contains an illegal character", ErrInvalidTopic, template, level)
+		}
+	}
+	return Template{raw: template}, nil
+}
+
+func (t Template) String() string {
+	return t.raw
+}
+
+// Render fills the template. Every placeholder used must have a value (except
+// {gateway}). Wildcards and NUL are removed from values; a "/" in a value adds
+// levels, as in the legacy topics of Movesense measures such as Meas/Acc/13.
+func (t Template) Render(v Values) (string, error) {
+	values := map[string]string{
+		"experiment":     v.Experiment,
+		"sensor":         v.Sensor,
+		"mac":            v.MAC,
+		"service":        v.Service,
+		"characteristic": v.Characteristic,
+		"gateway":        v.Gateway,
+	}
+	var errs []error
+	topic := placeholder.ReplaceAllStringFunc(t.raw, func(match string) string {
+		name := match[1 : len(match)-1]
+		value := values[name]
+		if !t.verbatim {
+			value = wildcards.Replace(value)
+		}
+		switch {
+		case values[name] == "" && name == "gateway":
+			return "+"
+		case value == "":
+			errs = append(errs, fmt.Errorf("%w: no value for {%s} in %q", ErrInvalidTopic, name, t.raw))
+		}
+		return value
+	})
+	if len(topic) > maxTopicLength {
+		errs = append(errs, fmt.Errorf("%w: topic longer than %d bytes", ErrInvalidTopic, maxTopicLength))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", err
+	}
+	return topic, nil
+}
+
+// Namer renders the topics of BLE characteristics and Movesense whiteboard measures.
+type Namer struct {
+	Template           Template
+	WhiteboardTemplate Template
+}
+
+// NewNamer parses the two templates; empty strings select the defaults.
+func NewNamer(template string, whiteboardTemplate string) (*Namer, error) {
+	if template == "" {
+		template = DefaultTemplate
+	}
+	if whiteboardTemplate == "" {
+		whiteboardTemplate = DefaultWhiteboardTemplate
+	}
+	t, err := Parse(template)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := Parse(whiteboardTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &Namer{Template: t, WhiteboardTemplate: wt}, nil
+}
+
+// Legacy returns the namer producing the topics used before templates were
+// configurable, values included as they are.
+func Legacy() *Namer {
+	return &Namer{
+		Template:           Template{raw: DefaultTemplate, verbatim: true},
+		WhiteboardTemplate: Template{raw: DefaultWhiteboardTemplate, verbatim: true},
+	}
+}
+
+// Characteristic returns the topic of a BLE characteristic. Names are lower-cased
+// without spaces and the MAC address without colons.
+func (n *Namer) Characteristic(experimentId, sensorName, mac, serviceUuid, characteristicName, gateway string) (string, error) {
+	return n.Template.Render(Values{
+		Experiment:     experimentId,
+		Sensor:         compact(sensorName, " "),
+		MAC:            compact(mac, ":"),
+		Service:        strings.ToLower(serviceUuid),
+		Characteristic: compact(characteristicName, " "),
+		Gateway:        gateway,
+	})
+}
+
+// Measure returns the topic of a Movesense whiteboard measure; the measure
+// name (lower-cased, without colons) fills {characteristic}.
+func (n *Namer) Measure(experimentId, sensorName, mac, measureName, gateway string) (string, error) {
+	return n.WhiteboardTemplate.Render(Values{
+		Experiment:     experimentId,
+		Sensor:         compact(sensorName, " "),
+		MAC:            compact(mac, ":"),
+		Service:        "movesense",
+		Characteristic: compact(measureName, ":"),
+		Gateway:        gateway,
+	})
+}
+
+// ACLFilters returns the topic filters covering every topic a gateway publishes
+// for an experiment, e.g. "qiot/<experimentId>/#" with the default templates.
+// Each template is cut after the levels holding only fixed text, {experiment}
+// or {gateway}; the cut must include {experiment}.
+func (n *Namer) ACLFilters(experimentId string, gateway string) ([]string, error) {
+	filters := []string{}
+	for _, t := range []Template{n.Template, n.WhiteboardTemplate} {
+		levels := strings.Split(t.raw, "/")
+		scoped := false
+		prefix := []string{}
+		for _, level := range levels {
+			specific, experiment := false, false
+			for _, match := range placeholder.FindAllStringSubmatch(level, -1) {
+				experiment = experiment || match[1] == "experiment"
+				specific = specific || (match[1] != "experiment" && match[1] != "gateway")
+			}
+			if specific {
+				break
+			}
+			scoped = scoped || experiment
+			prefix = append(prefix, level)
+		}
+		if !scoped {
+			return nil, fmt.Errorf("%w: %q: {experiment} must come before the other placeholders to scope an ACL", ErrInvalidTopic, t.raw)
+		}
+		scope := strings.Join(prefix, "/")
+		if len(prefix) < len(levels) {
+			scope += "/#"
+		}
+		filter, err := Template{raw: scope}.Render(Values{Experiment: experimentId, Gateway: gateway})
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(filters, filter) {
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+// ValidFilter reports whether a rendered topic can be used in a rule
+// (wildcards only as whole levels).
+func ValidFilter(topic string) bool {
+	if topic == "" || strings.ContainsRune(topic, 0) {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func compact(value string, remove string) string {
+	return strings.ToLower(strings.ReplaceAll(value, remove, ""))
+}
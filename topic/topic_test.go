@@ -0,0 +1,54 @@
+package topic
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNamerValues(t *testing.T) {
+	namer, err := NewNamer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  func(n *Namer) (string, error)
+		want string
+		// legacy is the topic of the legacy namer, with the values unchanged
+		legacy string
+	}{
+		{
+			name: "characteristic",
+			got: func(n *Namer) (string, error) {
+				return n.Characteristic("e1", "Thermo Meter", "AA:BB", "180A", "Temp Hum", "")
+			},
+			want:   "qiot/e1/thermometer/aabb/temphum",
+			legacy: "qiot/e1/thermometer/aabb/temphum",
+		},
+		{
+			name:   "wildcards removed",
+			got:    func(n *Namer) (string, error) { return n.Characteristic("e1", "s#1", "AA:BB", "180a", "temp+hum", "") },
+			want:   "qiot/e1/s1/aabb/temphum",
+			legacy: "qiot/e1/s#1/aabb/temp+hum",
+		},
+		{
+			name:   "slash adds levels",
+			got:    func(n *Namer) (string, error) { return n.Measure("e1", "ms", "0C:8C", "Meas/Acc/13", "") },
+			want:   "qiot/e1/0c8c/ble/movesense/meas/acc/13",
+			legacy: "qiot/e1/0c8c/ble/movesense/meas/acc/13",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := tt.got(namer); err != nil || got != tt.want {
+				t.Errorf("topic = %q, %v, want %q", got, err, tt.want)
+			}
+			if got, err := tt.got(Legacy()); err != nil || got != tt.legacy {
+				t.Errorf("legacy topic = %q, %v, want %q", got, err, tt.legacy)
+			}
+		})
+	}
+	if got, err := namer.Characteristic("e1", "s1", "AA:BB", "180a", "#", ""); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("topic of a name without legal characters = %q, %v, want ErrInvalidTopic", got, err)
+	}
+}